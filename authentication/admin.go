@@ -0,0 +1,57 @@
+package authentication
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionsPath is where administrators revoke sessions
+const SessionsPath = "/.well-known/sessions"
+
+// RevokeHandler lets administrators revoke sessions kept in the session store.
+// DELETE /.well-known/sessions/{id} revokes a single session while
+// DELETE /.well-known/sessions?user={email} revokes every session of a user
+func (helios Helios) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if helios.store == nil || helios.adminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(helios.adminToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, SessionsPath), "/")
+	user := r.URL.Query().Get("user")
+
+	var err error
+	switch {
+	case id != "":
+		log.Infof("Revoking session %q", id)
+		err = helios.store.Delete(id)
+	case user != "":
+		log.Infof("Revoking sessions of %q", user)
+		err = helios.store.DeleteUser(user)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
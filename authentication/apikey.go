@@ -0,0 +1,165 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceAccountProvider is the identity provider of requests authenticated with an API key
+const ServiceAccountProvider = "service-accounts"
+
+// DefaultAPIKeyHeader is the header API keys are read from by default
+const DefaultAPIKeyHeader = "X-Api-Key"
+
+// ErrAPIKey is returned when an API key is unknown or expired
+var ErrAPIKey = errors.New("invalid API key")
+
+// ServiceAccount is a named client authenticating with a static API key
+type ServiceAccount struct {
+	Name string `yaml:"name"`
+	// KeyHash is the hex encoded SHA-256 of the API key
+	KeyHash string   `yaml:"key_sha256"`
+	Groups  []string `yaml:"groups"`
+	// ExpiresAt is when the key stops being accepted, it never expires when zero
+	ExpiresAt time.Time `yaml:"expires"`
+}
+
+// identity returns the identity of requests authenticated as the service account
+func (a ServiceAccount) identity() Identity {
+	return Identity{Email: a.Name, Groups: a.Groups, Provider: ServiceAccountProvider}
+}
+
+// ServiceAccountsConfig service accounts configuration
+type ServiceAccountsConfig struct {
+	// Header is the request header holding the API key, defaults to DefaultAPIKeyHeader
+	Header   string
+	Accounts []ServiceAccount
+	// Path is a YAML file listing more service accounts, reloaded when it changes
+	Path string
+}
+
+// ServiceAccounts authenticates requests with API keys
+type ServiceAccounts struct {
+	header string
+	path   string
+	// accounts of the config, by key hash
+	accounts map[string]ServiceAccount
+
+	mu          sync.Mutex
+	fileModTime time.Time
+	file        map[string]ServiceAccount
+}
+
+// NewServiceAccounts creates service accounts with a given config, loading the accounts file if any
+func NewServiceAccounts(config ServiceAccountsConfig) (*ServiceAccounts, error) {
+	if config.Header == "" {
+		config.Header = DefaultAPIKeyHeader
+	}
+
+	accounts, err := indexServiceAccounts(config.Accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ServiceAccounts{header: config.Header, path: config.Path, accounts: accounts}
+	if s.path != "" {
+		if _, err := s.fileAccounts(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// indexServiceAccounts maps accounts by key hash, rejecting invalid and duplicate hashes
+func indexServiceAccounts(accounts []ServiceAccount) (map[string]ServiceAccount, error) {
+	index := make(map[string]ServiceAccount, len(accounts))
+	for _, a := range accounts {
+		if a.Name == "" {
+			return nil, errors.New("service account name is required")
+		}
+		hash, err := hex.DecodeString(a.KeyHash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("service account %q key_sha256 is not a hex encoded SHA-256", a.Name)
+		}
+		key := hex.EncodeToString(hash)
+		if _, ok := index[key]; ok {
+			return nil, fmt.Errorf("service account %q reuses the key of another account", a.Name)
+		}
+		index[key] = a
+	}
+	return index, nil
+}
+
+// fileAccounts returns the accounts of the file, reloading it if it changed
+func (s *ServiceAccounts) fileAccounts() (map[string]ServiceAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return s.file, err
+	}
+	if s.file != nil && info.ModTime().Equal(s.fileModTime) {
+		return s.file, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return s.file, err
+	}
+	var accounts []ServiceAccount
+	if err := yaml.Unmarshal(b, &accounts); err != nil {
+		return s.file, fmt.Errorf("cannot parse service accounts %q: %v", s.path, err)
+	}
+	index, err := indexServiceAccounts(accounts)
+	if err != nil {
+		return s.file, err
+	}
+
+	log.Debugf("Loaded %d service accounts from %q", len(index), s.path)
+	s.file = index
+	s.fileModTime = info.ModTime()
+
+	return s.file, nil
+}
+
+// Header returns the request header holding API keys
+func (s *ServiceAccounts) Header() string {
+	return s.header
+}
+
+// Authenticate returns the service account of an API key
+func (s *ServiceAccounts) Authenticate(key string) (ServiceAccount, error) {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	account, ok := s.accounts[hash]
+	if !ok && s.path != "" {
+		file, err := s.fileAccounts()
+		if err != nil {
+			// keep serving the accounts loaded last
+			log.Errorf("Cannot reload service accounts: %v", err)
+		}
+		account, ok = file[hash]
+	}
+	if !ok {
+		return ServiceAccount{}, ErrAPIKey
+	}
+
+	if !account.ExpiresAt.IsZero() && !time.Now().Before(account.ExpiresAt) {
+		log.Infof("API key of service account %q expired on %s", account.Name, account.ExpiresAt.Format(time.RFC3339))
+		return ServiceAccount{}, ErrAPIKey
+	}
+
+	return account, nil
+}
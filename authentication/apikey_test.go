@@ -0,0 +1,147 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestServiceAccounts_Authenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-accounts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("- name: backup\n  key_sha256: "+keyHash("backup-key")+"\n"), 0600))
+
+	accounts, err := NewServiceAccounts(ServiceAccountsConfig{
+		Accounts: []ServiceAccount{
+			{Name: "ci", KeyHash: keyHash("ci-key"), Groups: []string{"deployers"}},
+			{Name: "old", KeyHash: keyHash("old-key"), ExpiresAt: time.Now().Add(-time.Hour)},
+		},
+		Path: path,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultAPIKeyHeader, accounts.Header())
+
+	tests := []struct {
+		Key  string
+		Name string
+		Err  error
+	}{
+		{"ci-key", "ci", nil},
+		{"backup-key", "backup", nil},
+		{"old-key", "", ErrAPIKey},
+		{"unknown", "", ErrAPIKey},
+	}
+	for _, test := range tests {
+		account, err := accounts.Authenticate(test.Key)
+		assert.Equal(t, test.Err, err, test.Key)
+		assert.Equal(t, test.Name, account.Name, test.Key)
+	}
+
+	// the file is reloaded when it changes
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("- name: restore\n  key_sha256: "+keyHash("restore-key")+
+		"\n  groups: [ops]\n  expires: 2999-01-01\n"), 0600))
+	assert.NoError(t, os.Chtimes(path, later, later))
+
+	account, err := accounts.Authenticate("restore-key")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, account.Groups)
+	assert.Equal(t, 2999, account.ExpiresAt.Year())
+	_, err = accounts.Authenticate("backup-key")
+	assert.Equal(t, ErrAPIKey, err)
+
+	// the last accounts are kept while the file is invalid
+	assert.NoError(t, ioutil.WriteFile(path, []byte("- name: broken\n  key_sha256: nope\n"), 0600))
+	assert.NoError(t, os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)))
+	_, err = accounts.Authenticate("restore-key")
+	assert.NoError(t, err)
+}
+
+func TestNewServiceAccounts(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Accounts []ServiceAccount
+	}{
+		{"no name", []ServiceAccount{{KeyHash: keyHash("a")}}},
+		{"plain key", []ServiceAccount{{Name: "a", KeyHash: "a"}}},
+		{"duplicate", []ServiceAccount{{Name: "a", KeyHash: keyHash("a")}, {Name: "b", KeyHash: keyHash("a")}}},
+	}
+	for _, test := range tests {
+		_, err := NewServiceAccounts(ServiceAccountsConfig{Accounts: test.Accounts})
+		assert.Error(t, err, test.Name)
+	}
+
+	_, err := NewServiceAccounts(ServiceAccountsConfig{Path: "/does/not/exist.yaml"})
+	assert.Error(t, err)
+}
+
+func TestHelios_ServiceAccounts(t *testing.T) {
+	accounts, err := NewServiceAccounts(ServiceAccountsConfig{
+		Header:   "X-Helios-Key",
+		Accounts: []ServiceAccount{{Name: "ci", KeyHash: keyHash("ci-key"), Groups: []string{"deployers"}}},
+	})
+	assert.NoError(t, err)
+
+	oauth2 := new(mockProvider)
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:             JWTConfig{Secret: "test", Expiration: time.Minute},
+		ServiceAccounts: accounts,
+	})
+	mdw := auth.ForProviders(DefaultProviderName, ServiceAccountProvider).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		identity, _ := IdentityFromContext(req.Context())
+		assert.Equal(t, Identity{Email: "ci", Groups: []string{"deployers"}, Provider: ServiceAccountProvider}, identity)
+		assert.Empty(t, req.Header.Get("X-Helios-Key"))
+	}))
+
+	tests := []struct {
+		Key       string
+		Accept    string
+		Code      int
+		Challenge string
+	}{
+		{"ci-key", "", http.StatusOK, ""},
+		{"wrong", "", http.StatusUnauthorized, `APIKey realm="helios", header="X-Helios-Key"`},
+		{"", "application/json", http.StatusUnauthorized, `APIKey realm="helios", header="X-Helios-Key"`},
+		{"", "text/html", http.StatusTemporaryRedirect, ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://testing/", nil)
+		req.Header.Set("Accept", test.Accept)
+		if test.Key != "" {
+			req.Header.Set("X-Helios-Key", test.Key)
+		}
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+
+		assert.Equal(t, test.Code, res.Code, i)
+		assert.Equal(t, test.Challenge, res.Header().Get("WWW-Authenticate"), i)
+	}
+
+	// routes opt in to service accounts
+	for _, names := range [][]string{nil, {DefaultProviderName}} {
+		req := httptest.NewRequest("GET", "http://testing/", nil)
+		req.Header.Set("X-Helios-Key", "ci-key")
+		res := httptest.NewRecorder()
+		auth.ForProviders(names...).Middleware(http.NotFoundHandler()).ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusUnauthorized, res.Code, names)
+		assert.Equal(t, `Helios realm="helios"`, res.Header().Get("WWW-Authenticate"), names)
+	}
+}
@@ -0,0 +1,118 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// AssertionClaims are the claims of an identity assertion sent to upstreams
+type AssertionClaims struct {
+	jwt.StandardClaims
+	Email  string   `json:"email"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// AssertionSigner signs short-lived identity assertions that upstreams verify with the published JWKS
+type AssertionSigner struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+}
+
+// NewAssertionSigner creates a signer from a PEM encoded EC P-256 private key file.
+// An ephemeral key is generated when path is empty
+func NewAssertionSigner(path string) (*AssertionSigner, error) {
+	var key *ecdsa.PrivateKey
+	if path == "" {
+		log.Warn("No JWT signing key configured, identity assertions are signed with an ephemeral key")
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	} else {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = jwt.ParseECPrivateKeyFromPEM(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("signing key must use the P-256 curve")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &AssertionSigner{
+		key:   key,
+		keyID: base64.RawURLEncoding.EncodeToString(sum[:8]),
+	}, nil
+}
+
+// Sign issues an ES256 assertion of the identity for the given audience
+func (s *AssertionSigner) Sign(identity Identity, audience string, expiration time.Duration) (string, error) {
+	now := time.Now()
+	claims := &AssertionClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  audience,
+			ExpiresAt: now.Add(expiration).Unix(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			Issuer:    "Helios",
+			Subject:   identity.Email,
+		},
+		Email:  identity.Email,
+		Groups: identity.Groups,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.keyID
+
+	return token.SignedString(s.key)
+}
+
+// JWKSHandler publishes the verification key as a JSON Web Key Set
+func (s *AssertionSigner) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	size := (s.key.Curve.Params().BitSize + 7) / 8
+	coord := func(b []byte) string {
+		// coordinates must be left padded to the curve size
+		padded := make([]byte, size)
+		copy(padded[size-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(padded)
+	}
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"alg": "ES256",
+			"use": "sig",
+			"kid": s.keyID,
+			"x":   coord(s.key.X.Bytes()),
+			"y":   coord(s.key.Y.Bytes()),
+		}},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jwks); err != nil {
+		log.Error(err)
+	}
+}
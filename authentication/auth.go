@@ -4,9 +4,12 @@ import (
 	"encoding/base64"
 	"errors"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/session"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,6 +19,16 @@ const CookieName = "Helios_Authorization"
 // HeaderName is the name of the cookie that contains the JWT token
 const HeaderName = "Helios-Jwt-Assertion"
 
+// SignedOutPath serves the page users land on after logging out
+const SignedOutPath = "/.well-known/signed-out"
+
+const signedOutPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Signed out</title></head>
+<body><p>You have been signed out.</p></body>
+</html>
+`
+
 // ErrUnauthorized is returned by the middleware when a request is not authorized
 var ErrUnauthorized = errors.New("unauthorized request")
 
@@ -23,22 +36,121 @@ var ErrUnauthorized = errors.New("unauthorized request")
 type JWTConfig struct {
 	Secret     string
 	Expiration time.Duration
+	// EncryptionKeys encrypt session cookies when set. Tokens sent in the HeaderName header stay signed-only
+	EncryptionKeys []EncryptionKey
+}
+
+// Config authentication middleware configuration
+type Config struct {
+	JWT JWTConfig
+	// Store keeps sessions server-side, the cookie then holds an opaque session ID
+	Store session.Store
+	// AdminToken authorizes session revocation requests
+	AdminToken string
+	// RefreshInterval is how often sessions are re-validated with the identity provider.
+	// Defaults to half the JWT expiration
+	RefreshInterval time.Duration
+	// IdleTimeout ends sessions after a period of inactivity
+	IdleTimeout time.Duration
+	// MaxLifetime is the absolute session lifetime, renewals never extend it
+	MaxLifetime time.Duration
+	// SSO enables single sign-on across hosts
+	SSO SSOConfig
+	// Cookie session cookie attributes, DefaultCookieConfig is used when empty
+	Cookie CookieConfig
+	// Backchannel verifies logout tokens sent by the provider given to NewHeliosAuthenticationWithConfig
+	Backchannel BackchannelConfig
+	// Providers are the identity providers users can log in with, after the one given to
+	// NewHeliosAuthenticationWithConfig
+	Providers []Provider
+	// LoginPage brands the page users choose an identity provider on
+	LoginPage LoginPageConfig
+	// ServiceAccounts authenticates automation with API keys
+	ServiceAccounts *ServiceAccounts
+	// CLI lets command line clients log in
+	CLI CLIConfig
 }
 
 // Helios represents a middleware instance that can authenticate requests
 type Helios struct {
-	provider  providers.OAuth2Provider
-	jwtConfig JWTConfig
+	providers []Provider
+	// allowed restricts the providers accepted by the middleware, all are when empty
+	allowed         []string
+	loginPage       LoginPageConfig
+	jwtConfig       JWTConfig
+	store           session.Store
+	adminToken      string
+	refreshInterval time.Duration
+	idleTimeout     time.Duration
+	maxLifetime     time.Duration
+	sso             SSOConfig
+	cookie          CookieConfig
+	// codes holds one-time SSO codes
+	codes session.Store
+	// renewing tracks sessions being renewed in the background
+	renewing        *sync.Map
+	serviceAccounts *ServiceAccounts
+	// onUnauthenticated is the response to requests without valid credentials
+	onUnauthenticated UnauthenticatedAction
+	cli               CLIConfig
+	// devices holds pending device authorizations of command line clients
+	devices *deviceGrants
 }
 
 // NewHeliosAuthentication creates a new authentication middleware instance
 func NewHeliosAuthentication(provider providers.OAuth2Provider, jwtSecret string, jwtExpiration time.Duration) Helios {
-	return Helios{
-		provider: provider,
-		jwtConfig: JWTConfig{
+	return NewHeliosAuthenticationWithConfig(provider, Config{
+		JWT: JWTConfig{
 			Secret:     jwtSecret,
 			Expiration: jwtExpiration,
 		},
+	})
+}
+
+// NewHeliosAuthenticationWithConfig creates a new authentication middleware instance with a given config.
+// provider is named DefaultProviderName, it can be nil when config lists providers
+func NewHeliosAuthenticationWithConfig(provider providers.OAuth2Provider, config Config) Helios {
+	var idps []Provider
+	if provider != nil {
+		idps = append(idps, Provider{
+			OAuth2Provider: provider,
+			Name:           DefaultProviderName,
+			Backchannel:    config.Backchannel,
+		})
+	}
+	idps = append(idps, config.Providers...)
+
+	refreshInterval := config.RefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = config.JWT.Expiration / 2
+	}
+
+	cookie := config.Cookie
+	if cookie.Name == "" {
+		cookie = DefaultCookieConfig()
+	}
+
+	codes := config.Store
+	if codes == nil {
+		codes = session.NewMemoryStore()
+	}
+
+	return Helios{
+		providers:       idps,
+		loginPage:       config.LoginPage,
+		jwtConfig:       config.JWT,
+		store:           config.Store,
+		adminToken:      config.AdminToken,
+		refreshInterval: refreshInterval,
+		idleTimeout:     config.IdleTimeout,
+		maxLifetime:     config.MaxLifetime,
+		sso:             config.SSO,
+		cookie:          cookie,
+		codes:           codes,
+		renewing:        &sync.Map{},
+		serviceAccounts: config.ServiceAccounts,
+		cli:             config.CLI,
+		devices:         newDeviceGrants(),
 	}
 }
 
@@ -46,95 +158,332 @@ func NewHeliosAuthentication(provider providers.OAuth2Provider, jwtSecret string
 func (helios Helios) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("Authenticating request %q", r.URL)
-		if err := authenticate(helios.jwtConfig.Secret, r); err != nil {
+		creds, err := helios.authenticate(r)
+		if err == nil && !helios.allows(creds.identity.Provider) {
+			err = ErrUnauthorized
+		}
+		if err == nil && !helios.renew(w, r, creds) {
+			err = ErrUnauthorized
+		}
+		if err != nil {
 			log.Debugf("Authentication failed for %q", r.URL)
-			// dynamically build callback URL based on current domain
-			scheme := "http"
-			if r.TLS != nil {
-				scheme = "https"
-			}
-			callback := scheme + "://" + r.Host + "/.well-known/callback"
-
-			url := helios.provider.GetLoginURL(callback, r.RequestURI)
+			helios.unauthenticated(w, r)
+			return
+		}
 
-			log.Debugf("Redirecting to %s", url)
+		// sessions without provider belong to the first one
+		if creds.identity.Provider == "" {
+			provider, _ := helios.provider("")
+			creds.identity.Provider = provider.Name
+		}
 
-			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-			return
+		ctx := WithIdentity(r.Context(), creds.identity)
+		if creds.session != nil {
+			ctx = withSession(ctx, creds.session)
 		}
 
 		// Call the next handler, which can be another middleware in the chain, or the final handler.
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // CallbackHandler handles OAuth2 callback flow
 func (helios Helios) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Handling callback request")
-	// decode and decrypt state to recover original request url
-	encodedState := r.URL.Query().Get("state")
 
+	// decode and decrypt state to recover original request url
 	// @todo decrypt state (see GetLoginURL)
-	state, err := base64.StdEncoding.DecodeString(encodedState)
+	state, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("state"))
 	if err != nil {
 		log.Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	profile, err := helios.provider.FetchUser(r)
+	name, rd := decodeState(string(state))
+	helios.callback(w, r, name, rd, false)
+}
+
+// callback logs users in with the named provider and sends them back to rd.
+// saml tells if the request was posted to the assertion consumer service, which only SAML providers use
+func (helios Helios) callback(w http.ResponseWriter, r *http.Request, name, rd string, saml bool) {
+	provider, ok := helios.provider(name)
+	if !ok {
+		log.Warnf("Unknown identity provider %q", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, isSAML := provider.OAuth2Provider.(providers.MetadataProvider); isSAML != saml {
+		log.Warnf("Identity provider %q cannot handle this callback", name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	profile, err := provider.FetchUser(r)
 	if err != nil {
 		log.Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Debugf("Authorized. Redirecting to %s", string(state))
+	log.Debugf("Authorized with %q. Redirecting to %s", provider.Name, rd)
 
-	exp := time.Now().Add(helios.jwtConfig.Expiration)
-	jwt, err := IssueJWTWithSecret(helios.jwtConfig.Secret, profile.Email, exp)
+	value, exp, err := helios.newSession(provider.Name, profile, time.Now())
 	if err != nil {
 		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := helios.setSessionCookie(w, r, value, exp); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     CookieName,
-		Value:    jwt,
-		Expires:  exp,
-		Path:     "/",
-		Secure:   true,
-		HttpOnly: true,
-	})
 
-	http.Redirect(w, r, string(state), http.StatusFound)
+	http.Redirect(w, r, rd, http.StatusFound)
+}
+
+// newSession creates the session of a user authenticated with a provider at authTime.
+// It returns the cookie value and when the cookie expires
+func (helios Helios) newSession(provider string, profile providers.UserInfo, authTime time.Time) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(helios.jwtConfig.Expiration)
+
+	if helios.store != nil {
+		id, err := session.NewID()
+		if err != nil {
+			return "", exp, err
+		}
+		err = helios.store.Save(&session.Session{
+			ID:                id,
+			User:              profile.Email,
+			Provider:          provider,
+			Groups:            profile.Groups,
+			AccessToken:       profile.AccessToken,
+			RefreshToken:      profile.RefreshToken,
+			IDToken:           profile.IDToken,
+			Subject:           profile.Subject,
+			ProviderSessionID: profile.SessionID,
+			CreatedAt:         authTime,
+			LastSeenAt:        now,
+			RefreshAt:         now.Add(helios.refreshInterval),
+			ExpiresAt:         exp,
+		})
+		return id, helios.cookieExpiration(authTime, exp), err
+	}
+
+	claims := &Claims{
+		Groups:      profile.Groups,
+		AccessToken: helios.cookieAccessToken(profile.AccessToken),
+		RefreshAt:   now.Add(helios.refreshInterval).Unix(),
+		AuthTime:    authTime.Unix(),
+		IDToken:     profile.IDToken,
+		Provider:    provider,
+	}
+	claims.Subject = profile.Email
+	claims.ExpiresAt = exp.Unix()
+
+	if profile.RefreshToken != "" {
+		// cookies may only be signed, keep the refresh token away from prying eyes
+		rt, err := encryptString(helios.jwtConfig.Secret, profile.RefreshToken)
+		if err != nil {
+			return "", exp, err
+		}
+		claims.RefreshToken = rt
+	}
+
+	value, err := helios.issueCookieToken(claims)
+	return value, helios.cookieExpiration(authTime, exp), err
+}
+
+// cookieAccessToken returns the access token kept in session cookies. Signed cookies can be read by the browser,
+// so access tokens are only kept in encrypted ones
+func (helios Helios) cookieAccessToken(token string) string {
+	if len(helios.jwtConfig.EncryptionKeys) == 0 {
+		return ""
+	}
+	return token
 }
 
+// cookieExpiration caps the cookie expiration to the absolute session lifetime
+func (helios Helios) cookieExpiration(authTime, exp time.Time) time.Time {
+	if helios.maxLifetime > 0 && authTime.Add(helios.maxLifetime).Before(exp) {
+		return authTime.Add(helios.maxLifetime)
+	}
+	return exp
+}
+
+// Logout ends the session and signs the user out of the identity provider.
+// Users are then sent to the rd URL, or to the signed-out page
 func (helios Helios) Logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     CookieName,
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Unix(0, 0),
-		Secure:   true,
-		HttpOnly: true,
-	})
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	returnURL := scheme + "://" + r.Host + SignedOutPath
+	if rd := r.URL.Query().Get("rd"); rd != "" {
+		// relative URLs stay on the current host
+		if strings.HasPrefix(rd, "/") && !strings.HasPrefix(rd, "//") {
+			rd = scheme + "://" + r.Host + rd
+		}
+		target, err := helios.validateRedirect(rd)
+		if err != nil {
+			log.Warnf("Rejecting logout: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		returnURL = target.String()
+	}
+
+	name, idToken := helios.endSession(r)
+	helios.clearSessionCookie(w, r)
+
+	var url string
+	if provider, ok := helios.provider(name); ok {
+		url = provider.GetLogoutURL(returnURL, idToken)
+	}
+	if url == "" {
+		url = returnURL
+	}
+	log.Debugf("Logged out. Redirecting to %s", url)
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// endSession revokes the server-side session of a request.
+// It returns the identity provider of the session and its id_token
+func (helios Helios) endSession(r *http.Request) (provider, idToken string) {
+	value, err := helios.readSessionCookie(r)
+	if err != nil {
+		return "", ""
+	}
+
+	if helios.store != nil {
+		if isCode(value) {
+			return "", ""
+		}
+		if s, err := helios.store.Load(value); err == nil {
+			provider, idToken = s.Provider, s.IDToken
+		}
+		if err := helios.store.Delete(value); err != nil {
+			log.Errorf("Cannot revoke session: %v", err)
+		}
+		return provider, idToken
+	}
+
+	// expired tokens still carry their claims
+	claims, _ := helios.parseCookieToken(value)
+	if claims == nil {
+		return "", ""
+	}
+	return claims.Provider, claims.IDToken
+}
+
+// SignedOutHandler renders the page users land on after logging out
+func (helios Helios) SignedOutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(signedOutPage))
+}
+
+// credentials describes how a request was authenticated
+type credentials struct {
+	identity Identity
+	// claims of the session cookie when sessions live in the cookie
+	claims *Claims
+	// server-side session when a session store is used
+	session *session.Session
 }
 
-func authenticate(jwtSecret string, r *http.Request) error {
+func (helios Helios) authenticate(r *http.Request) (*credentials, error) {
+	if helios.serviceAccounts != nil {
+		if key := r.Header.Get(helios.serviceAccounts.Header()); key != "" {
+			account, err := helios.serviceAccounts.Authenticate(key)
+			if err != nil {
+				return nil, ErrUnauthorized
+			}
+			// upstreams never see API keys
+			r.Header.Del(helios.serviceAccounts.Header())
+			return &credentials{identity: account.identity()}, nil
+		}
+	}
+
 	// look for Token in Cookies and Headers
-	cookie, err := r.Cookie(CookieName)
+	cookie, err := helios.readSessionCookie(r)
 	token := r.Header.Get(HeaderName)
 
 	if err == http.ErrNoCookie && token == "" {
-		return ErrUnauthorized
+		return nil, ErrUnauthorized
 	}
 
-	if token == "" && cookie != nil {
-		token = cookie.Value
+	if token == "" && cookie != "" {
+		// cookies hold an opaque session ID when sessions are kept server-side
+		if helios.store != nil {
+			return helios.loadSession(cookie)
+		}
+
+		claims, err := helios.parseCookieToken(cookie)
+		if err != nil {
+			if isExpired(err) {
+				sessionEnded(claims.Subject, ExpiryExpired)
+			}
+			return nil, ErrUnauthorized
+		}
+		if reason := helios.expiryReason(claims.authTime(), time.Unix(claims.IssuedAt, 0)); reason != "" {
+			sessionEnded(claims.Subject, reason)
+			return nil, ErrUnauthorized
+		}
+		return &credentials{identity: claims.Identity(), claims: claims}, nil
 	}
 
-	if !ValidateJWTWithSecret(jwtSecret, token) {
-		return ErrUnauthorized
+	// tokens of command line clients are server-side sessions as well, so they can be revoked. Signed tokens are
+	// still accepted, they cannot be revoked before they expire
+	if helios.store != nil && !isSignedToken(token) {
+		return helios.loadSession(token)
 	}
 
-	return nil
+	claims, err := ParseJWTWithSecret(helios.jwtConfig.Secret, token)
+	if err != nil {
+		if isExpired(err) {
+			sessionEnded(claims.Subject, ExpiryExpired)
+		}
+		return nil, ErrUnauthorized
+	}
+	// signed tokens are never renewed, their issue date is the last time the user was seen
+	if reason := helios.expiryReason(claims.authTime(), time.Unix(claims.IssuedAt, 0)); reason != "" {
+		sessionEnded(claims.Subject, reason)
+		return nil, ErrUnauthorized
+	}
+
+	return &credentials{identity: claims.Identity()}, nil
+}
+
+// isSignedToken tells a JWT from a session ID, which never holds dots
+func isSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// loadSession returns the credentials of a live server-side session, ending sessions past their idle timeout or
+// lifetime
+func (helios Helios) loadSession(id string) (*credentials, error) {
+	if isCode(id) {
+		return nil, ErrUnauthorized
+	}
+	s, err := helios.store.Load(id)
+	if err != nil {
+		// expired sessions were already dropped by the store and cannot be told from revoked ones
+		if err != session.ErrNotFound {
+			log.Errorf("Cannot load session: %v", err)
+		}
+		return nil, ErrUnauthorized
+	}
+	if reason := helios.expiryReason(s.CreatedAt, s.LastSeenAt); reason != "" {
+		sessionEnded(s.User, reason)
+		if err := helios.store.Delete(s.ID); err != nil {
+			log.Errorf("Cannot revoke session: %v", err)
+		}
+		return nil, ErrUnauthorized
+	}
+	return &credentials{identity: identityFromSession(s), session: s}, nil
 }
@@ -1,15 +1,30 @@
 package authentication
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/session"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	jose "gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
 )
 
 type mockProvider struct {
@@ -23,11 +38,38 @@ func (m *mockProvider) FetchUser(r *http.Request) (providers.UserInfo, error) {
 	return profile.(providers.UserInfo), nil
 }
 
+func (m *mockProvider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	args := m.Called(refreshToken)
+	return args.Get(0).(providers.UserInfo), args.Error(1)
+}
+
 func (m *mockProvider) GetLoginURL(callbackURL, state string) string {
 	args := m.Called(callbackURL, state)
 	return args.String(0)
 }
 
+func (m *mockProvider) GetLogoutURL(returnURL, idToken string) string {
+	args := m.Called(returnURL, idToken)
+	return args.String(0)
+}
+
+// mockSAMLProvider is a provider users log in with through the SAML assertion consumer service
+type mockSAMLProvider struct {
+	mockProvider
+}
+
+func (m *mockSAMLProvider) Metadata(acsURL string) ([]byte, error) {
+	args := m.Called(acsURL)
+	return []byte(args.String(0)), args.Error(1)
+}
+
+// browserRequest returns a request of a browser, which the middleware sends to log in
+func browserRequest(target string) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	return req
+}
+
 func TestHelios_Middleware(t *testing.T) {
 	// returns a http.HandlerFunc for testing http middleware
 	testHandler := func() http.HandlerFunc {
@@ -74,9 +116,9 @@ func TestHelios_Middleware(t *testing.T) {
 
 	// setup expectations
 	loginURL := "http://login"
-	oauth2.On("GetLoginURL", "http://testing/.well-known/callback", "http://testing").Return(loginURL).Times(3)
+	oauth2.On("GetLoginURL", "http://testing/.well-known/callback", encodeState(DefaultProviderName, "http://testing")).Return(loginURL).Times(3)
 	for _, test := range tests {
-		req := httptest.NewRequest("GET", "http://testing", nil)
+		req := browserRequest("http://testing")
 		res := httptest.NewRecorder()
 		req.Header.Set(test.HeaderName, test.HeaderValue)
 		mdw.ServeHTTP(res, req)
@@ -112,3 +154,1029 @@ func TestHelios_CallbackHandler(t *testing.T) {
 	}
 	oauth2.AssertExpectations(t)
 }
+
+func TestHelios_MiddlewareGRPC(t *testing.T) {
+	oauth2 := new(mockProvider)
+	auth := NewHeliosAuthentication(oauth2, "test", 5*time.Minute)
+
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest("POST", "http://testing/helloworld.Greeter/SayHello", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	res := httptest.NewRecorder()
+	mdw.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/grpc", res.Header().Get("Content-Type"))
+	assert.Equal(t, "16", res.Header().Get("Grpc-Status"))
+	oauth2.AssertExpectations(t)
+}
+
+func TestHelios_SessionStore(t *testing.T) {
+	oauth2 := new(mockProvider)
+	store := session.NewMemoryStore()
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:        JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Store:      store,
+		AdminToken: "admin",
+	})
+
+	oauth2.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "t@test"})
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+
+	// log in and grab the opaque session cookie
+	state := base64.StdEncoding.EncodeToString([]byte("http://testing"))
+	req := httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res := httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+	cookies := res.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	sid := cookies[0].Value
+	assert.False(t, ValidateJWTWithSecret("test", sid))
+
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	authenticated := func() int {
+		req := browserRequest("http://testing")
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: sid})
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		return res.Code
+	}
+	assert.Equal(t, http.StatusOK, authenticated())
+
+	tests := []struct {
+		URL, Token string
+		StatusCode int
+	}{
+		{"http://testing" + SessionsPath + "/" + sid, "wrong", http.StatusUnauthorized},
+		{"http://testing" + SessionsPath, "admin", http.StatusBadRequest},
+		{"http://testing" + SessionsPath + "?user=t@test", "admin", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("DELETE", test.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+test.Token)
+		res := httptest.NewRecorder()
+		auth.RevokeHandler(res, req)
+		assert.Equal(t, test.StatusCode, res.Code)
+	}
+
+	assert.Equal(t, http.StatusTemporaryRedirect, authenticated())
+}
+
+func TestHelios_Renew(t *testing.T) {
+	oauth2 := new(mockProvider)
+	store := session.NewMemoryStore()
+
+	key := EncryptionKey{ID: "key", Key: bytes.Repeat([]byte{1}, 32)}
+
+	tests := []struct {
+		Store        session.Store
+		Keys         []EncryptionKey
+		RefreshToken string
+		RefreshErr   error
+		StatusCode   int
+	}{
+		{nil, nil, "valid", nil, http.StatusOK},
+		{nil, []EncryptionKey{key}, "valid", nil, http.StatusOK},
+		{nil, nil, "disabled", providers.ErrRefresh, http.StatusTemporaryRedirect},
+		{store, nil, "valid", nil, http.StatusOK},
+		{store, nil, "disabled", providers.ErrRefresh, http.StatusOK},
+	}
+
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+	oauth2.On("Refresh", "valid").Return(providers.UserInfo{Email: "t@test", AccessToken: "new"}, nil)
+	oauth2.On("Refresh", "disabled").Return(providers.UserInfo{}, providers.ErrRefresh)
+
+	for _, test := range tests {
+		auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+			JWT:   JWTConfig{Secret: "test", Expiration: 5 * time.Minute, EncryptionKeys: test.Keys},
+			Store: test.Store,
+			// sessions must be re-validated right away
+			RefreshInterval: -time.Minute,
+		})
+
+		value, _, err := auth.newSession(DefaultProviderName, providers.UserInfo{Email: "t@test", RefreshToken: test.RefreshToken}, time.Now())
+		assert.NoError(t, err)
+
+		var identity Identity
+		mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			identity, _ = IdentityFromContext(req.Context())
+		}))
+		req := browserRequest("http://testing")
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: value})
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		assert.Equal(t, test.StatusCode, res.Code)
+
+		if test.Store == nil {
+			// cookie sessions are renewed or cleared right away
+			cookies := res.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			if test.RefreshErr == nil {
+				claims, err := auth.parseCookieToken(cookies[0].Value)
+				assert.NoError(t, err)
+				assert.Equal(t, "t@test", identity.Email)
+				// signed cookies can be read by the browser, only encrypted ones keep access tokens
+				if test.Keys == nil {
+					assert.Empty(t, identity.AccessToken)
+					assert.Empty(t, claims.AccessToken)
+				} else {
+					assert.Equal(t, "new", identity.AccessToken)
+					assert.Equal(t, "new", claims.AccessToken)
+				}
+			} else {
+				assert.Empty(t, cookies[0].Value)
+			}
+			continue
+		}
+
+		// server-side sessions are renewed in the background
+		renewed := func() bool {
+			s, err := store.Load(value)
+			if test.RefreshErr != nil {
+				return err == session.ErrNotFound
+			}
+			return err == nil && s.AccessToken == "new"
+		}
+		for i := 0; i < 100 && !renewed(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, renewed())
+	}
+}
+
+func TestHelios_RenewRevoked(t *testing.T) {
+	oauth2 := new(mockProvider)
+	store := session.NewMemoryStore()
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:             JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Store:           store,
+		RefreshInterval: -time.Minute,
+	})
+	revoked := make(chan time.Time)
+	oauth2.On("Refresh", "valid").Return(providers.UserInfo{Email: "t@test", AccessToken: "new"}, nil).WaitUntil(revoked)
+
+	value, _, err := auth.newSession(DefaultProviderName, providers.UserInfo{Email: "t@test", RefreshToken: "valid"}, time.Now())
+	assert.NoError(t, err)
+	req := browserRequest("http://testing")
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: value})
+	res := httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})).ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// an administrator revokes the session while the identity provider renews it
+	assert.NoError(t, store.DeleteUser("t@test"))
+	close(revoked)
+	for i := 0; i < 100; i++ {
+		if _, renewing := auth.renewing.Load(value); !renewing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = store.Load(value)
+	assert.Equal(t, session.ErrNotFound, err)
+}
+
+func TestHelios_TouchRevoked(t *testing.T) {
+	store := session.NewMemoryStore()
+	auth := NewHeliosAuthenticationWithConfig(new(mockProvider), Config{
+		JWT:         JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Store:       store,
+		IdleTimeout: time.Minute,
+	})
+	value, _, err := auth.newSession(DefaultProviderName, providers.UserInfo{Email: "t@test"}, time.Now())
+	assert.NoError(t, err)
+	s, err := store.Load(value)
+	assert.NoError(t, err)
+
+	// the session is revoked after the request loaded it, recording its activity does not bring it back
+	assert.NoError(t, store.Delete(value))
+	s.LastSeenAt = time.Now().Add(-time.Minute)
+	auth.touchSession(s)
+	_, err = store.Load(value)
+	assert.Equal(t, session.ErrNotFound, err)
+}
+
+func TestHelios_RenewCookieOnce(t *testing.T) {
+	oauth2 := new(mockProvider)
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:             JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		RefreshInterval: -time.Minute,
+	})
+	// the provider rotates refresh tokens, a second use fails
+	oauth2.On("Refresh", "rotating").Return(providers.UserInfo{Email: "t@test"}, nil).
+		After(50 * time.Millisecond).Once()
+	oauth2.On("Refresh", "rotating").Return(providers.UserInfo{}, providers.ErrRefresh)
+
+	value, _, err := auth.newSession(DefaultProviderName, providers.UserInfo{Email: "t@test", RefreshToken: "rotating"}, time.Now())
+	assert.NoError(t, err)
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	request := func() *httptest.ResponseRecorder {
+		req := browserRequest("http://testing")
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: value})
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		return res
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := request()
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.NotEmpty(t, res.Result().Cookies()[0].Value)
+		}()
+	}
+	wg.Wait()
+
+	// requests still sending the previous cookie get the renewed one
+	res := request()
+	assert.Equal(t, http.StatusOK, res.Code)
+	oauth2.AssertNumberOfCalls(t, "Refresh", 1)
+}
+
+func TestHelios_SessionLimits(t *testing.T) {
+	oauth2 := new(mockProvider)
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:         JWTConfig{Secret: "test", Expiration: 10 * time.Hour},
+		IdleTimeout: 30 * time.Minute,
+		MaxLifetime: 12 * time.Hour,
+	})
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	now := time.Now()
+	tests := []struct {
+		AuthTime, IssuedAt time.Time
+		StatusCode         int
+		Reissued           bool
+		HeaderStatusCode   int
+	}{
+		// fresh session
+		{now, now, http.StatusOK, false, http.StatusOK},
+		// past half the idle window, cookie slides
+		{now.Add(-time.Hour), now.Add(-20 * time.Minute), http.StatusOK, true, http.StatusOK},
+		// idle for too long
+		{now.Add(-time.Hour), now.Add(-31 * time.Minute), http.StatusTemporaryRedirect, false, http.StatusUnauthorized},
+		// active but over the absolute lifetime
+		{now.Add(-13 * time.Hour), now, http.StatusTemporaryRedirect, false, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		claims := &Claims{AuthTime: test.AuthTime.Unix()}
+		claims.Subject = "t@test"
+		claims.IssuedAt = test.IssuedAt.Unix()
+		claims.ExpiresAt = now.Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test"))
+		assert.NoError(t, err)
+
+		req := browserRequest("http://testing")
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+
+		assert.Equal(t, test.StatusCode, res.Code)
+		assert.Equal(t, test.Reissued, len(res.Result().Cookies()) == 1)
+
+		// signed tokens sent in the header end alike
+		req = httptest.NewRequest("GET", "http://testing", nil)
+		req.Header.Set(HeaderName, token)
+		res = httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		assert.Equal(t, test.HeaderStatusCode, res.Code)
+	}
+}
+
+func TestHelios_SSO(t *testing.T) {
+	oauth2 := new(mockProvider)
+	oauth2.On("GetLoginURL", "http://auth.test/.well-known/callback", mock.Anything).Return("http://login")
+
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		SSO: SSOConfig{
+			AuthDomain:   "auth.test",
+			AllowedHosts: []string{"app.test"},
+		},
+	})
+	token, _ := IssueJWTWithSecret("test", "t@test", time.Now().Add(5*time.Minute))
+
+	// unauthenticated requests are sent to the auth domain
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	req := browserRequest("http://app.test/dashboard")
+	res := httptest.NewRecorder()
+	mdw.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, res.Code)
+	assert.Equal(t, "http://auth.test"+SSOAuthorizePath+"?rd=http%3A%2F%2Fapp.test%2Fdashboard", res.Header().Get("Location"))
+
+	rd := url.QueryEscape("http://app.test/dashboard")
+	tests := []struct {
+		URL        string
+		Cookie     string
+		StatusCode int
+		Location   string
+	}{
+		{"http://app.test" + SSOAuthorizePath + "?rd=" + rd, token, http.StatusNotFound, ""},
+		{"http://auth.test" + SSOAuthorizePath + "?rd=" + url.QueryEscape("http://evil.test/"), token, http.StatusBadRequest, ""},
+		{"http://auth.test" + SSOAuthorizePath + "?rd=" + rd, "", http.StatusTemporaryRedirect, "http://login"},
+		{"http://auth.test" + SSOAuthorizePath + "?rd=" + rd, token, http.StatusFound, "http://app.test" + SSORedeemPath},
+	}
+
+	var location string
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.URL, nil)
+		if test.Cookie != "" {
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: test.Cookie})
+		}
+		res := httptest.NewRecorder()
+		auth.SSOAuthorizeHandler(res, req)
+
+		assert.Equal(t, test.StatusCode, res.Code)
+		location = res.Header().Get("Location")
+		assert.True(t, strings.HasPrefix(location, test.Location))
+	}
+
+	// the one-time code sets a session cookie on the target host
+	redeem := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", location, nil)
+		res := httptest.NewRecorder()
+		auth.SSORedeemHandler(res, req)
+		return res
+	}
+	res = redeem()
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "http://app.test/dashboard", res.Header().Get("Location"))
+	cookies := res.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, ValidateJWTWithSecret("test", cookies[0].Value))
+
+	// codes cannot be replayed
+	assert.Equal(t, http.StatusUnauthorized, redeem().Code)
+}
+
+func TestHelios_CookieChunks(t *testing.T) {
+	oauth2 := new(mockProvider)
+	cookie := DefaultCookieConfig()
+	cookie.HostPrefix = true
+	cookie.SameSite = http.SameSiteStrictMode
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:    JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Cookie: cookie,
+	})
+
+	// enough groups to overflow a single cookie
+	groups := make([]string, 500)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("group-%04d", i)
+	}
+	oauth2.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "t@test", Groups: groups})
+
+	state := base64.StdEncoding.EncodeToString([]byte("http://testing"))
+	req := httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res := httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+
+	cookies := res.Result().Cookies()
+	assert.True(t, len(cookies) > 1)
+	for i, c := range cookies {
+		assert.Equal(t, fmt.Sprintf("__Host-%s_%d", CookieName, i), c.Name)
+		assert.Equal(t, http.SameSiteStrictMode, c.SameSite)
+		assert.True(t, c.Secure)
+	}
+
+	var identity Identity
+	mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		identity, _ = IdentityFromContext(req.Context())
+	}))
+	req = browserRequest("http://testing")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	res = httptest.NewRecorder()
+	mdw.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, groups, identity.Groups)
+}
+
+func TestHelios_CookieTooLarge(t *testing.T) {
+	oauth2 := new(mockProvider)
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+	})
+
+	// more chunks than are read back, the login fails instead of looping
+	groups := make([]string, 5000)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("group-%04d", i)
+	}
+	oauth2.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "t@test", Groups: groups})
+
+	state := base64.StdEncoding.EncodeToString([]byte("http://testing"))
+	req := httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res := httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Empty(t, res.Result().Cookies())
+}
+
+func TestHelios_Logout(t *testing.T) {
+	oauth2 := new(mockProvider)
+	store := session.NewMemoryStore()
+	sso := SSOConfig{AllowedHosts: []string{"testing", "app.test"}}
+	cookieAuth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		SSO: sso,
+	})
+	storeAuth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:   JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Store: store,
+		SSO:   sso,
+	})
+
+	profile := providers.UserInfo{Email: "t@test", IDToken: "id-token"}
+	oauth2.On("GetLogoutURL", "http://testing"+SignedOutPath, "id-token").Return("http://idp/logout")
+	oauth2.On("GetLogoutURL", "http://testing/bye", "id-token").Return("http://idp/logout?bye")
+	oauth2.On("GetLogoutURL", "https://app.test/", "").Return("")
+
+	tests := []struct {
+		Auth     Helios
+		RD       string
+		Session  bool
+		Code     int
+		Location string
+	}{
+		{cookieAuth, "", true, http.StatusFound, "http://idp/logout"},
+		{storeAuth, "", true, http.StatusFound, "http://idp/logout"},
+		{cookieAuth, "/bye", true, http.StatusFound, "http://idp/logout?bye"},
+		// providers without logout endpoint redirect straight to rd
+		{cookieAuth, "https://app.test/", false, http.StatusFound, "https://app.test/"},
+		{cookieAuth, "https://evil.test/", true, http.StatusBadRequest, ""},
+		{cookieAuth, "//evil.test/", true, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://testing/.well-known/logout?rd="+url.QueryEscape(test.RD), nil)
+		var id string
+		if test.Session {
+			value, _, err := test.Auth.newSession(DefaultProviderName, profile, time.Now())
+			assert.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: value})
+			id = value
+		}
+		res := httptest.NewRecorder()
+		test.Auth.Logout(res, req)
+
+		assert.Equal(t, test.Code, res.Code)
+		assert.Equal(t, test.Location, res.Header().Get("Location"))
+		if test.Code == http.StatusFound && test.Auth.store != nil {
+			_, err := store.Load(id)
+			assert.Equal(t, session.ErrNotFound, err)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	cookieAuth.SignedOutHandler(res, httptest.NewRequest("GET", "http://testing"+SignedOutPath, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "signed out")
+}
+
+// fakeIdP publishes a JWKS and signs logout tokens
+type fakeIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	idp := &fakeIdP{key: key}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "idp", Algorithm: "RS256", Use: "sig"},
+		}})
+	}))
+	return idp
+}
+
+func (idp *fakeIdP) sign(t *testing.T, key *rsa.PrivateKey, claims interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "idp"))
+	assert.NoError(t, err)
+	token, err := josejwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+func TestHelios_BackchannelLogout(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+
+	oauth2 := new(mockProvider)
+	store := session.NewMemoryStore()
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:   JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Store: store,
+		Backchannel: BackchannelConfig{
+			KeySet:   providers.NewKeySet(idp.URL),
+			Issuer:   "https://idp.test",
+			Audience: "helios",
+		},
+	})
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	events := map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.test",
+			"aud":    []string{"helios", "other"},
+			"iat":    time.Now().Unix(),
+			"jti":    "id",
+			"events": events,
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		Token   string
+		Code    int
+		Revoked []string
+	}{
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sid": "s1"})), http.StatusOK, []string{"a1"}},
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sub": "b"})), http.StatusOK, []string{"b1", "b2"}},
+		{idp.sign(t, otherKey, claims(map[string]interface{}{"sub": "a"})), http.StatusBadRequest, nil},
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sub": "a", "aud": "other"})), http.StatusBadRequest, nil},
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sub": "a", "iss": "https://evil.test"})), http.StatusBadRequest, nil},
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sub": "a", "events": map[string]interface{}{}})), http.StatusBadRequest, nil},
+		{idp.sign(t, idp.key, claims(map[string]interface{}{"sub": "a", "nonce": "n"})), http.StatusBadRequest, nil},
+		{idp.sign(t, idp.key, claims(nil)), http.StatusBadRequest, nil},
+		{"not-a-token", http.StatusBadRequest, nil},
+	}
+
+	for i, test := range tests {
+		expires := time.Now().Add(time.Hour)
+		sessions := []*session.Session{
+			{ID: "a1", User: "a@test", Provider: DefaultProviderName, Subject: "a", ProviderSessionID: "s1", ExpiresAt: expires},
+			{ID: "a2", User: "a@test", Provider: DefaultProviderName, Subject: "a", ProviderSessionID: "s2", ExpiresAt: expires},
+			{ID: "b1", User: "b@test", Provider: DefaultProviderName, Subject: "b", ProviderSessionID: "s3", ExpiresAt: expires},
+			{ID: "b2", User: "b@test", Provider: DefaultProviderName, Subject: "b", ProviderSessionID: "s4", ExpiresAt: expires},
+		}
+		for _, s := range sessions {
+			assert.NoError(t, store.Save(s))
+		}
+
+		form := url.Values{"logout_token": {test.Token}}
+		req := httptest.NewRequest("POST", "http://testing"+BackchannelLogoutPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		auth.BackchannelLogoutHandler(res, req)
+		assert.Equal(t, test.Code, res.Code, i)
+
+		for _, s := range sessions {
+			_, err := store.Load(s.ID)
+			revoked := false
+			for _, id := range test.Revoked {
+				revoked = revoked || id == s.ID
+			}
+			assert.Equal(t, revoked, err == session.ErrNotFound, "%d: %s", i, s.ID)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	auth.BackchannelLogoutHandler(res, httptest.NewRequest("GET", "http://testing"+BackchannelLogoutPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+}
+
+func TestHelios_BackchannelLogoutProviders(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+
+	store := session.NewMemoryStore()
+	backchannel := func(issuer string) BackchannelConfig {
+		return BackchannelConfig{KeySet: providers.NewKeySet(idp.URL), Issuer: issuer, Audience: "helios"}
+	}
+	auth := NewHeliosAuthenticationWithConfig(new(mockProvider), Config{
+		JWT:   JWTConfig{Secret: "test"},
+		Store: store,
+		Providers: []Provider{
+			{OAuth2Provider: new(mockProvider), Name: "employees", Backchannel: backchannel("https://employees.test")},
+			{OAuth2Provider: new(mockProvider), Name: "partners", Backchannel: backchannel("https://partners.test")},
+		},
+	})
+
+	// both providers issue the same subject and session IDs
+	expires := time.Now().Add(time.Hour)
+	sessions := []*session.Session{
+		{ID: "e1", User: "a@employees.test", Provider: "employees", Subject: "a", ProviderSessionID: "s1", ExpiresAt: expires},
+		{ID: "p1", User: "a@partners.test", Provider: "partners", Subject: "a", ProviderSessionID: "s1", ExpiresAt: expires},
+	}
+	for _, s := range sessions {
+		assert.NoError(t, store.Save(s))
+	}
+
+	logout := func(issuer string, extra map[string]interface{}) {
+		claims := map[string]interface{}{
+			"iss":    issuer,
+			"aud":    "helios",
+			"iat":    time.Now().Unix(),
+			"jti":    "id",
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		form := url.Values{"logout_token": {idp.sign(t, idp.key, claims)}}
+		req := httptest.NewRequest("POST", "http://testing"+BackchannelLogoutPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		auth.BackchannelLogoutHandler(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+
+	logout("https://employees.test", map[string]interface{}{"sub": "a"})
+	_, err := store.Load("e1")
+	assert.Equal(t, session.ErrNotFound, err)
+	_, err = store.Load("p1")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Save(sessions[0]))
+	logout("https://partners.test", map[string]interface{}{"sid": "s1"})
+	_, err = store.Load("p1")
+	assert.Equal(t, session.ErrNotFound, err)
+	_, err = store.Load("e1")
+	assert.NoError(t, err)
+}
+
+func TestHelios_Providers(t *testing.T) {
+	employees, contractors := new(mockProvider), new(mockProvider)
+	auth := NewHeliosAuthenticationWithConfig(nil, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Providers: []Provider{
+			{OAuth2Provider: employees, Name: "employees", Title: "Azure AD"},
+			{OAuth2Provider: contractors, Name: "contractors"},
+			// bound to a route with its own client
+			{OAuth2Provider: contractors, Name: "contractors@app.test", Private: true},
+		},
+		LoginPage: LoginPageConfig{Title: "ACME", LogoURL: "https://acme.test/logo.png"},
+	})
+	employees.On("GetLoginURL", mock.Anything, encodeState("employees", "http://testing/app")).Return("http://employees/login")
+	contractors.On("GetLoginURL", mock.Anything, encodeState("contractors", "http://testing/app")).Return("http://contractors/login")
+	contractors.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "c@test"})
+
+	var identity Identity
+	serve := func(auth Helios, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		identity = Identity{}
+		mdw := auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			identity, _ = IdentityFromContext(req.Context())
+		}))
+		req := browserRequest("http://testing/app")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		return res
+	}
+
+	// several providers apply, users choose one
+	res := serve(auth)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	for _, s := range []string{"ACME", "https://acme.test/logo.png", "Azure AD", "http://employees/login", "contractors", "http://contractors/login"} {
+		assert.Contains(t, res.Body.String(), s)
+	}
+	assert.NotContains(t, res.Body.String(), "contractors@app.test")
+
+	// a single provider applies
+	res = serve(auth.ForProviders("contractors"))
+	assert.Equal(t, http.StatusTemporaryRedirect, res.Code)
+	assert.Equal(t, "http://contractors/login", res.Header().Get("Location"))
+
+	state := base64.StdEncoding.EncodeToString([]byte(encodeState("contractors", "/app")))
+	req := httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res = httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "/app", res.Header().Get("Location"))
+	cookie := res.Result().Cookies()[0]
+
+	res = serve(auth.ForProviders("contractors"), cookie)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, Identity{Email: "c@test", Provider: "contractors"}, identity)
+
+	// sessions of other providers are not accepted
+	res = serve(auth.ForProviders("employees"), cookie)
+	assert.Equal(t, http.StatusTemporaryRedirect, res.Code)
+	assert.Equal(t, "http://employees/login", res.Header().Get("Location"))
+
+	// sessions of a route client are only accepted by that route
+	state = base64.StdEncoding.EncodeToString([]byte(encodeState("contractors@app.test", "/app")))
+	req = httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res = httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+	cookie = res.Result().Cookies()[0]
+
+	res = serve(auth.ForProviders("contractors@app.test"), cookie)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "contractors@app.test", identity.Provider)
+	res = serve(auth, cookie)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = serve(auth.ForProviders("contractors"), cookie)
+	assert.Equal(t, http.StatusTemporaryRedirect, res.Code)
+
+	// unknown providers are rejected
+	state = base64.StdEncoding.EncodeToString([]byte(encodeState("unknown", "/app")))
+	req = httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res = httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestHelios_SAML(t *testing.T) {
+	oauth2, sp := new(mockProvider), new(mockSAMLProvider)
+	auth := NewHeliosAuthenticationWithConfig(nil, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Providers: []Provider{
+			{OAuth2Provider: oauth2, Name: "oauth2"},
+			{OAuth2Provider: sp, Name: "adfs"},
+		},
+	})
+	sp.On("GetLoginURL", "http://testing"+SAMLACSPath, mock.Anything).Return("http://adfs/sso")
+	sp.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "s@test", Groups: []string{"finance"}})
+	sp.On("Metadata", "http://testing"+SAMLACSPath).Return("<EntityDescriptor/>", nil)
+
+	// SAML logins start on Helios, which binds them to the browser
+	req := browserRequest("http://testing/app")
+	res := httptest.NewRecorder()
+	auth.ForProviders("adfs").Middleware(http.NotFoundHandler()).ServeHTTP(res, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, res.Code)
+	login := res.Header().Get("Location")
+	assert.Equal(t, "http://testing"+SAMLLoginPath+"?idp=adfs&rd="+url.QueryEscape("http://testing/app"), login)
+
+	start := func(target string) (string, *http.Cookie) {
+		res := httptest.NewRecorder()
+		auth.SAMLLoginHandler(res, httptest.NewRequest("GET", target, nil))
+		if res.Code != http.StatusFound {
+			return "", nil
+		}
+		assert.Equal(t, "http://adfs/sso", res.Header().Get("Location"))
+		handle := sp.Calls[len(sp.Calls)-1].Arguments.String(1)
+		// identity providers may drop relay states over 80 bytes
+		assert.True(t, len(handle) <= 80)
+		return handle, res.Result().Cookies()[0]
+	}
+	for _, target := range []string{
+		"http://testing" + SAMLLoginPath + "?idp=oauth2&rd=/app",
+		"http://testing" + SAMLLoginPath + "?idp=adfs&rd=https://evil.test/app",
+		"http://testing" + SAMLLoginPath + "?idp=adfs&rd=//evil.test/app",
+	} {
+		handle, _ := start(target)
+		assert.Empty(t, handle, target)
+	}
+
+	post := func(handle string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		form := url.Values{"SAMLResponse": {"response"}, "RelayState": {handle}}
+		req := httptest.NewRequest("POST", "http://testing"+SAMLACSPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		auth.SAMLACSHandler(res, req)
+		return res
+	}
+
+	// assertions are only accepted by the browser that started the login
+	handle, cookie := start(login)
+	other, otherCookie := start("http://testing" + SAMLLoginPath + "?idp=adfs&rd=/app")
+	assert.Equal(t, http.StatusBadRequest, post(handle, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, post(other, cookie).Code)
+	assert.Equal(t, http.StatusBadRequest, post(handle, otherCookie).Code)
+
+	res = post(handle, cookie)
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "http://testing/app", res.Header().Get("Location"))
+	var sessionCookie *http.Cookie
+	for _, c := range res.Result().Cookies() {
+		if c.Name == CookieName {
+			sessionCookie = c
+		}
+	}
+
+	// logins complete once
+	assert.Equal(t, http.StatusBadRequest, post(handle, cookie).Code)
+
+	var identity Identity
+	req = browserRequest("http://testing/app")
+	req.AddCookie(sessionCookie)
+	res = httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		identity, _ = IdentityFromContext(req.Context())
+	})).ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, Identity{Email: "s@test", Groups: []string{"finance"}, Provider: "adfs"}, identity)
+
+	// SAML providers cannot handle OAuth2 callbacks
+	state := base64.StdEncoding.EncodeToString([]byte(encodeState("adfs", "/app")))
+	req = httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res = httptest.NewRecorder()
+	auth.CallbackHandler(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	req = httptest.NewRequest("GET", "http://testing"+SAMLACSPath, nil)
+	res = httptest.NewRecorder()
+	auth.SAMLACSHandler(res, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+
+	for _, idp := range []string{"", "adfs"} {
+		req = httptest.NewRequest("GET", "http://testing"+SAMLMetadataPath+"?idp="+idp, nil)
+		res = httptest.NewRecorder()
+		auth.SAMLMetadataHandler(res, req)
+		assert.Equal(t, http.StatusOK, res.Code, idp)
+		assert.Equal(t, "<EntityDescriptor/>", res.Body.String(), idp)
+	}
+	req = httptest.NewRequest("GET", "http://testing"+SAMLMetadataPath+"?idp=oauth2", nil)
+	res = httptest.NewRecorder()
+	auth.SAMLMetadataHandler(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	sp.AssertExpectations(t)
+}
+
+func TestHelios_SAMLFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := session.NewFileStore(filepath.Join(dir, "sessions.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	sp := new(mockSAMLProvider)
+	sp.On("GetLoginURL", "http://testing"+SAMLACSPath, mock.Anything).Return("http://adfs/sso")
+	sp.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "s@test"})
+	auth := NewHeliosAuthenticationWithConfig(nil, Config{
+		JWT:       JWTConfig{Secret: "test", Expiration: 5 * time.Minute},
+		Providers: []Provider{{OAuth2Provider: sp, Name: "adfs"}},
+		Store:     store,
+	})
+
+	// pending logins have no user yet
+	res := httptest.NewRecorder()
+	auth.SAMLLoginHandler(res, httptest.NewRequest("GET", "http://testing"+SAMLLoginPath+"?idp=adfs&rd=/app", nil))
+	assert.Equal(t, http.StatusFound, res.Code)
+	cookie := res.Result().Cookies()[0]
+
+	form := url.Values{"SAMLResponse": {"response"}, "RelayState": {cookie.Value}}
+	req := httptest.NewRequest("POST", "http://testing"+SAMLACSPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	res = httptest.NewRecorder()
+	auth.SAMLACSHandler(res, req)
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "/app", res.Header().Get("Location"))
+}
+
+func TestHelios_EncryptedCookie(t *testing.T) {
+	oauth2 := new(mockProvider)
+	oldKey := EncryptionKey{ID: "old", Key: bytes.Repeat([]byte{1}, 32)}
+	newKey := EncryptionKey{ID: "new", Key: bytes.Repeat([]byte{2}, 32)}
+	newAuth := func(keys ...EncryptionKey) Helios {
+		return NewHeliosAuthenticationWithConfig(oauth2, Config{
+			JWT: JWTConfig{Secret: "test", Expiration: 5 * time.Minute, EncryptionKeys: keys},
+		})
+	}
+	oauth2.On("FetchUser", mock.Anything).Return(providers.UserInfo{Email: "t@test", Groups: []string{"admins"}})
+
+	state := base64.StdEncoding.EncodeToString([]byte("http://testing"))
+	req := httptest.NewRequest("GET", "http://testing/.well-known/callback?state="+state, nil)
+	res := httptest.NewRecorder()
+	newAuth(oldKey).CallbackHandler(res, req)
+
+	cookies := res.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	// five parts compact JWE, claims are not readable
+	assert.Len(t, strings.Split(cookies[0].Value, "."), 5)
+	assert.False(t, ValidateJWTWithSecret("test", cookies[0].Value))
+	assert.NotContains(t, cookies[0].Value, base64.RawURLEncoding.EncodeToString([]byte("t@test")))
+
+	signed, _ := IssueJWTWithSecret("test", "t@test", time.Now().Add(5*time.Minute))
+	tests := []struct {
+		Auth   Helios
+		Cookie string
+		Header string
+		Code   int
+	}{
+		{newAuth(oldKey), cookies[0].Value, "", http.StatusOK},
+		// rotated keys still decrypt existing cookies
+		{newAuth(newKey, oldKey), cookies[0].Value, "", http.StatusOK},
+		{newAuth(newKey), cookies[0].Value, "", http.StatusTemporaryRedirect},
+		// signed-only cookies are rejected once encryption is enabled
+		{newAuth(oldKey), signed, "", http.StatusTemporaryRedirect},
+		// header tokens stay signed-only
+		{newAuth(oldKey), "", signed, http.StatusOK},
+	}
+
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+	for _, test := range tests {
+		mdw := test.Auth.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+		req := browserRequest("http://testing")
+		if test.Cookie != "" {
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: test.Cookie})
+		}
+		if test.Header != "" {
+			req.Header.Set(HeaderName, test.Header)
+		}
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		assert.Equal(t, test.Code, res.Code)
+	}
+}
+
+func TestCookieConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Cookie CookieConfig
+		Valid  bool
+	}{
+		{DefaultCookieConfig(), true},
+		{CookieConfig{Name: "a", Path: "/", HostPrefix: true, Secure: true}, true},
+		{CookieConfig{Name: "a", Path: "/", HostPrefix: true, Secure: true, Domain: "example.com"}, false},
+		{CookieConfig{Name: "a", Path: "/app", HostPrefix: true, Secure: true}, false},
+		{CookieConfig{Name: "a", Path: "/", SameSite: http.SameSiteNoneMode}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Valid, test.Cookie.Validate() == nil)
+	}
+}
+
+func TestHelios_Unauthenticated(t *testing.T) {
+	oauth2 := new(mockProvider)
+	oauth2.On("GetLoginURL", "http://testing/.well-known/callback", mock.Anything).Return("http://login")
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{JWT: JWTConfig{Secret: "test", Expiration: time.Minute}})
+
+	const html = "text/html,application/xhtml+xml"
+	tests := []struct {
+		Action  UnauthenticatedAction
+		Method  string
+		Headers map[string]string
+		Code    int
+	}{
+		{UnauthenticatedNegotiate, "GET", map[string]string{"Accept": html}, http.StatusTemporaryRedirect},
+		{UnauthenticatedNegotiate, "GET", map[string]string{"Accept": "application/json"}, http.StatusUnauthorized},
+		{UnauthenticatedNegotiate, "GET", map[string]string{"Accept": html, "X-Requested-With": "XMLHttpRequest"}, http.StatusUnauthorized},
+		{UnauthenticatedNegotiate, "POST", map[string]string{"Accept": html}, http.StatusUnauthorized},
+		{UnauthenticatedNegotiate, "GET", map[string]string{"Accept": "*/*"}, http.StatusUnauthorized},
+		{UnauthenticatedRedirect, "POST", map[string]string{"Accept": "application/json"}, http.StatusTemporaryRedirect},
+		{Unauthenticated401, "GET", map[string]string{"Accept": html}, http.StatusUnauthorized},
+		{Unauthenticated403, "GET", map[string]string{"Accept": html}, http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(test.Method, "http://testing/api?page=2", nil)
+		for k, v := range test.Headers {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		auth.OnUnauthenticated(test.Action).Middleware(http.NotFoundHandler()).ServeHTTP(res, req)
+
+		assert.Equal(t, test.Code, res.Code, i)
+		if test.Code == http.StatusTemporaryRedirect {
+			assert.Equal(t, "http://login", res.Header().Get("Location"), i)
+			continue
+		}
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"), i)
+		assert.Equal(t, test.Code == http.StatusUnauthorized, res.Header().Get("WWW-Authenticate") != "", i)
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&body), i)
+		assert.Equal(t, map[string]string{"error": "unauthenticated", "login_url": "http://login"}, body, i)
+	}
+	oauth2.AssertCalled(t, "GetLoginURL", "http://testing/.well-known/callback", encodeState(DefaultProviderName, "http://testing/api?page=2"))
+
+	// users choose a provider on the page itself when several apply
+	auth = NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:       JWTConfig{Secret: "test", Expiration: time.Minute},
+		Providers: []Provider{{OAuth2Provider: oauth2, Name: "other"}},
+	})
+	res := httptest.NewRecorder()
+	auth.Middleware(http.NotFoundHandler()).ServeHTTP(res, httptest.NewRequest("GET", "http://testing/api", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	assert.Contains(t, res.Body.String(), `"login_url":"http://testing/api"`)
+
+	// so do SSO logins on the auth domain
+	auth = NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT: JWTConfig{Secret: "test", Expiration: time.Minute},
+		SSO: SSOConfig{AuthDomain: "auth.test"},
+	})
+	res = httptest.NewRecorder()
+	auth.Middleware(http.NotFoundHandler()).ServeHTTP(res, httptest.NewRequest("GET", "http://testing/api", nil))
+	assert.Contains(t, res.Body.String(), `"login_url":"http://auth.test`+SSOAuthorizePath+`?rd=http%3A%2F%2Ftesting%2Fapi"`)
+
+	_, err := ParseUnauthenticatedAction("404")
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// BackchannelLogoutPath receives logout tokens from the identity provider
+const BackchannelLogoutPath = "/.well-known/backchannel-logout"
+
+// backchannelLogoutEvent is the event every logout token must hold
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// ErrLogoutToken is returned when a logout token is invalid
+var ErrLogoutToken = errors.New("invalid logout token")
+
+// BackchannelConfig OpenID Connect back-channel logout configuration
+type BackchannelConfig struct {
+	// KeySet verifies logout token signatures, back-channel logout is disabled when nil
+	KeySet *providers.KeySet
+	// Issuer is the identity provider issuer
+	Issuer string
+	// Audience is the client ID logout tokens are issued for
+	Audience string
+}
+
+// logoutClaims are the claims of an OpenID Connect logout token
+type logoutClaims struct {
+	jwt.Claims
+	Events    map[string]interface{} `json:"events"`
+	SessionID string                 `json:"sid"`
+	Nonce     *string                `json:"nonce"`
+}
+
+// BackchannelLogoutHandler revokes the sessions matching a logout token sent by the identity provider
+func (helios Helios) BackchannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	// sessions living in cookies cannot be revoked
+	if helios.store == nil {
+		log.Warn("Rejecting logout token: back-channel logout requires a session store")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	claims, names, err := helios.verifyLogoutToken(r.PostFormValue("logout_token"))
+	if err != nil {
+		log.Warnf("Rejecting logout token: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// subjects and sessions are only unique within the providers the token was issued for
+	for _, name := range names {
+		if claims.SessionID != "" {
+			err = helios.store.DeleteProviderSession(name, claims.SessionID)
+		} else {
+			err = helios.store.DeleteSubject(name, claims.Subject)
+		}
+		if err != nil {
+			log.Errorf("Cannot revoke sessions: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Debugf("Revoked sessions of subject %q, session %q from providers %v", claims.Subject, claims.SessionID, names)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// backchannelConfig returns the back-channel configuration of the provider that issued a logout token, along with
+// the names of every provider sharing it
+func (helios Helios) backchannelConfig(token string) (BackchannelConfig, []string, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return BackchannelConfig{}, nil, err
+	}
+	// the issuer is only used to pick the keys the token is then verified with
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return BackchannelConfig{}, nil, err
+	}
+
+	// providers can share an issuer with different clients
+	var conf BackchannelConfig
+	var names []string
+	for _, p := range helios.providers {
+		if p.Backchannel.KeySet == nil || p.Backchannel.Issuer == "" || p.Backchannel.Issuer != claims.Issuer ||
+			!claims.Audience.Contains(p.Backchannel.Audience) {
+			continue
+		}
+		if names == nil {
+			conf = p.Backchannel
+		} else if p.Backchannel.Audience != conf.Audience {
+			continue
+		}
+		names = append(names, p.Name)
+	}
+	if names == nil {
+		return BackchannelConfig{}, nil, ErrLogoutToken
+	}
+	return conf, names, nil
+}
+
+// verifyLogoutToken validates a logout token as described by OpenID Connect Back-Channel Logout 1.0 and returns
+// the names of the providers it revokes sessions of
+func (helios Helios) verifyLogoutToken(token string) (*logoutClaims, []string, error) {
+	conf, names, err := helios.backchannelConfig(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims := &logoutClaims{}
+	if err := conf.KeySet.VerifyJWT(token, claims); err != nil {
+		return nil, nil, err
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   conf.Issuer,
+		Audience: jwt.Audience{conf.Audience},
+		Time:     time.Now(),
+	}, time.Minute)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case claims.IssuedAt == nil:
+		return nil, nil, ErrLogoutToken
+	case claims.Events == nil || claims.Events[backchannelLogoutEvent] == nil:
+		return nil, nil, ErrLogoutToken
+	case claims.Subject == "" && claims.SessionID == "":
+		return nil, nil, ErrLogoutToken
+	// logout tokens cannot be mistaken for id_tokens
+	case claims.Nonce != nil:
+		return nil, nil, ErrLogoutToken
+	}
+
+	return claims, names, nil
+}
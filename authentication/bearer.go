@@ -0,0 +1,321 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/grpcutil"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// defaultIntrospectionCacheTTL is how long introspection results are cached by default
+const defaultIntrospectionCacheTTL = time.Minute
+
+// ErrAccessToken is returned when a bearer access token is invalid, expired or issued for another audience
+var ErrAccessToken = errors.New("invalid access token")
+
+// ErrInsufficientScope is returned when a bearer access token lacks a required scope
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// BearerConfig validates the OAuth2 access tokens clients send as Authorization: Bearer
+type BearerConfig struct {
+	// KeySet verifies JWT access tokens
+	KeySet *providers.KeySet
+	// Issuer is the expected issuer of access tokens, it is not checked when empty
+	Issuer string
+	// Introspection validates opaque access tokens when its URL is set
+	Introspection IntrospectionConfig
+}
+
+// IntrospectionConfig RFC 7662 token introspection configuration
+type IntrospectionConfig struct {
+	URL string
+	// ClientID and ClientSecret authenticate Helios to the introspection endpoint
+	ClientID     string
+	ClientSecret string
+	// CacheTTL is how long introspection results are cached, defaults to a minute
+	CacheTTL time.Duration
+}
+
+// BearerPolicy is what a path requires of access tokens
+type BearerPolicy struct {
+	Audience string
+	// Scopes must all be granted to the token
+	Scopes []string
+}
+
+// scopes decodes scopes given as a space separated string or as a list
+type scopes []string
+
+func (s *scopes) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	*s = strings.Fields(str)
+	return nil
+}
+
+// accessTokenClaims are the claims of JWT access tokens. Identity providers name the client and scopes differently
+type accessTokenClaims struct {
+	jwt.Claims
+	ClientID        string `json:"client_id"`
+	AuthorizedParty string `json:"azp"`
+	OktaClientID    string `json:"cid"`
+	AzureAppID      string `json:"appid"`
+	Scope           scopes `json:"scope"`
+	Scp             scopes `json:"scp"`
+}
+
+// introspection is an RFC 7662 introspection response
+type introspection struct {
+	Active   bool         `json:"active"`
+	Scope    scopes       `json:"scope"`
+	ClientID string       `json:"client_id"`
+	Subject  string       `json:"sub"`
+	Audience jwt.Audience `json:"aud"`
+	Issuer   string       `json:"iss"`
+	Expiry   int64        `json:"exp"`
+}
+
+type introspectionEntry struct {
+	result    introspection
+	expiresAt time.Time
+}
+
+// BearerAuthenticator authenticates clients with access tokens, typically issued with the client credentials grant
+type BearerAuthenticator struct {
+	config BearerConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]introspectionEntry
+}
+
+// NewBearerAuthenticator creates a bearer token authenticator with a given config
+func NewBearerAuthenticator(config BearerConfig) *BearerAuthenticator {
+	if config.Introspection.CacheTTL == 0 {
+		config.Introspection.CacheTTL = defaultIntrospectionCacheTTL
+	}
+	return &BearerAuthenticator{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  make(map[string]introspectionEntry),
+	}
+}
+
+// Authenticate validates an access token against a policy and returns the client it was issued to
+func (b *BearerAuthenticator) Authenticate(token string, policy BearerPolicy) (Principal, error) {
+	var (
+		principal Principal
+		audience  jwt.Audience
+		err       error
+	)
+
+	// JWT access tokens are verified locally, opaque ones are introspected
+	if strings.Count(token, ".") == 2 && b.config.KeySet != nil {
+		principal, audience, err = b.verify(token)
+	} else if b.config.Introspection.URL != "" {
+		principal, audience, err = b.introspect(token)
+	} else {
+		err = ErrAccessToken
+	}
+	if err != nil {
+		return principal, err
+	}
+
+	if !audience.Contains(policy.Audience) {
+		log.Debugf("Access token audience %v does not include %q", audience, policy.Audience)
+		return principal, ErrAccessToken
+	}
+	for _, scope := range policy.Scopes {
+		if !contains(principal.Scopes, scope) {
+			return principal, ErrInsufficientScope
+		}
+	}
+
+	return principal, nil
+}
+
+// verify checks the signature and claims of a JWT access token
+func (b *BearerAuthenticator) verify(token string) (Principal, jwt.Audience, error) {
+	var claims accessTokenClaims
+	if err := b.config.KeySet.VerifyJWT(token, &claims); err != nil {
+		log.Debugf("Cannot verify access token: %v", err)
+		return Principal{}, nil, ErrAccessToken
+	}
+
+	err := claims.ValidateWithLeeway(jwt.Expected{
+		Issuer: b.config.Issuer,
+		Time:   time.Now(),
+	}, time.Minute)
+	if err != nil || claims.Expiry == nil {
+		log.Debugf("Invalid access token claims: %v", err)
+		return Principal{}, nil, ErrAccessToken
+	}
+
+	principal := Principal{
+		ClientID: firstNonEmpty(claims.ClientID, claims.AuthorizedParty, claims.OktaClientID, claims.AzureAppID),
+		Subject:  claims.Subject,
+		Scopes:   append(claims.Scope, claims.Scp...),
+	}
+	return principal, claims.Audience, nil
+}
+
+// introspect asks the authorization server about an opaque access token, results are cached
+func (b *BearerAuthenticator) introspect(token string) (Principal, jwt.Audience, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	b.mu.Lock()
+	entry, ok := b.cache[key]
+	b.mu.Unlock()
+
+	if !ok || !entry.expiresAt.After(now) {
+		result, err := b.fetchIntrospection(token)
+		if err != nil {
+			log.Errorf("Cannot introspect access token: %v", err)
+			return Principal{}, nil, ErrAccessToken
+		}
+
+		entry = introspectionEntry{result: result, expiresAt: now.Add(b.config.Introspection.CacheTTL)}
+		if exp := time.Unix(result.Expiry, 0); result.Expiry != 0 && exp.Before(entry.expiresAt) {
+			entry.expiresAt = exp
+		}
+
+		b.mu.Lock()
+		for k, e := range b.cache {
+			if !e.expiresAt.After(now) {
+				delete(b.cache, k)
+			}
+		}
+		b.cache[key] = entry
+		b.mu.Unlock()
+	}
+
+	result := entry.result
+	if !result.Active || (result.Expiry != 0 && !time.Unix(result.Expiry, 0).After(now)) {
+		return Principal{}, nil, ErrAccessToken
+	}
+	if b.config.Issuer != "" && result.Issuer != "" && result.Issuer != b.config.Issuer {
+		log.Debugf("Access token issuer %q is not %q", result.Issuer, b.config.Issuer)
+		return Principal{}, nil, ErrAccessToken
+	}
+
+	principal := Principal{
+		ClientID: result.ClientID,
+		Subject:  result.Subject,
+		Scopes:   result.Scope,
+	}
+	return principal, result.Audience, nil
+}
+
+func (b *BearerAuthenticator) fetchIntrospection(token string) (introspection, error) {
+	var result introspection
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, b.config.Introspection.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(b.config.Introspection.ClientID), url.QueryEscape(b.config.Introspection.ClientSecret))
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("introspection failed: %s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
+
+// Middleware accepts requests carrying a valid bearer access token. Requests without one are passed to fallback,
+// typically the session middleware, or rejected when fallback is nil
+func (b *BearerAuthenticator) Middleware(policy BearerPolicy, next, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			if fallback != nil {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			bearerError(w, r, nil, policy)
+			return
+		}
+
+		principal, err := b.Authenticate(strings.TrimPrefix(header, "Bearer "), policy)
+		if err != nil {
+			log.Debugf("Rejecting access token for %q: %v", r.URL, err)
+			bearerError(w, r, err, policy)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// bearerError rejects a request as described by RFC 6750
+func bearerError(w http.ResponseWriter, r *http.Request, err error, policy BearerPolicy) {
+	if grpcutil.IsGRPCRequest(r) {
+		code := codes.Unauthenticated
+		if err == ErrInsufficientScope {
+			code = codes.PermissionDenied
+		}
+		grpcutil.WriteError(w, code, ErrUnauthorized.Error())
+		return
+	}
+
+	challenge := `Bearer realm="helios"`
+	status := http.StatusUnauthorized
+	switch err {
+	case nil:
+	case ErrInsufficientScope:
+		challenge += fmt.Sprintf(`, error="insufficient_scope", scope=%q`, strings.Join(policy.Scopes, " "))
+		status = http.StatusForbidden
+	default:
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(status)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
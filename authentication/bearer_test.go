@@ -0,0 +1,173 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBearerAuthenticator_JWT(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+
+	bearer := NewBearerAuthenticator(BearerConfig{KeySet: providers.NewKeySet(idp.URL), Issuer: "https://idp.test"})
+	policy := BearerPolicy{Audience: "https://api.test", Scopes: []string{"read"}}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":       "https://idp.test",
+			"aud":       []string{"https://api.test"},
+			"sub":       "svc",
+			"client_id": "billing",
+			"scope":     "read write",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		Name      string
+		Token     string
+		Err       error
+		Principal Principal
+	}{
+		{"valid", idp.sign(t, idp.key, claims(nil)), nil,
+			Principal{ClientID: "billing", Subject: "svc", Scopes: []string{"read", "write"}}},
+		{"azp and scp list", idp.sign(t, idp.key, claims(map[string]interface{}{"client_id": nil, "scope": nil,
+			"azp": "reports", "scp": []string{"read"}})), nil,
+			Principal{ClientID: "reports", Subject: "svc", Scopes: []string{"read"}}},
+		{"unknown key", idp.sign(t, otherKey, claims(nil)), ErrAccessToken, Principal{}},
+		{"issuer", idp.sign(t, idp.key, claims(map[string]interface{}{"iss": "https://evil.test"})), ErrAccessToken, Principal{}},
+		{"audience", idp.sign(t, idp.key, claims(map[string]interface{}{"aud": "https://other.test"})), ErrAccessToken, Principal{}},
+		{"expired", idp.sign(t, idp.key, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), ErrAccessToken, Principal{}},
+		{"no expiry", idp.sign(t, idp.key, claims(map[string]interface{}{"exp": nil})), ErrAccessToken, Principal{}},
+		{"scope", idp.sign(t, idp.key, claims(map[string]interface{}{"scope": "write"})), ErrInsufficientScope, Principal{}},
+		{"opaque", "opaque", ErrAccessToken, Principal{}},
+	}
+
+	for _, test := range tests {
+		principal, err := bearer.Authenticate(test.Token, policy)
+		assert.Equal(t, test.Err, err, test.Name)
+		if err == nil {
+			assert.Equal(t, test.Principal, principal, test.Name)
+		}
+	}
+}
+
+func TestBearerAuthenticator_Introspection(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		id, secret, _ := r.BasicAuth()
+		assert.Equal(t, "helios", id)
+		assert.Equal(t, "secret", secret)
+		assert.Equal(t, "access_token", r.PostFormValue("token_type_hint"))
+
+		switch r.PostFormValue("token") {
+		case "active":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"active":    true,
+				"client_id": "billing",
+				"scope":     "read",
+				"aud":       "https://api.test",
+				"exp":       time.Now().Add(time.Hour).Unix(),
+			})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer server.Close()
+
+	bearer := NewBearerAuthenticator(BearerConfig{Introspection: IntrospectionConfig{
+		URL:          server.URL,
+		ClientID:     "helios",
+		ClientSecret: "secret",
+	}})
+	policy := BearerPolicy{Audience: "https://api.test"}
+
+	for i := 0; i < 2; i++ {
+		principal, err := bearer.Authenticate("active", policy)
+		assert.NoError(t, err)
+		assert.Equal(t, Principal{ClientID: "billing", Scopes: []string{"read"}}, principal)
+
+		_, err = bearer.Authenticate("revoked", policy)
+		assert.Equal(t, ErrAccessToken, err)
+	}
+	// results are cached, including inactive tokens
+	assert.Equal(t, 2, calls)
+
+	_, err := bearer.Authenticate("active", BearerPolicy{Audience: "https://api.test", Scopes: []string{"write"}})
+	assert.Equal(t, ErrInsufficientScope, err)
+}
+
+func TestBearerAuthenticator_Middleware(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+
+	bearer := NewBearerAuthenticator(BearerConfig{KeySet: providers.NewKeySet(idp.URL)})
+	policy := BearerPolicy{Audience: "https://api.test", Scopes: []string{"admin"}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := PrincipalFromContext(r.Context())
+		assert.True(t, ok)
+		_, _ = w.Write([]byte(principal.ClientID))
+	})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusFound)
+	})
+
+	token := func(scope string) string {
+		return idp.sign(t, idp.key, map[string]interface{}{
+			"aud":       "https://api.test",
+			"client_id": "billing",
+			"scope":     scope,
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	tests := []struct {
+		Authorization string
+		Fallback      http.Handler
+		Code          int
+		Challenge     string
+	}{
+		{"Bearer " + token("admin"), nil, http.StatusOK, ""},
+		{"", fallback, http.StatusFound, ""},
+		{"", nil, http.StatusUnauthorized, `Bearer realm="helios"`},
+		{"Bearer invalid", fallback, http.StatusUnauthorized, `Bearer realm="helios", error="invalid_token"`},
+		{"Bearer " + token("read"), nil, http.StatusForbidden, `Bearer realm="helios", error="insufficient_scope", scope="admin"`},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://testing/api", nil)
+		if test.Authorization != "" {
+			req.Header.Set("Authorization", test.Authorization)
+		}
+		res := httptest.NewRecorder()
+		bearer.Middleware(policy, next, test.Fallback).ServeHTTP(res, req)
+
+		assert.Equal(t, test.Code, res.Code, i)
+		assert.Equal(t, test.Challenge, res.Header().Get("WWW-Authenticate"), i)
+		if test.Code == http.StatusOK {
+			assert.Equal(t, "billing", res.Body.String(), i)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "http://testing/api.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Authorization", "Bearer "+token("read"))
+	res := httptest.NewRecorder()
+	bearer.Middleware(policy, next, nil).ServeHTTP(res, req)
+	assert.Equal(t, "7", res.Header().Get("Grpc-Status"))
+}
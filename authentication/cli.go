@@ -0,0 +1,539 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// CLI endpoints, command line clients log in through them to get a token sent in the HeaderName header
+const (
+	// CLIAuthorizePath logs users in with their browser and hands a one-time code to a loopback callback
+	CLIAuthorizePath = "/.well-known/cli/authorize"
+	// CLIDeviceCodePath is the RFC 8628 device authorization endpoint
+	CLIDeviceCodePath = "/.well-known/cli/device/code"
+	// CLIDevicePath is the page users approve device codes on
+	CLIDevicePath = "/.well-known/cli/device"
+	// CLITokenPath exchanges one-time codes and approved device codes for a token
+	CLITokenPath = "/.well-known/cli/token"
+)
+
+const (
+	// DeviceCodeGrantType is the RFC 8628 grant type
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// CLITokenType is the type of tokens issued to command line clients
+	CLITokenType = "Helios"
+
+	cliCodePrefix        = codePrefix + "cli:"
+	deviceCodeExpiration = 10 * time.Minute
+	devicePollInterval   = 5 * time.Second
+	// user codes avoid vowels and ambiguous characters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// maxDeviceGrants bounds the memory held by pending device authorizations, which anyone can start
+	maxDeviceGrants = 1000
+)
+
+// CLIConfig command line client login configuration
+type CLIConfig struct {
+	Enabled bool
+	// TokenExpiration is the lifetime of tokens issued to command line clients, defaults to the JWT expiration
+	TokenExpiration time.Duration
+}
+
+// DeviceAuthorization is the response of the device authorization endpoint
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// CLIToken is the response of the token endpoint
+type CLIToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// tokenError is an OAuth2 token endpoint error
+type tokenError struct {
+	Error string `json:"error"`
+}
+
+// deviceGrant is a pending device authorization
+type deviceGrant struct {
+	userCode  string
+	expiresAt time.Time
+	interval  time.Duration
+	lastPoll  time.Time
+	// login is set once a user approved the grant
+	login  *session.Session
+	denied bool
+}
+
+// deviceGrants holds pending device authorizations by device code and user code
+type deviceGrants struct {
+	sync.Mutex
+	byDeviceCode map[string]*deviceGrant
+	byUserCode   map[string]*deviceGrant
+}
+
+func newDeviceGrants() *deviceGrants {
+	return &deviceGrants{
+		byDeviceCode: make(map[string]*deviceGrant),
+		byUserCode:   make(map[string]*deviceGrant),
+	}
+}
+
+// expire drops grants past their expiration, the lock must be held
+func (g *deviceGrants) expire(now time.Time) {
+	for code, grant := range g.byDeviceCode {
+		if !grant.expiresAt.After(now) {
+			delete(g.byDeviceCode, code)
+			delete(g.byUserCode, grant.userCode)
+		}
+	}
+}
+
+var authorizePageTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Terminal login</title></head>
+<body>
+<form method="post">
+<p>Signed in as {{ .Email }}. Approve the login of your terminal only if you just started it with helios login.</p>
+<input type="hidden" name="callback" value="{{ .Callback }}">
+<input type="hidden" name="state" value="{{ .State }}">
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+<button name="action" value="approve">Approve</button>
+<button name="action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+var devicePageTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Device login</title></head>
+<body>
+{{ if .Message }}<p>{{ .Message }}</p>
+{{ else }}<form method="post">
+<p>Signed in as {{ .Email }}. Approve the login of your terminal if it shows this code:</p>
+<input name="user_code" value="{{ .UserCode }}" autocomplete="off" required>
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+<button name="action" value="approve">Approve</button>
+<button name="action" value="deny">Deny</button>
+</form>
+{{ end }}</body>
+</html>
+`))
+
+// normalizeUserCode ignores case, dashes and spaces users may type
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits a user code in two halves, easier to read and type
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// isLoopback checks that a callback URL stays on the machine of the user
+func isLoopback(callback string) bool {
+	u, err := url.Parse(callback)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// cliCSRF binds a CLI login approval form to the signed in user
+func (helios Helios) cliCSRF(form string, identity Identity) string {
+	mac := hmac.New(sha256.New, []byte(helios.jwtConfig.Secret))
+	mac.Write([]byte(form + "\n" + identity.Email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeCLIPage renders a CLI login approval page
+func writeCLIPage(w http.ResponseWriter, status int, page *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the page must not be framed, approvals could be clickjacked
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := page.Execute(w, data); err != nil {
+		log.Error(err)
+	}
+}
+
+// cliLogin returns the user a command line login is approved for. The identity provider subject and session of the
+// approving session are kept, so the token is revoked along with them
+func cliLogin(r *http.Request, identity Identity) *session.Session {
+	login := &session.Session{User: identity.Email, Groups: identity.Groups, Provider: identity.Provider}
+	if s, ok := sessionFromContext(r.Context()); ok {
+		login.Subject, login.ProviderSessionID = s.Subject, s.ProviderSessionID
+	}
+	return login
+}
+
+// issueCLIToken issues a token command line clients send in the HeaderName header. Tokens are server-side sessions
+// when a store is used, so they can be revoked and time out like browser sessions
+func (helios Helios) issueCLIToken(login *session.Session) (CLIToken, error) {
+	expiration := helios.cli.TokenExpiration
+	if expiration == 0 {
+		expiration = helios.jwtConfig.Expiration
+	}
+	if helios.maxLifetime > 0 && expiration > helios.maxLifetime {
+		expiration = helios.maxLifetime
+	}
+
+	now := time.Now()
+	if helios.store != nil {
+		id, err := session.NewID()
+		if err != nil {
+			return CLIToken{}, err
+		}
+		err = helios.store.Save(&session.Session{
+			ID:                id,
+			User:              login.User,
+			Provider:          login.Provider,
+			Groups:            login.Groups,
+			Subject:           login.Subject,
+			ProviderSessionID: login.ProviderSessionID,
+			CreatedAt:         now,
+			LastSeenAt:        now,
+			RefreshAt:         now.Add(expiration),
+			ExpiresAt:         now.Add(expiration),
+		})
+		if err != nil {
+			return CLIToken{}, err
+		}
+		return CLIToken{AccessToken: id, TokenType: CLITokenType, ExpiresIn: int64(expiration.Seconds())}, nil
+	}
+
+	// signed tokens are not renewed by activity, they would end at the idle timeout anyway
+	if helios.idleTimeout > 0 && expiration > helios.idleTimeout {
+		expiration = helios.idleTimeout
+	}
+	claims := &Claims{
+		Groups:   login.Groups,
+		AuthTime: now.Unix(),
+		Provider: login.Provider,
+	}
+	claims.Subject = login.User
+	claims.ExpiresAt = now.Add(expiration).Unix()
+
+	token, err := IssueJWTWithClaims(helios.jwtConfig.Secret, claims)
+	if err != nil {
+		return CLIToken{}, err
+	}
+	return CLIToken{AccessToken: token, TokenType: CLITokenType, ExpiresIn: int64(expiration.Seconds())}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+// CLIAuthorizeHandler hands a one-time code to the loopback callback of a command line client once the user
+// approved the login. It must be served behind the middleware, which logs the user in first
+func (helios Helios) CLIAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	identity, ok := IdentityFromContext(r.Context())
+	if !helios.cli.Enabled || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Email    string
+		Callback string
+		State    string
+		CSRF     string
+	}{
+		Email:    identity.Email,
+		Callback: r.FormValue("callback"),
+		State:    r.FormValue("state"),
+		CSRF:     helios.cliCSRF("authorize", identity),
+	}
+	if !isLoopback(data.Callback) || data.State == "" {
+		log.Warnf("Rejecting CLI login: invalid callback %q", data.Callback)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// any page could send the browser here, codes are only handed out once the user approves
+		writeCLIPage(w, http.StatusOK, authorizePageTemplate, data)
+		return
+	case http.MethodPost:
+		if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(data.CSRF)) {
+			log.Warnf("Rejecting CLI login of %q: invalid CSRF token", identity.Email)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	target, _ := url.Parse(data.Callback)
+	query := target.Query()
+	query.Set("state", data.State)
+	if r.PostFormValue("action") != "approve" {
+		query.Set("error", "access_denied")
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	id, err := session.NewID()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	code := cliLogin(r, identity)
+	code.ID = cliCodePrefix + id
+	code.CreatedAt = now
+	code.ExpiresAt = now.Add(codeExpiration)
+	if err := helios.codes.Save(code); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query.Set("code", cliCodePrefix+id)
+	target.RawQuery = query.Encode()
+	log.Debugf("Handing CLI login of %q to %s", identity.Email, target.Host)
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// CLIDeviceCodeHandler starts a device authorization
+func (helios Helios) CLIDeviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !helios.cli.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceCode, err := session.NewID()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	grant := &deviceGrant{expiresAt: now.Add(deviceCodeExpiration), interval: devicePollInterval}
+
+	helios.devices.Lock()
+	helios.devices.expire(now)
+	if len(helios.devices.byDeviceCode) >= maxDeviceGrants {
+		helios.devices.Unlock()
+		log.Warn("Rejecting device authorization: too many pending device logins")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	for grant.userCode == "" || helios.devices.byUserCode[grant.userCode] != nil {
+		if grant.userCode, err = newUserCode(); err != nil {
+			helios.devices.Unlock()
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	helios.devices.byDeviceCode[deviceCode] = grant
+	helios.devices.byUserCode[grant.userCode] = grant
+	helios.devices.Unlock()
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	verification := scheme + "://" + r.Host + CLIDevicePath
+	writeJSON(w, http.StatusOK, DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                formatUserCode(grant.userCode),
+		VerificationURI:         verification,
+		VerificationURIComplete: verification + "?" + url.Values{"user_code": {formatUserCode(grant.userCode)}}.Encode(),
+		ExpiresIn:               int64(deviceCodeExpiration.Seconds()),
+		Interval:                int64(devicePollInterval.Seconds()),
+	})
+}
+
+// CLIDeviceHandler lets users approve a device code. It must be served behind the middleware, which logs the user
+// in first
+func (helios Helios) CLIDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	identity, ok := IdentityFromContext(r.Context())
+	if !helios.cli.Enabled || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Email    string
+		UserCode string
+		CSRF     string
+		Message  string
+	}{
+		Email:    identity.Email,
+		UserCode: r.FormValue("user_code"),
+		CSRF:     helios.cliCSRF("device", identity),
+	}
+
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(data.CSRF)) {
+			log.Warnf("Rejecting device approval of %q: invalid CSRF token", identity.Email)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		helios.devices.Lock()
+		helios.devices.expire(now)
+		grant := helios.devices.byUserCode[normalizeUserCode(data.UserCode)]
+		switch {
+		case grant == nil || grant.login != nil || grant.denied:
+			status = http.StatusBadRequest
+			data.Message = "This code is invalid or expired, start the login again."
+		case r.PostFormValue("action") == "approve":
+			grant.login = cliLogin(r, identity)
+			data.Message = "Your terminal is now logged in, you can close this page."
+			log.Infof("Device login approved by %q", identity.Email)
+		default:
+			grant.denied = true
+			data.Message = "The login was denied."
+		}
+		helios.devices.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeCLIPage(w, status, devicePageTemplate, data)
+}
+
+// CLITokenHandler exchanges one-time codes and approved device codes for a token
+func (helios Helios) CLITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !helios.cli.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var login *session.Session
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		code := r.PostFormValue("code")
+		if !strings.HasPrefix(code, cliCodePrefix) {
+			writeJSON(w, http.StatusBadRequest, tokenError{"invalid_grant"})
+			return
+		}
+		s, err := helios.codes.Load(code)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, tokenError{"invalid_grant"})
+			return
+		}
+		// codes can only be used once
+		if err := helios.codes.Delete(code); err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		login = s
+
+	case DeviceCodeGrantType:
+		now := time.Now()
+		helios.devices.Lock()
+		helios.devices.expire(now)
+		code := r.PostFormValue("device_code")
+		grant := helios.devices.byDeviceCode[code]
+		var errCode string
+		switch {
+		case grant == nil:
+			errCode = "expired_token"
+		case grant.denied:
+			errCode = "access_denied"
+		case grant.login == nil && now.Sub(grant.lastPoll) < grant.interval:
+			grant.interval += devicePollInterval
+			errCode = "slow_down"
+		case grant.login == nil:
+			errCode = "authorization_pending"
+		}
+		if grant != nil {
+			grant.lastPoll = now
+			if errCode == "" || errCode == "access_denied" {
+				delete(helios.devices.byDeviceCode, code)
+				delete(helios.devices.byUserCode, grant.userCode)
+			}
+		}
+		helios.devices.Unlock()
+
+		if errCode != "" {
+			writeJSON(w, http.StatusBadRequest, tokenError{errCode})
+			return
+		}
+		login = grant.login
+
+	default:
+		writeJSON(w, http.StatusBadRequest, tokenError{"unsupported_grant_type"})
+		return
+	}
+
+	token, err := helios.issueCLIToken(login)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Issued CLI token to %q", login.User)
+	writeJSON(w, http.StatusOK, token)
+}
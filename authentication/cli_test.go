@@ -0,0 +1,297 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newCLIAuth() Helios {
+	return NewHeliosAuthenticationWithConfig(new(mockProvider), Config{
+		JWT: JWTConfig{Secret: "test", Expiration: time.Minute},
+		CLI: CLIConfig{Enabled: true, TokenExpiration: time.Hour},
+	})
+}
+
+func postForm(handler http.HandlerFunc, target string, form url.Values, identity *Identity) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if identity != nil {
+		req = req.WithContext(WithIdentity(context.Background(), *identity))
+	}
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func tokenErrorOf(t *testing.T, res *httptest.ResponseRecorder) string {
+	var body tokenError
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	return body.Error
+}
+
+// assertCLIToken checks that a token endpoint response holds a token accepted by the middleware
+func assertCLIToken(t *testing.T, auth Helios, res *httptest.ResponseRecorder, email string) {
+	assert.Equal(t, http.StatusOK, res.Code)
+	var token CLIToken
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&token))
+	assert.Equal(t, CLITokenType, token.TokenType)
+	assert.Equal(t, int64(3600), token.ExpiresIn)
+
+	req := httptest.NewRequest("GET", "http://testing/api", nil)
+	req.Header.Set(HeaderName, token.AccessToken)
+	res = httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := IdentityFromContext(r.Context())
+		assert.Equal(t, email, identity.Email)
+		assert.Equal(t, []string{"engineering"}, identity.Groups)
+	})).ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestHelios_CLIDeviceFlow(t *testing.T) {
+	auth := newCLIAuth()
+	jane := &Identity{Email: "jane@acme.test", Groups: []string{"engineering"}, Provider: DefaultProviderName}
+
+	res := postForm(auth.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var device DeviceAuthorization
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&device))
+	assert.Equal(t, "http://testing"+CLIDevicePath, device.VerificationURI)
+	assert.Regexp(t, "^[B-Z]{4}-[B-Z]{4}$", device.UserCode)
+	assert.Equal(t, int64(5), device.Interval)
+
+	poll := func() *httptest.ResponseRecorder {
+		return postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath,
+			url.Values{"grant_type": {DeviceCodeGrantType}, "device_code": {device.DeviceCode}}, nil)
+	}
+	assert.Equal(t, "authorization_pending", tokenErrorOf(t, poll()))
+	// clients polling faster than the interval are slowed down
+	assert.Equal(t, "slow_down", tokenErrorOf(t, poll()))
+
+	// the approval page requires a logged in user and the CSRF token of the user
+	req := httptest.NewRequest("GET", device.VerificationURIComplete, nil)
+	res = httptest.NewRecorder()
+	auth.CLIDeviceHandler(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = httptest.NewRecorder()
+	auth.CLIDeviceHandler(res, req.WithContext(WithIdentity(context.Background(), *jane)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), device.UserCode)
+	csrf := auth.cliCSRF("device", *jane)
+	assert.Contains(t, res.Body.String(), csrf)
+
+	approve := url.Values{"user_code": {strings.ToLower(device.UserCode)}, "action": {"approve"}, "csrf": {"forged"}}
+	res = postForm(auth.CLIDeviceHandler, "http://testing"+CLIDevicePath, approve, jane)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	approve.Set("csrf", csrf)
+	res = postForm(auth.CLIDeviceHandler, "http://testing"+CLIDevicePath, approve, jane)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "logged in")
+
+	// approvals are final
+	res = postForm(auth.CLIDeviceHandler, "http://testing"+CLIDevicePath, approve, jane)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	assertCLIToken(t, auth, poll(), "jane@acme.test")
+	// device codes are exchanged once
+	assert.Equal(t, "expired_token", tokenErrorOf(t, poll()))
+}
+
+func TestHelios_CLIDeviceDenied(t *testing.T) {
+	auth := newCLIAuth()
+	jane := &Identity{Email: "jane@acme.test"}
+
+	res := postForm(auth.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+	var device DeviceAuthorization
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&device))
+
+	deny := url.Values{"user_code": {device.UserCode}, "action": {"deny"}, "csrf": {auth.cliCSRF("device", *jane)}}
+	res = postForm(auth.CLIDeviceHandler, "http://testing"+CLIDevicePath, deny, jane)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath,
+		url.Values{"grant_type": {DeviceCodeGrantType}, "device_code": {device.DeviceCode}}, nil)
+	assert.Equal(t, "access_denied", tokenErrorOf(t, res))
+}
+
+func TestHelios_CLIDeviceLimit(t *testing.T) {
+	auth := newCLIAuth()
+
+	for i := 0; i < maxDeviceGrants; i++ {
+		res := postForm(auth.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+	// pending logins are bounded, new ones wait for others to expire
+	res := postForm(auth.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+
+	auth.devices.Lock()
+	auth.devices.expire(time.Now().Add(deviceCodeExpiration))
+	auth.devices.Unlock()
+	res = postForm(auth.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestHelios_CLIAuthorize(t *testing.T) {
+	auth := newCLIAuth()
+	jane := Identity{Email: "jane@acme.test", Groups: []string{"engineering"}}
+
+	tests := []struct {
+		Callback string
+		Code     int
+	}{
+		{"http://127.0.0.1:4242/callback", http.StatusFound},
+		{"http://localhost:4242/callback", http.StatusFound},
+		{"http://[::1]:4242/callback", http.StatusFound},
+		{"https://evil.test/callback", http.StatusBadRequest},
+		{"http://evil.test/callback", http.StatusBadRequest},
+	}
+	csrf := auth.cliCSRF("authorize", jane)
+	var location *url.URL
+	for _, test := range tests {
+		approve := url.Values{"callback": {test.Callback}, "state": {"xyz"}, "csrf": {csrf}, "action": {"approve"}}
+		res := postForm(auth.CLIAuthorizeHandler, "http://testing"+CLIAuthorizePath, approve, &jane)
+		assert.Equal(t, test.Code, res.Code, test.Callback)
+		if res.Code == http.StatusFound {
+			var err error
+			location, err = url.Parse(res.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "xyz", location.Query().Get("state"))
+		}
+	}
+
+	// opening the page does not hand out a code, the user approves the login first
+	req := httptest.NewRequest("GET", "http://testing"+CLIAuthorizePath+"?"+
+		url.Values{"callback": {"http://127.0.0.1:4242/callback"}, "state": {"xyz"}}.Encode(), nil)
+	res := httptest.NewRecorder()
+	auth.CLIAuthorizeHandler(res, req.WithContext(WithIdentity(context.Background(), jane)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, res.Header().Get("Location"))
+	assert.Contains(t, res.Body.String(), csrf)
+
+	form := url.Values{"callback": {"http://127.0.0.1:4242/callback"}, "state": {"xyz"}, "csrf": {"forged"},
+		"action": {"approve"}}
+	res = postForm(auth.CLIAuthorizeHandler, "http://testing"+CLIAuthorizePath, form, &jane)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	form.Set("csrf", csrf)
+	form.Set("action", "deny")
+	res = postForm(auth.CLIAuthorizeHandler, "http://testing"+CLIAuthorizePath, form, &jane)
+	assert.Equal(t, http.StatusFound, res.Code)
+	denied, err := url.Parse(res.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "access_denied", denied.Query().Get("error"))
+	assert.Empty(t, denied.Query().Get("code"))
+
+	code := location.Query().Get("code")
+	// codes handed to command line clients do not create browser sessions
+	res = httptest.NewRecorder()
+	auth.SSORedeemHandler(res, httptest.NewRequest("GET", "http://testing"+SSORedeemPath+"?"+
+		url.Values{"code": {code}, "rd": {"http://testing/"}}.Encode(), nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}}
+	assertCLIToken(t, auth, postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath, exchange, nil), "jane@acme.test")
+	// codes are exchanged once
+	res = postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath, exchange, nil)
+	assert.Equal(t, "invalid_grant", tokenErrorOf(t, res))
+
+	res = postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath, url.Values{"grant_type": {"password"}}, nil)
+	assert.Equal(t, "unsupported_grant_type", tokenErrorOf(t, res))
+
+	disabled := NewHeliosAuthenticationWithConfig(new(mockProvider), Config{JWT: JWTConfig{Secret: "test"}})
+	res = postForm(disabled.CLIDeviceCodeHandler, "http://testing"+CLIDeviceCodePath, nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestHelios_CLITokenStore(t *testing.T) {
+	store, oauth2 := session.NewMemoryStore(), new(mockProvider)
+	oauth2.On("GetLoginURL", mock.Anything, mock.Anything).Return("http://login")
+	auth := NewHeliosAuthenticationWithConfig(oauth2, Config{
+		JWT:         JWTConfig{Secret: "test", Expiration: time.Minute},
+		CLI:         CLIConfig{Enabled: true, TokenExpiration: time.Hour},
+		Store:       store,
+		MaxLifetime: 30 * time.Minute,
+	})
+	jane := Identity{Email: "jane@acme.test", Groups: []string{"engineering"}, Provider: DefaultProviderName}
+	browser := &session.Session{User: jane.Email, Provider: DefaultProviderName, Subject: "idp-jane",
+		ProviderSessionID: "idp-session"}
+
+	login := func() CLIToken {
+		approve := url.Values{"callback": {"http://127.0.0.1:4242/callback"}, "state": {"xyz"},
+			"csrf": {auth.cliCSRF("authorize", jane)}, "action": {"approve"}}
+		req := httptest.NewRequest("POST", "http://testing"+CLIAuthorizePath, strings.NewReader(approve.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		auth.CLIAuthorizeHandler(res, req.WithContext(withSession(WithIdentity(context.Background(), jane), browser)))
+		location, err := url.Parse(res.Header().Get("Location"))
+		assert.NoError(t, err)
+
+		res = postForm(auth.CLITokenHandler, "http://testing"+CLITokenPath,
+			url.Values{"grant_type": {"authorization_code"}, "code": {location.Query().Get("code")}}, nil)
+		var token CLIToken
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&token))
+		return token
+	}
+	serve := func(token CLIToken) int {
+		req := httptest.NewRequest("GET", "http://testing/api", nil)
+		req.Header.Set(HeaderName, token.AccessToken)
+		res := httptest.NewRecorder()
+		auth.Middleware(http.NotFoundHandler()).ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// tokens never outlive the session lifetime
+	token := login()
+	assert.Equal(t, int64(1800), token.ExpiresIn)
+	assert.Equal(t, http.StatusNotFound, serve(token))
+
+	// tokens are revoked with the sessions of the user
+	assert.NoError(t, store.DeleteUser(jane.Email))
+	assert.Equal(t, http.StatusUnauthorized, serve(token))
+
+	token = login()
+	assert.NoError(t, store.DeleteProviderSession(DefaultProviderName, "idp-session"))
+	assert.Equal(t, http.StatusUnauthorized, serve(token))
+
+	// clients holding signed tokens keep working once sessions are kept server-side, within the session lifetime
+	claims := &Claims{AuthTime: time.Now().Unix()}
+	claims.Subject = jane.Email
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	signed, err := IssueJWTWithClaims("test", claims)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, serve(CLIToken{AccessToken: signed}))
+
+	claims.AuthTime = time.Now().Add(-time.Hour).Unix()
+	signed, err = IssueJWTWithClaims("test", claims)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, serve(CLIToken{AccessToken: signed}))
+	forged, err := IssueJWTWithClaims("other", &Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, serve(CLIToken{AccessToken: forged}))
+}
+
+func TestHelios_CLITokenIdleTimeout(t *testing.T) {
+	auth := NewHeliosAuthenticationWithConfig(new(mockProvider), Config{
+		JWT:         JWTConfig{Secret: "test"},
+		CLI:         CLIConfig{Enabled: true, TokenExpiration: time.Hour},
+		IdleTimeout: 30 * time.Minute,
+	})
+
+	// signed tokens are never renewed, so they are not issued past the idle timeout
+	token, err := auth.issueCLIToken(&session.Session{User: "jane@acme.test"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1800), token.ExpiresIn)
+}
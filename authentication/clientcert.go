@@ -0,0 +1,67 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/cyakimov/helios/grpcutil"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// ClientCertificate is the identity of a TLS client certificate verified by the listener
+type ClientCertificate struct {
+	Subject string
+	Issuer  string
+	// URIs, Emails and DNSNames are the subject alternative names
+	URIs     []string
+	Emails   []string
+	DNSNames []string
+	// SPIFFEID is the spiffe:// URI of workloads
+	SPIFFEID string
+	// Fingerprint is the hex encoded SHA-256 of the certificate
+	Fingerprint string
+}
+
+// ClientCertificateFromRequest returns the client certificate of a request, if the listener verified one
+func ClientCertificateFromRequest(r *http.Request) (ClientCertificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ClientCertificate{}, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	sum := sha256.Sum256(cert.Raw)
+	cc := ClientCertificate{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Emails:      cert.EmailAddresses,
+		DNSNames:    cert.DNSNames,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	for _, uri := range cert.URIs {
+		cc.URIs = append(cc.URIs, uri.String())
+		if uri.Scheme == "spiffe" && cc.SPIFFEID == "" {
+			cc.SPIFFEID = uri.String()
+		}
+	}
+
+	return cc, true
+}
+
+// RequireClientCertificate rejects requests without a verified client certificate
+func RequireClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ClientCertificateFromRequest(r); !ok {
+			log.Debugf("No client certificate for %q", r.URL)
+			if grpcutil.IsGRPCRequest(r) {
+				grpcutil.WriteError(w, codes.Unauthenticated, ErrUnauthorized.Error())
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,59 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireClientCertificate(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://acme.test/ns/prod/sa/billing")
+	cert := &x509.Certificate{
+		Raw:            []byte("der"),
+		Subject:        pkix.Name{CommonName: "billing", Organization: []string{"ACME"}},
+		Issuer:         pkix.Name{CommonName: "ACME devices"},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{"billing@acme.test"},
+	}
+
+	var got ClientCertificate
+	mdw := RequireClientCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = ClientCertificateFromRequest(r)
+	}))
+
+	tests := []struct {
+		TLS        *tls.ConnectionState
+		StatusCode int
+	}{
+		{nil, http.StatusUnauthorized},
+		// certificates the listener did not verify are ignored
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusUnauthorized},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "https://testing/", nil)
+		req.TLS = test.TLS
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+		assert.Equal(t, test.StatusCode, res.Code)
+	}
+
+	sum := sha256.Sum256([]byte("der"))
+	assert.Equal(t, ClientCertificate{
+		Subject:     "CN=billing,O=ACME",
+		Issuer:      "CN=ACME devices",
+		URIs:        []string{"spiffe://acme.test/ns/prod/sa/billing"},
+		Emails:      []string{"billing@acme.test"},
+		SPIFFEID:    "spiffe://acme.test/ns/prod/sa/billing",
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, got)
+}
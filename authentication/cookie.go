@@ -0,0 +1,149 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostPrefix locks a cookie to the host that set it
+const hostPrefix = "__Host-"
+
+// maxCookieSize is the largest cookie value sent before splitting it across numbered cookies.
+// Browsers limit cookies to 4096 bytes including name and attributes
+const maxCookieSize = 3800
+
+// maxCookieChunks bounds how many chunks are written and read back from a request
+const maxCookieChunks = 10
+
+// CookieConfig session cookie attributes
+type CookieConfig struct {
+	Name     string
+	Domain   string
+	Path     string
+	SameSite http.SameSite
+	Secure   bool
+	// HostPrefix prepends __Host- to the cookie name so browsers lock it to the host
+	HostPrefix bool
+}
+
+// DefaultCookieConfig returns the default session cookie attributes
+func DefaultCookieConfig() CookieConfig {
+	return CookieConfig{
+		Name:     CookieName,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+	}
+}
+
+// Validate checks the cookie attributes are consistent
+func (c CookieConfig) Validate() error {
+	if c.HostPrefix && (c.Domain != "" || c.Path != "/" || !c.Secure) {
+		return errors.New("__Host- cookies must be secure, have no domain and use the / path")
+	}
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("SameSite=None cookies must be secure")
+	}
+	return nil
+}
+
+// name returns the full cookie name
+func (c CookieConfig) name() string {
+	if c.HostPrefix {
+		return hostPrefix + c.Name
+	}
+	return c.Name
+}
+
+func (c CookieConfig) chunkName(i int) string {
+	return c.name() + "_" + strconv.Itoa(i)
+}
+
+func (c CookieConfig) cookie(name, value string, exp time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  exp,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		SameSite: c.SameSite,
+		Secure:   c.Secure,
+		HttpOnly: true,
+	}
+}
+
+// readSessionCookie returns the session cookie value, reassembling it when it was split in chunks
+func (helios Helios) readSessionCookie(r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(helios.cookie.name()); err == nil {
+		return cookie.Value, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < maxCookieChunks; i++ {
+		chunk, err := r.Cookie(helios.cookie.chunkName(i))
+		if err != nil {
+			break
+		}
+		sb.WriteString(chunk.Value)
+	}
+
+	if sb.Len() == 0 {
+		return "", http.ErrNoCookie
+	}
+	return sb.String(), nil
+}
+
+// setSessionCookie sets the session cookie, splitting large values across numbered cookies.
+// Leftovers of a previous session cookie are cleared. Values needing more than maxCookieChunks are refused,
+// they could not be read back
+func (helios Helios) setSessionCookie(w http.ResponseWriter, r *http.Request, value string, exp time.Time) error {
+	if len(value) > maxCookieSize*maxCookieChunks {
+		return fmt.Errorf("session cookie of %d bytes exceeds the %d bytes limit, use a session store",
+			len(value), maxCookieSize*maxCookieChunks)
+	}
+
+	c := helios.cookie
+	chunks := 0
+
+	if len(value) <= maxCookieSize {
+		http.SetCookie(w, c.cookie(c.name(), value, exp))
+	} else {
+		for ; len(value) > 0; chunks++ {
+			size := maxCookieSize
+			if len(value) < size {
+				size = len(value)
+			}
+			http.SetCookie(w, c.cookie(c.chunkName(chunks), value[:size], exp))
+			value = value[size:]
+		}
+		if _, err := r.Cookie(c.name()); err == nil {
+			http.SetCookie(w, c.cookie(c.name(), "", time.Unix(0, 0)))
+		}
+	}
+
+	for i := chunks; i < maxCookieChunks; i++ {
+		if _, err := r.Cookie(c.chunkName(i)); err != nil {
+			break
+		}
+		http.SetCookie(w, c.cookie(c.chunkName(i), "", time.Unix(0, 0)))
+	}
+
+	return nil
+}
+
+// clearSessionCookie removes the session cookie and all its chunks
+func (helios Helios) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	c := helios.cookie
+	http.SetCookie(w, c.cookie(c.name(), "", time.Unix(0, 0)))
+
+	for i := 0; i < maxCookieChunks; i++ {
+		if _, err := r.Cookie(c.chunkName(i)); err != nil {
+			break
+		}
+		http.SetCookie(w, c.cookie(c.chunkName(i), "", time.Unix(0, 0)))
+	}
+}
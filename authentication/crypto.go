@@ -0,0 +1,85 @@
+package authentication
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Labels of the keys derived from the JWT secret, every use gets its own key
+const (
+	refreshTokenKeyLabel = "helios refresh token encryption"
+	cookieKeyLabel       = "helios session cookie encryption"
+)
+
+// errCiphertext is returned when an encrypted value cannot be decrypted
+var errCiphertext = errors.New("invalid ciphertext")
+
+// deriveKey derives a 256 bits key from the secret with HKDF-SHA256
+func deriveKey(secret, label string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(label)), key); err != nil {
+		// HKDF-SHA256 yields up to 8160 bytes
+		panic(err)
+	}
+	return key
+}
+
+// DefaultEncryptionKey derives the session cookie encryption key used when none is configured
+func DefaultEncryptionKey(secret string) EncryptionKey {
+	return EncryptionKey{ID: "default", Key: deriveKey(secret, cookieKeyLabel)}
+}
+
+func newGCM(secret string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(secret, refreshTokenKeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptString encrypts a refresh token with AES-256-GCM using a key derived from the secret
+func encryptString(secret, plaintext string) (string, error) {
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptString reverses encryptString
+func decryptString(secret, ciphertext string) (string, error) {
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errCiphertext
+	}
+
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errCiphertext
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,29 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveKey(t *testing.T) {
+	cookieKey := DefaultEncryptionKey("test").Key
+	refreshKey := deriveKey("test", refreshTokenKeyLabel)
+	sum := sha256.Sum256([]byte("test"))
+
+	assert.Len(t, cookieKey, 32)
+	assert.Equal(t, cookieKey, DefaultEncryptionKey("test").Key)
+	assert.NotEqual(t, cookieKey, refreshKey)
+	assert.NotEqual(t, sum[:], cookieKey)
+	assert.NotEqual(t, sum[:], refreshKey)
+	assert.NotEqual(t, cookieKey, DefaultEncryptionKey("other").Key)
+
+	rt, err := encryptString("test", "refresh-token")
+	assert.NoError(t, err)
+	plaintext, err := decryptString("test", rt)
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-token", plaintext)
+	_, err = decryptString("other", rt)
+	assert.Error(t, err)
+}
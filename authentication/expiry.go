@@ -0,0 +1,39 @@
+package authentication
+
+import (
+	"expvar"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons why a session ended. Session stores drop expired server-side sessions,
+// so ExpiryExpired is only recorded for cookie sessions
+const (
+	ExpiryExpired       = "expired"
+	ExpiryIdleTimeout   = "idle_timeout"
+	ExpiryMaxLifetime   = "max_lifetime"
+	ExpiryRenewalFailed = "renewal_failed"
+)
+
+// sessionExpirations counts ended sessions by reason
+var sessionExpirations = expvar.NewMap("helios_session_expirations")
+
+// sessionEnded records the end of a session
+func sessionEnded(user, reason string) {
+	log.Infof("Session of %q ended: %s", user, reason)
+	sessionExpirations.Add(reason, 1)
+}
+
+// expiryReason checks the idle timeout and absolute lifetime of a session.
+// It returns an empty string while the session is still valid
+func (helios Helios) expiryReason(authTime, lastSeen time.Time) string {
+	now := time.Now()
+	if helios.maxLifetime > 0 && now.After(authTime.Add(helios.maxLifetime)) {
+		return ExpiryMaxLifetime
+	}
+	if helios.idleTimeout > 0 && now.After(lastSeen.Add(helios.idleTimeout)) {
+		return ExpiryIdleTimeout
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package authentication
+
+import (
+	"context"
+
+	"github.com/cyakimov/helios/authentication/session"
+)
+
+type contextKey int
+
+const (
+	identityKey contextKey = iota
+	principalKey
+	sessionKey
+)
+
+// Identity represents the authenticated user behind a request
+type Identity struct {
+	Email       string
+	Groups      []string
+	AccessToken string
+	// Provider is the name of the identity provider the user logged in with
+	Provider string
+}
+
+// WithIdentity returns a copy of ctx carrying the given identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// IdentityFromContext returns the identity stored in ctx by the authentication middleware, if any
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// Principal represents the client behind a request authenticated with a bearer access token
+type Principal struct {
+	ClientID string
+	// Subject is the sub claim, often the client ID itself for client credentials tokens
+	Subject string
+	Scopes  []string
+}
+
+// WithPrincipal returns a copy of ctx carrying the given principal
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the principal stored in ctx by the bearer middleware, if any
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	return principal, ok
+}
+
+// withSession returns a copy of ctx carrying the server-side session a request was authenticated with
+func withSession(ctx context.Context, s *session.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, s)
+}
+
+// sessionFromContext returns the server-side session stored in ctx by the middleware, if any
+func sessionFromContext(ctx context.Context) (*session.Session, bool) {
+	s, ok := ctx.Value(sessionKey).(*session.Session)
+	return s, ok
+}
+
+// identityFromSession returns the identity of a server-side session
+func identityFromSession(s *session.Session) Identity {
+	return Identity{
+		Email:       s.User,
+		Groups:      s.Groups,
+		AccessToken: s.AccessToken,
+		Provider:    s.Provider,
+	}
+}
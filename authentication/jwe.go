@@ -0,0 +1,78 @@
+package authentication
+
+import (
+	"errors"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// ErrEncryptionKey is returned when an encrypted cookie uses an unknown key
+var ErrEncryptionKey = errors.New("unknown encryption key")
+
+// EncryptionKey is a 256 bits key used to encrypt session cookies
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// encryptToken wraps a signed token in a compact AES-GCM JWE using the first key
+func encryptToken(keys []EncryptionKey, token string) (string, error) {
+	opts := (&jose.EncrypterOptions{}).WithContentType("JWT")
+	enc, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{
+		Algorithm: jose.DIRECT,
+		Key:       keys[0].Key,
+		KeyID:     keys[0].ID,
+	}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	jwe, err := enc.Encrypt([]byte(token))
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+// decryptToken returns the signed token held by a compact JWE.
+// Every key can decrypt so keys can be rotated
+func decryptToken(keys []EncryptionKey, value string) (string, error) {
+	jwe, err := jose.ParseEncrypted(value)
+	if err != nil {
+		return "", err
+	}
+
+	for _, k := range keys {
+		if k.ID != jwe.Header.KeyID {
+			continue
+		}
+		token, err := jwe.Decrypt(k.Key)
+		if err != nil {
+			return "", err
+		}
+		return string(token), nil
+	}
+
+	return "", ErrEncryptionKey
+}
+
+// issueCookieToken issues the session cookie token, encrypting it when encryption keys are configured
+func (helios Helios) issueCookieToken(claims *Claims) (string, error) {
+	token, err := IssueJWTWithClaims(helios.jwtConfig.Secret, claims)
+	if err != nil || len(helios.jwtConfig.EncryptionKeys) == 0 {
+		return token, err
+	}
+	return encryptToken(helios.jwtConfig.EncryptionKeys, token)
+}
+
+// parseCookieToken parses a session cookie token issued by issueCookieToken
+func (helios Helios) parseCookieToken(value string) (*Claims, error) {
+	if len(helios.jwtConfig.EncryptionKeys) > 0 {
+		token, err := decryptToken(helios.jwtConfig.EncryptionKeys, value)
+		if err != nil {
+			return nil, err
+		}
+		value = token
+	}
+	return ParseJWTWithSecret(helios.jwtConfig.Secret, value)
+}
@@ -0,0 +1,301 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/grpcutil"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultProviderName names the provider given to NewHeliosAuthenticationWithConfig
+const DefaultProviderName = "default"
+
+// Provider is a named identity provider users can log in with
+type Provider struct {
+	providers.OAuth2Provider
+	Name string
+	// Title is shown on the login chooser page, defaults to Name
+	Title string
+	// Backchannel verifies logout tokens sent by the identity provider
+	Backchannel BackchannelConfig
+	// Private providers are only accepted by middlewares restricted to them with ForProviders,
+	// so sessions minted for one client are not accepted by routes bound to another
+	Private bool
+}
+
+func (p Provider) title() string {
+	if p.Title == "" {
+		return p.Name
+	}
+	return p.Title
+}
+
+// LoginPageConfig brands the page users choose an identity provider on
+type LoginPageConfig struct {
+	Title   string
+	LogoURL string
+}
+
+var chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{ .Title }}</title></head>
+<body>
+{{ if .LogoURL }}<img src="{{ .LogoURL }}" alt="{{ .Title }}">{{ end }}
+<h1>{{ .Title }}</h1>
+<ul>
+{{ range .Providers }}<li><a href="{{ .URL }}">Sign in with {{ .Title }}</a></li>
+{{ end }}</ul>
+</body>
+</html>
+`))
+
+// UnauthenticatedAction is the response to requests without valid credentials
+type UnauthenticatedAction string
+
+// Responses to unauthenticated requests
+const (
+	// UnauthenticatedNegotiate redirects browser navigations to log in and answers other requests like
+	// Unauthenticated401
+	UnauthenticatedNegotiate UnauthenticatedAction = ""
+	// UnauthenticatedRedirect always redirects to log in
+	UnauthenticatedRedirect UnauthenticatedAction = "redirect"
+	// Unauthenticated401 answers with a JSON body holding the login URL
+	Unauthenticated401 UnauthenticatedAction = "401"
+	// Unauthenticated403 is Unauthenticated401 with the 403 status code
+	Unauthenticated403 UnauthenticatedAction = "403"
+)
+
+// ParseUnauthenticatedAction parses redirect, 401 or 403. An empty action negotiates the response
+func ParseUnauthenticatedAction(action string) (UnauthenticatedAction, error) {
+	switch a := UnauthenticatedAction(action); a {
+	case UnauthenticatedNegotiate, UnauthenticatedRedirect, Unauthenticated401, Unauthenticated403:
+		return a, nil
+	}
+	return "", errors.New("unauthenticated action must be redirect, 401 or 403")
+}
+
+// OnUnauthenticated returns a copy of the middleware answering requests without valid credentials with action
+func (helios Helios) OnUnauthenticated(action UnauthenticatedAction) Helios {
+	helios.onUnauthenticated = action
+	return helios
+}
+
+// ForProviders returns a copy of the middleware that only accepts the named providers. All providers are accepted when
+// names is empty
+func (helios Helios) ForProviders(names ...string) Helios {
+	helios.allowed = names
+	return helios
+}
+
+// provider returns the provider with the given name, sessions without provider belong to the first one
+func (helios Helios) provider(name string) (Provider, bool) {
+	if name == "" && len(helios.providers) > 0 {
+		return helios.providers[0], true
+	}
+	for _, p := range helios.providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Provider{}, false
+}
+
+// allows checks if sessions of the given provider are accepted
+func (helios Helios) allows(name string) bool {
+	// routes opt in to service accounts by listing them with their providers
+	if name == ServiceAccountProvider {
+		return helios.serviceAccounts != nil && contains(helios.allowed, ServiceAccountProvider)
+	}
+	p, ok := helios.provider(name)
+	if !ok {
+		return false
+	}
+	if len(helios.allowed) == 0 {
+		return !p.Private
+	}
+	for _, allowed := range helios.allowed {
+		if allowed == p.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedProviders lists the providers users can log in with
+func (helios Helios) allowedProviders() []Provider {
+	allowed := make([]Provider, 0, len(helios.providers))
+	for _, p := range helios.providers {
+		if helios.allows(p.Name) {
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed
+}
+
+// encodeState records the provider users log in with along the URL they are sent back to
+func encodeState(provider, rd string) string {
+	return provider + "\n" + rd
+}
+
+// decodeState returns the provider and the redirect URL of a login state
+func decodeState(state string) (provider, rd string) {
+	i := strings.Index(state, "\n")
+	if i < 0 {
+		return "", state
+	}
+	return state[:i], state[i+1:]
+}
+
+// loginURL returns the URL logging users in with a provider and sending them back to rd.
+// SAML logins start on Helios, which binds them to the browser before sending users to the identity provider
+func (p Provider) loginURL(r *http.Request, rd string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if _, ok := p.OAuth2Provider.(providers.MetadataProvider); ok {
+		return scheme + "://" + r.Host + SAMLLoginPath + "?" + url.Values{"idp": {p.Name}, "rd": {rd}}.Encode()
+	}
+
+	return p.GetLoginURL(scheme+"://"+r.Host+"/.well-known/callback", encodeState(p.Name, rd))
+}
+
+// isNavigation tells if a request is a browser navigation, which can be redirected to log in. XHR calls, scripts and
+// form posts cannot follow the login flow
+func isNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json")
+}
+
+// unauthenticated answers a request without valid credentials
+func (helios Helios) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	// gRPC clients cannot follow redirects
+	if grpcutil.IsGRPCRequest(r) {
+		grpcutil.WriteError(w, codes.Unauthenticated, ErrUnauthorized.Error())
+		return
+	}
+
+	switch helios.onUnauthenticated {
+	case Unauthenticated401:
+		helios.unauthorized(w, r, http.StatusUnauthorized)
+		return
+	case Unauthenticated403:
+		helios.unauthorized(w, r, http.StatusForbidden)
+		return
+	case UnauthenticatedNegotiate:
+		if !isNavigation(r) {
+			helios.unauthorized(w, r, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if helios.sso.AuthDomain != "" && r.Host != helios.sso.AuthDomain {
+		// log in through the auth domain, which hands the session back to this host
+		url := helios.ssoLoginURL(r)
+		log.Debugf("Redirecting to %s", url)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		return
+	}
+
+	helios.login(w, r, r.RequestURI)
+}
+
+// ssoLoginURL returns the auth domain URL logging users in and sending them back to the request URL
+func (helios Helios) ssoLoginURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return helios.ssoAuthorizeURL(scheme, scheme+"://"+r.Host+r.URL.RequestURI())
+}
+
+// loginLocation returns the URL users log in at before retrying a request
+func (helios Helios) loginLocation(r *http.Request) string {
+	if helios.sso.AuthDomain != "" && r.Host != helios.sso.AuthDomain {
+		return helios.ssoLoginURL(r)
+	}
+	allowed := helios.allowedProviders()
+	if len(allowed) == 1 {
+		return allowed[0].loginURL(r, r.RequestURI)
+	}
+
+	// browsers choose a provider on the page itself
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// unauthorized answers clients that cannot follow the login flow with a JSON body holding the login URL
+func (helios Helios) unauthorized(w http.ResponseWriter, r *http.Request, status int) {
+	if status == http.StatusUnauthorized {
+		challenge := `Helios realm="helios"`
+		if helios.allows(ServiceAccountProvider) {
+			challenge = fmt.Sprintf(`APIKey realm="helios", header=%q`, helios.serviceAccounts.Header())
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	body := struct {
+		Error    string `json:"error"`
+		LoginURL string `json:"login_url"`
+	}{"unauthenticated", helios.loginLocation(r)}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error(err)
+	}
+}
+
+// login sends users to the identity provider, or lets them choose one when several apply
+func (helios Helios) login(w http.ResponseWriter, r *http.Request, rd string) {
+	allowed := helios.allowedProviders()
+	if len(allowed) == 1 {
+		url := allowed[0].loginURL(r, rd)
+		log.Debugf("Redirecting to %s", url)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		return
+	}
+
+	type choice struct {
+		Title string
+		URL   string
+	}
+	data := struct {
+		Title     string
+		LogoURL   string
+		Providers []choice
+	}{
+		Title:   helios.loginPage.Title,
+		LogoURL: helios.loginPage.LogoURL,
+	}
+	if data.Title == "" {
+		data.Title = "Sign in"
+	}
+	for _, p := range allowed {
+		data.Providers = append(data.Providers, choice{Title: p.title(), URL: p.loginURL(r, rd)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := chooserTemplate.Execute(w, data); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,71 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// linkNext finds the next page in a Link header
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+// GetJSON fetches an API resource on behalf of a user and decodes it into v.
+// It returns the URL of the next page when the resource is paginated
+func GetJSON(url, accessToken string, v interface{}) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return "", err
+	}
+
+	if m := linkNext.FindStringSubmatch(res.Header.Get("Link")); m != nil {
+		return m[1], nil
+	}
+	return "", nil
+}
+
+// PostJSON calls an API action on behalf of a user with a JSON body and decodes the response into v
+func PostJSON(url, accessToken string, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
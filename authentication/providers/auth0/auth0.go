@@ -4,10 +4,10 @@ import (
 	"context"
 	"encoding/base64"
 	"github.com/cyakimov/helios/authentication/providers"
-	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"net/http"
+	"net/url"
 )
 
 // Auth0Provider represents an Auth0 instance
@@ -15,16 +15,23 @@ type Provider struct {
 	providers.OAuth2Provider
 	oauth2     oauth2.Config
 	profileURL string
+	logoutURL  string
 }
 
 // NewAuth0Provider creates a new Auth0 identity provider with a given config
 func NewAuth0Provider(config providers.OAuth2Config) providers.OAuth2Provider {
+	logoutURL := config.LogoutURL
+	if u, err := url.Parse(config.AuthURL); logoutURL == "" && err == nil {
+		logoutURL = u.Scheme + "://" + u.Host + "/v2/logout"
+	}
+
 	return Provider{
 		profileURL: config.ProfileURL,
+		logoutURL:  logoutURL,
 		oauth2: oauth2.Config{
 			ClientID:     config.ClientID,
 			ClientSecret: config.ClientSecret,
-			Scopes:       []string{"openid", "email_verified", "email"},
+			Scopes:       config.ScopesOrDefault("openid", "email_verified", "email", "offline_access"),
 			Endpoint: oauth2.Endpoint{
 				AuthURL:  config.AuthURL,
 				TokenURL: config.TokenURL,
@@ -52,24 +59,18 @@ func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error)
 		return userInfo, providers.ErrCodeExchange
 	}
 
-	// Parse the token
-	jwtToken, _ := jwt.ParseWithClaims(token.Extra("id_token").(string), &providers.OIDClaims{}, nil)
-	if jwtToken == nil {
-		return userInfo, providers.ErrJWTParse
-	}
-
-	claims, ok := jwtToken.Claims.(*providers.OIDClaims)
-	if !ok {
-		return userInfo, providers.ErrJWTClaims
-	}
+	return providers.UserInfoFromToken(token)
+}
 
-	if claims.Email == "" {
-		return userInfo, providers.ErrNoEmail
+// Refresh re-validates a user with Auth0 using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
 	}
 
-	userInfo.Email = claims.Email
-
-	return userInfo, nil
+	return providers.UserInfoFromToken(token)
 }
 
 // GetLoginURL returns OAuth 2 login endpoint used to redirect users
@@ -81,3 +82,13 @@ func (provider Provider) GetLoginURL(callbackURL string, state string) string {
 
 	return provider.oauth2.AuthCodeURL(s, callback)
 }
+
+// GetLogoutURL returns the Auth0 logout endpoint. returnURL must be an allowed logout URL of the application
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	params := url.Values{
+		"client_id": {provider.oauth2.ClientID},
+		"returnTo":  {returnURL},
+	}
+
+	return provider.logoutURL + "?" + params.Encode()
+}
@@ -5,22 +5,46 @@ import (
 	"encoding/base64"
 	"github.com/cyakimov/helios/authentication/providers"
 	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"net/http"
+	"strings"
 )
 
 type Provider struct {
 	providers.OAuth2Provider
 	oauth2 oauth2.Config
+	graph  graph
+}
+
+// idTokenClaims are the Azure AD id_token claims groups are read from
+type idTokenClaims struct {
+	jwt.StandardClaims
+	TenantID string   `json:"tid"`
+	ObjectID string   `json:"oid"`
+	Groups   []string `json:"groups"`
+	// ClaimNames lists the claims left out of the token. It holds groups when the user is a member of too many groups
+	ClaimNames map[string]string `json:"_claim_names"`
 }
 
 const (
-	authEndpoint  = "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"
-	tokenEndpoint = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	authEndpoint   = "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"
+	tokenEndpoint  = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	logoutEndpoint = "https://login.microsoftonline.com/common/oauth2/v2.0/logout"
 )
 
 func NewAzureADProvider(config providers.OAuth2Config) providers.OAuth2Provider {
+	graphURL := strings.TrimSuffix(config.APIURL, "/")
+	if graphURL == "" {
+		graphURL = graphEndpoint
+	}
+
 	return &Provider{
+		graph: graph{
+			url:   graphURL,
+			names: config.GroupNames,
+			cache: newGroupCache(config.GroupCacheTTL),
+		},
 		oauth2: oauth2.Config{
 			ClientID:     config.ClientID,
 			ClientSecret: config.ClientSecret,
@@ -28,7 +52,7 @@ func NewAzureADProvider(config providers.OAuth2Config) providers.OAuth2Provider
 				AuthURL:  authEndpoint,
 				TokenURL: tokenEndpoint,
 			},
-			Scopes: []string{"openid", "email"},
+			Scopes: config.ScopesOrDefault("openid", "email", "offline_access"),
 		},
 	}
 }
@@ -50,26 +74,76 @@ func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error)
 		return userInfo, providers.ErrCodeExchange
 	}
 
-	// Parse the token
-	jwtToken, _ := jwt.ParseWithClaims(token.Extra("id_token").(string), &providers.OIDClaims{}, nil)
-	if jwtToken == nil {
-		return userInfo, providers.ErrJWTParse
+	return provider.userInfo(token)
+}
+
+// Refresh re-validates a user with Azure AD using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
 	}
 
-	claims, ok := jwtToken.Claims.(*providers.OIDClaims)
-	if !ok {
-		return userInfo, providers.ErrJWTClaims
+	return provider.userInfo(token)
+}
+
+// userInfo builds the user info out of the id_token, groups included
+func (provider Provider) userInfo(token *oauth2.Token) (providers.UserInfo, error) {
+	userInfo, err := providers.UserInfoFromToken(token)
+	if err != nil {
+		return userInfo, err
 	}
 
-	if claims.Email == "" {
-		return userInfo, providers.ErrNoEmail
+	var claims idTokenClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(userInfo.IDToken, &claims); err != nil {
+		return userInfo, providers.ErrJWTParse
 	}
 
-	userInfo.Email = claims.Email
+	groups, err := provider.groups(claims, token.AccessToken)
+	if err != nil {
+		log.Error(err)
+		return userInfo, providers.ErrProfile
+	}
+	userInfo.Groups = groups
 
 	return userInfo, nil
 }
 
+// groups returns the groups claim. Azure AD leaves groups out of the token when the user is a member of too many of
+// them, they are then resolved through Microsoft Graph and cached per user
+func (provider Provider) groups(claims idTokenClaims, accessToken string) ([]string, error) {
+	_, overage := claims.ClaimNames["groups"]
+	if !overage && (!provider.graph.names || len(claims.Groups) == 0) {
+		return claims.Groups, nil
+	}
+
+	user := claims.TenantID + "/" + claims.ObjectID
+	if claims.ObjectID == "" {
+		user = claims.TenantID + "/" + claims.Subject
+	}
+	if groups, ok := provider.graph.cache.get(user); ok {
+		return groups, nil
+	}
+
+	groups := claims.Groups
+	if overage {
+		var err error
+		if groups, err = provider.graph.memberGroups(accessToken); err != nil {
+			return nil, err
+		}
+	}
+	if provider.graph.names {
+		var err error
+		if groups, err = provider.graph.groupNames(accessToken, groups); err != nil {
+			return nil, err
+		}
+	}
+
+	provider.graph.cache.put(user, groups)
+	return groups, nil
+}
+
 // GetLoginURL returns OAuth 2 login endpoint used to redirect users
 func (provider Provider) GetLoginURL(callbackURL string, state string) string {
 	// @todo encrypt state
@@ -79,3 +153,8 @@ func (provider Provider) GetLoginURL(callbackURL string, state string) string {
 
 	return provider.oauth2.AuthCodeURL(s, callback)
 }
+
+// GetLogoutURL returns the Azure AD logout endpoint
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return providers.EndSessionURL(logoutEndpoint, provider.oauth2.ClientID, returnURL, idToken)
+}
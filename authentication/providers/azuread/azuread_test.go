@@ -0,0 +1,118 @@
+package azuread
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type fakeGraph struct {
+	*httptest.Server
+	calls int
+}
+
+func newGraph(t *testing.T) *fakeGraph {
+	g := &fakeGraph{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.0/me/getMemberObjects", func(w http.ResponseWriter, r *http.Request) {
+		g.calls++
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(memberObjects{Value: []string{"g1", "g2", "role"}})
+	})
+	mux.HandleFunc("/v1.0/directoryObjects/getByIds", func(w http.ResponseWriter, r *http.Request) {
+		g.calls++
+		var body struct {
+			IDs   []string `json:"ids"`
+			Types []string `json:"types"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, []string{"group"}, body.Types)
+
+		names := map[string]string{"g1": "engineering", "g2": "platform", "g3": "finance"}
+		var objects directoryObjects
+		for _, id := range body.IDs {
+			if name, ok := names[id]; ok {
+				objects.Value = append(objects.Value, struct {
+					ID          string `json:"id"`
+					DisplayName string `json:"displayName"`
+				}{id, name})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(objects)
+	})
+	g.Server = httptest.NewServer(mux)
+	return g
+}
+
+func newToken(t *testing.T, oid string, groups []string, overage bool) *oauth2.Token {
+	claims := jwt.MapClaims{"email": oid + "@acme.test", "sub": oid, "oid": oid, "tid": "tenant"}
+	if groups != nil {
+		claims["groups"] = groups
+	}
+	if overage {
+		claims["_claim_names"] = map[string]string{"groups": "src1"}
+	}
+	idToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	return (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{"id_token": idToken})
+}
+
+func TestProvider_Groups(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Groups  []string
+		Overage bool
+		Names   bool
+		Want    []string
+		Calls   int
+	}{
+		{"claim", []string{"g1"}, false, false, []string{"g1"}, 0},
+		{"overage", nil, true, false, []string{"g1", "g2", "role"}, 1},
+		{"claim names", []string{"g3", "g4"}, false, true, []string{"finance", "g4"}, 1},
+		{"overage names", nil, true, true, []string{"engineering", "platform", "role"}, 2},
+	}
+
+	for _, test := range tests {
+		graph := newGraph(t)
+		provider := NewAzureADProvider(providers.OAuth2Config{
+			ClientID:   "id",
+			APIURL:     graph.URL,
+			GroupNames: test.Names,
+		}).(*Provider)
+
+		// the second login is served from the cache
+		for i := 0; i < 2; i++ {
+			info, err := provider.userInfo(newToken(t, "user", test.Groups, test.Overage))
+			assert.NoError(t, err, test.Name)
+			assert.Equal(t, "user@acme.test", info.Email, test.Name)
+			assert.Equal(t, test.Want, info.Groups, test.Name)
+		}
+		assert.Equal(t, test.Calls, graph.calls, test.Name)
+		graph.Close()
+	}
+}
+
+func TestProvider_GroupsGraphError(t *testing.T) {
+	graph := newGraph(t)
+	defer graph.Close()
+	provider := NewAzureADProvider(providers.OAuth2Config{ClientID: "id", APIURL: graph.URL}).(*Provider)
+
+	token := newToken(t, "user", nil, true)
+	token.AccessToken = "revoked"
+	_, err := provider.userInfo(token)
+	assert.Equal(t, providers.ErrProfile, err)
+
+	// failures are not cached
+	_, err = provider.userInfo(newToken(t, "user", nil, true))
+	assert.NoError(t, err)
+}
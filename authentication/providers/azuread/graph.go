@@ -0,0 +1,118 @@
+package azuread
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+)
+
+const (
+	graphEndpoint = "https://graph.microsoft.com"
+	// getByIdsLimit is the maximum number of IDs resolved by a single getByIds call
+	getByIdsLimit = 1000
+	// defaultGroupCacheTTL is how long groups resolved through Microsoft Graph are cached by default
+	defaultGroupCacheTTL = 10 * time.Minute
+)
+
+type memberObjects struct {
+	Value []string `json:"value"`
+}
+
+type directoryObjects struct {
+	Value []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
+	} `json:"value"`
+}
+
+// graph resolves group memberships through Microsoft Graph
+type graph struct {
+	url   string
+	names bool
+	cache *groupCache
+}
+
+// memberGroups returns the object IDs of every group, directory role and administrative unit the signed in user
+// is a member of, transitively
+func (g graph) memberGroups(accessToken string) ([]string, error) {
+	var objects memberObjects
+	body := map[string]bool{"securityEnabledOnly": false}
+	if err := providers.PostJSON(g.url+"/v1.0/me/getMemberObjects", accessToken, body, &objects); err != nil {
+		return nil, err
+	}
+	return objects.Value, nil
+}
+
+// groupNames maps group object IDs to their display names. Objects that are not groups keep their ID
+func (g graph) groupNames(accessToken string, ids []string) ([]string, error) {
+	names := make(map[string]string, len(ids))
+	for start := 0; start < len(ids); start += getByIdsLimit {
+		end := start + getByIdsLimit
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var objects directoryObjects
+		body := map[string][]string{"ids": ids[start:end], "types": {"group"}}
+		if err := providers.PostJSON(g.url+"/v1.0/directoryObjects/getByIds", accessToken, body, &objects); err != nil {
+			return nil, err
+		}
+		for _, o := range objects.Value {
+			names[o.ID] = o.DisplayName
+		}
+	}
+
+	groups := make([]string, len(ids))
+	for i, id := range ids {
+		groups[i] = id
+		if name := names[id]; name != "" {
+			groups[i] = name
+		}
+	}
+	return groups, nil
+}
+
+// groupCache keeps the groups resolved through Microsoft Graph per user
+type groupCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups    []string
+	expiresAt time.Time
+}
+
+func newGroupCache(ttl time.Duration) *groupCache {
+	if ttl == 0 {
+		ttl = defaultGroupCacheTTL
+	}
+	return &groupCache{ttl: ttl, entries: make(map[string]groupCacheEntry)}
+}
+
+func (c *groupCache) get(user string) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[user]
+	if !ok || !entry.expiresAt.After(time.Now()) {
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+func (c *groupCache) put(user string, groups []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	// drop expired entries so users that stopped logging in do not pile up
+	for key, entry := range c.entries {
+		if !entry.expiresAt.After(now) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[user] = groupCacheEntry{groups: groups, expiresAt: now.Add(c.ttl)}
+}
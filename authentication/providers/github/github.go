@@ -0,0 +1,183 @@
+package github
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Provider represents GitHub or a GitHub Enterprise instance
+type Provider struct {
+	providers.OAuth2Provider
+	oauth2 oauth2.Config
+	apiURL string
+}
+
+const (
+	authEndpoint  = "https://github.com/login/oauth/authorize"
+	tokenEndpoint = "https://github.com/login/oauth/access_token"
+	apiEndpoint   = "https://api.github.com"
+)
+
+type email struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+type org struct {
+	Login string `json:"login"`
+}
+
+type team struct {
+	Slug         string `json:"slug"`
+	Organization org    `json:"organization"`
+}
+
+// NewGitHubProvider creates a new GitHub identity provider with a given config.
+// GitHub Enterprise is used when APIURL is set, its OAuth endpoints default to the same host
+func NewGitHubProvider(config providers.OAuth2Config) providers.OAuth2Provider {
+	apiURL := strings.TrimSuffix(config.APIURL, "/")
+	authURL, tokenURL := authEndpoint, tokenEndpoint
+	if apiURL == "" {
+		apiURL = apiEndpoint
+	} else {
+		base := strings.TrimSuffix(apiURL, "/api/v3")
+		authURL, tokenURL = base+"/login/oauth/authorize", base+"/login/oauth/access_token"
+	}
+	if config.AuthURL != "" {
+		authURL = config.AuthURL
+	}
+	if config.TokenURL != "" {
+		tokenURL = config.TokenURL
+	}
+
+	return &Provider{
+		apiURL: apiURL,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  authURL,
+				TokenURL: tokenURL,
+			},
+			Scopes: config.ScopesOrDefault("read:user", "user:email", "read:org"),
+		},
+	}
+}
+
+// FetchUser fetches user info from GitHub
+func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error) {
+	code := r.URL.Query().Get("code")
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := scheme + "://" + r.Host + r.URL.Path
+	callback := oauth2.SetAuthURLParam("redirect_uri", url)
+
+	// get access token
+	token, err := provider.oauth2.Exchange(context.TODO(), code, callback)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrCodeExchange
+	}
+
+	return provider.userInfo(token)
+}
+
+// Refresh re-validates a user with GitHub using a refresh token, only issued to GitHub Apps with expiring tokens
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
+	}
+
+	return provider.userInfo(token)
+}
+
+// userInfo fetches the primary verified email of the user, its organizations and teams.
+// Groups are organization logins and org/team slugs
+func (provider Provider) userInfo(token *oauth2.Token) (providers.UserInfo, error) {
+	userInfo := providers.UserInfo{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+	}
+
+	var emails []email
+	err := provider.list("/user/emails", token, &emails, func() {
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				userInfo.Email = e.Email
+			}
+		}
+	})
+	if err != nil {
+		log.Error(err)
+		return userInfo, providers.ErrProfile
+	}
+	if userInfo.Email == "" {
+		return userInfo, providers.ErrNoEmail
+	}
+
+	userInfo.Groups = []string{}
+	var orgs []org
+	err = provider.list("/user/orgs", token, &orgs, func() {
+		for _, o := range orgs {
+			userInfo.Groups = append(userInfo.Groups, o.Login)
+		}
+	})
+	if err != nil {
+		log.Error(err)
+		return userInfo, providers.ErrProfile
+	}
+
+	var teams []team
+	err = provider.list("/user/teams", token, &teams, func() {
+		for _, t := range teams {
+			userInfo.Groups = append(userInfo.Groups, t.Organization.Login+"/"+t.Slug)
+		}
+	})
+	if err != nil {
+		log.Error(err)
+		return userInfo, providers.ErrProfile
+	}
+
+	return userInfo, nil
+}
+
+// list walks every page of an API resource, calling page after each one is decoded into v
+func (provider Provider) list(path string, token *oauth2.Token, v interface{}, page func()) error {
+	url := provider.apiURL + path + "?per_page=100"
+	for url != "" {
+		next, err := providers.GetJSON(url, token.AccessToken, v)
+		if err != nil {
+			return err
+		}
+		page()
+		url = next
+	}
+	return nil
+}
+
+// GetLoginURL returns OAuth 2 login endpoint used to redirect users
+func (provider Provider) GetLoginURL(callbackURL string, state string) string {
+	// @todo encrypt state
+	s := base64.StdEncoding.EncodeToString([]byte(state))
+
+	callback := oauth2.SetAuthURLParam("redirect_uri", callbackURL)
+
+	return provider.oauth2.AuthCodeURL(s, callback)
+}
+
+// GetLogoutURL returns an empty string, GitHub does not let applications end user sessions
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return ""
+}
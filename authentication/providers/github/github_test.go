@@ -0,0 +1,87 @@
+package github
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGitHub(t *testing.T, emails []email) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "code", r.Form.Get("code"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"gho_token","token_type":"bearer"}`))
+	})
+	api := func(path string, h func(w http.ResponseWriter, r *http.Request) interface{}) {
+		mux.HandleFunc("/api/v3"+path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer gho_token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(h(w, r))
+		})
+	}
+
+	api("/user/emails", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return emails
+	})
+	api("/user/orgs", func(w http.ResponseWriter, r *http.Request) interface{} {
+		// organizations span two pages
+		if r.URL.Query().Get("page") == "2" {
+			return []org{{Login: "acme-labs"}}
+		}
+		w.Header().Set("Link", `<http://`+r.Host+`/api/v3/user/orgs?per_page=100&page=2>; rel="next", <http://`+r.Host+`/api/v3/user/orgs?per_page=100&page=2>; rel="last"`)
+		return []org{{Login: "acme"}}
+	})
+	api("/user/teams", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return []team{{Slug: "platform", Organization: org{Login: "acme"}}}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestProvider_FetchUser(t *testing.T) {
+	tests := []struct {
+		Emails []email
+		Email  string
+		Err    error
+	}{
+		{[]email{{"old@acme.test", false, true}, {"dev@acme.test", true, true}}, "dev@acme.test", nil},
+		{[]email{{"dev@acme.test", true, false}}, "", providers.ErrNoEmail},
+	}
+
+	for _, test := range tests {
+		server := newGitHub(t, test.Emails)
+		provider := NewGitHubProvider(providers.OAuth2Config{
+			ClientID:     "id",
+			ClientSecret: "secret",
+			APIURL:       server.URL + "/api/v3",
+		})
+
+		req := httptest.NewRequest("GET", "http://helios/.well-known/callback?code=code", nil)
+		info, err := provider.FetchUser(req)
+		server.Close()
+
+		assert.Equal(t, test.Err, err)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, test.Email, info.Email)
+		assert.Equal(t, []string{"acme", "acme-labs", "acme/platform"}, info.Groups)
+		assert.Equal(t, "gho_token", info.AccessToken)
+	}
+}
+
+func TestProvider_GetLoginURL(t *testing.T) {
+	provider := NewGitHubProvider(providers.OAuth2Config{ClientID: "id", APIURL: "https://ghe.acme.test/api/v3"})
+	url := provider.GetLoginURL("https://helios/.well-known/callback", "/")
+
+	assert.Contains(t, url, "https://ghe.acme.test/login/oauth/authorize?")
+	assert.Contains(t, url, "scope=read%3Auser+user%3Aemail+read%3Aorg")
+}
@@ -0,0 +1,150 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Provider represents GitLab.com or a self-hosted GitLab instance
+type Provider struct {
+	providers.OAuth2Provider
+	oauth2 oauth2.Config
+	apiURL string
+}
+
+const baseURL = "https://gitlab.com"
+
+type user struct {
+	Email       string `json:"email"`
+	State       string `json:"state"`
+	ConfirmedAt string `json:"confirmed_at"`
+}
+
+type group struct {
+	FullPath string `json:"full_path"`
+}
+
+// NewGitLabProvider creates a new GitLab identity provider with a given config.
+// A self-hosted instance is used when APIURL is set, its OAuth endpoints default to the same host
+func NewGitLabProvider(config providers.OAuth2Config) providers.OAuth2Provider {
+	base := baseURL
+	apiURL := strings.TrimSuffix(config.APIURL, "/")
+	if apiURL == "" {
+		apiURL = base + "/api/v4"
+	} else {
+		base = strings.TrimSuffix(apiURL, "/api/v4")
+	}
+
+	authURL, tokenURL := base+"/oauth/authorize", base+"/oauth/token"
+	if config.AuthURL != "" {
+		authURL = config.AuthURL
+	}
+	if config.TokenURL != "" {
+		tokenURL = config.TokenURL
+	}
+
+	return &Provider{
+		apiURL: apiURL,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  authURL,
+				TokenURL: tokenURL,
+			},
+			Scopes: config.ScopesOrDefault("read_user", "read_api"),
+		},
+	}
+}
+
+// FetchUser fetches user info from GitLab
+func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error) {
+	code := r.URL.Query().Get("code")
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := scheme + "://" + r.Host + r.URL.Path
+	callback := oauth2.SetAuthURLParam("redirect_uri", url)
+
+	// get access token
+	token, err := provider.oauth2.Exchange(context.TODO(), code, callback)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrCodeExchange
+	}
+
+	return provider.userInfo(token)
+}
+
+// Refresh re-validates a user with GitLab using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
+	}
+
+	return provider.userInfo(token)
+}
+
+// userInfo fetches the confirmed primary email of the user and the full path of its groups
+func (provider Provider) userInfo(token *oauth2.Token) (providers.UserInfo, error) {
+	userInfo := providers.UserInfo{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+	}
+
+	var u user
+	if _, err := providers.GetJSON(provider.apiURL+"/user", token.AccessToken, &u); err != nil {
+		log.Error(err)
+		return userInfo, providers.ErrProfile
+	}
+	// blocked users keep valid tokens
+	if u.State != "active" {
+		return userInfo, providers.ErrProfile
+	}
+	if u.Email == "" || u.ConfirmedAt == "" {
+		return userInfo, providers.ErrNoEmail
+	}
+	userInfo.Email = u.Email
+
+	userInfo.Groups = []string{}
+	url := provider.apiURL + "/groups?min_access_level=10&per_page=100"
+	for url != "" {
+		var groups []group
+		next, err := providers.GetJSON(url, token.AccessToken, &groups)
+		if err != nil {
+			log.Error(err)
+			return userInfo, providers.ErrProfile
+		}
+		for _, g := range groups {
+			userInfo.Groups = append(userInfo.Groups, g.FullPath)
+		}
+		url = next
+	}
+
+	return userInfo, nil
+}
+
+// GetLoginURL returns OAuth 2 login endpoint used to redirect users
+func (provider Provider) GetLoginURL(callbackURL string, state string) string {
+	// @todo encrypt state
+	s := base64.StdEncoding.EncodeToString([]byte(state))
+
+	callback := oauth2.SetAuthURLParam("redirect_uri", callbackURL)
+
+	return provider.oauth2.AuthCodeURL(s, callback)
+}
+
+// GetLogoutURL returns an empty string, GitLab does not let applications end user sessions
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return ""
+}
@@ -0,0 +1,74 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGitLab(t *testing.T, u user) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("grant_type") == "refresh_token" {
+			assert.Equal(t, "refresh", r.Form.Get("refresh_token"))
+		} else {
+			assert.Equal(t, "code", r.Form.Get("code"))
+		}
+		_, _ = w.Write([]byte(`{"access_token":"glpat","token_type":"bearer","refresh_token":"refresh","expires_in":7200}`))
+	})
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer glpat", r.Header.Get("Authorization"))
+		_ = json.NewEncoder(w).Encode(u)
+	})
+	mux.HandleFunc("/api/v4/groups", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "10", r.URL.Query().Get("min_access_level"))
+		if r.URL.Query().Get("page") == "2" {
+			_ = json.NewEncoder(w).Encode([]group{{FullPath: "acme/platform"}})
+			return
+		}
+		w.Header().Set("Link", `<http://`+r.Host+`/api/v4/groups?min_access_level=10&per_page=100&page=2>; rel="next"`)
+		_ = json.NewEncoder(w).Encode([]group{{FullPath: "acme"}})
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestProvider_FetchUser(t *testing.T) {
+	tests := []struct {
+		User user
+		Err  error
+	}{
+		{user{Email: "dev@acme.test", State: "active", ConfirmedAt: "2019-10-01T10:00:00Z"}, nil},
+		{user{Email: "dev@acme.test", State: "active"}, providers.ErrNoEmail},
+		{user{Email: "dev@acme.test", State: "blocked", ConfirmedAt: "2019-10-01T10:00:00Z"}, providers.ErrProfile},
+	}
+
+	for _, test := range tests {
+		server := newGitLab(t, test.User)
+		provider := NewGitLabProvider(providers.OAuth2Config{
+			ClientID:     "id",
+			ClientSecret: "secret",
+			APIURL:       server.URL + "/api/v4",
+		})
+
+		req := httptest.NewRequest("GET", "http://helios/.well-known/callback?code=code", nil)
+		info, err := provider.FetchUser(req)
+		assert.Equal(t, test.Err, err)
+		if err == nil {
+			assert.Equal(t, "dev@acme.test", info.Email)
+			assert.Equal(t, []string{"acme", "acme/platform"}, info.Groups)
+			assert.Equal(t, "refresh", info.RefreshToken)
+
+			info, err = provider.Refresh("refresh")
+			assert.NoError(t, err)
+			assert.Equal(t, "dev@acme.test", info.Email)
+		}
+		server.Close()
+	}
+}
@@ -4,14 +4,15 @@ import (
 	"context"
 	"encoding/base64"
 	"github.com/cyakimov/helios/authentication/providers"
-	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"net/http"
 )
 
 type Provider struct {
 	providers.OAuth2Provider
-	oauth2 oauth2.Config
+	oauth2    oauth2.Config
+	logoutURL string
 }
 
 const (
@@ -21,6 +22,7 @@ const (
 
 func NewGoogleProvider(config providers.OAuth2Config) providers.OAuth2Provider {
 	return &Provider{
+		logoutURL: config.LogoutURL,
 		oauth2: oauth2.Config{
 			ClientID:     config.ClientID,
 			ClientSecret: config.ClientSecret,
@@ -28,7 +30,7 @@ func NewGoogleProvider(config providers.OAuth2Config) providers.OAuth2Provider {
 				AuthURL:  authEndpoint,
 				TokenURL: tokenEndpoint,
 			},
-			Scopes: []string{"email"},
+			Scopes: config.ScopesOrDefault("email"),
 		},
 	}
 }
@@ -50,24 +52,18 @@ func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error)
 		return userInfo, providers.ErrCodeExchange
 	}
 
-	// Parse the token
-	jwtToken, _ := jwt.ParseWithClaims(token.Extra("id_token").(string), &providers.OIDClaims{}, nil)
-	if jwtToken == nil {
-		return userInfo, providers.ErrJWTParse
-	}
-
-	claims, ok := jwtToken.Claims.(*providers.OIDClaims)
-	if !ok {
-		return userInfo, providers.ErrJWTClaims
-	}
+	return providers.UserInfoFromToken(token)
+}
 
-	if claims.Email == "" {
-		return userInfo, providers.ErrNoEmail
+// Refresh re-validates a user with Google using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
 	}
 
-	userInfo.Email = claims.Email
-
-	return userInfo, nil
+	return providers.UserInfoFromToken(token)
 }
 
 // GetLoginURL returns OAuth 2 login endpoint used to redirect users
@@ -77,5 +73,14 @@ func (provider Provider) GetLoginURL(callbackURL string, state string) string {
 
 	callback := oauth2.SetAuthURLParam("redirect_uri", callbackURL)
 
-	return provider.oauth2.AuthCodeURL(s, callback)
+	// Google only issues refresh tokens for offline access
+	return provider.oauth2.AuthCodeURL(s, callback, oauth2.AccessTypeOffline)
+}
+
+// GetLogoutURL returns the configured end session endpoint, Google does not provide one
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	if provider.logoutURL == "" {
+		return ""
+	}
+	return providers.EndSessionURL(provider.logoutURL, provider.oauth2.ClientID, returnURL, idToken)
 }
@@ -0,0 +1,102 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrUnknownKey is returned when a token is signed with a key the identity provider does not publish
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// keySetRefreshInterval bounds how often a key set is fetched again to find unknown keys
+const keySetRefreshInterval = time.Minute
+
+// KeySet fetches and caches the signing keys an identity provider publishes as a JSON Web Key Set
+type KeySet struct {
+	url       string
+	client    *http.Client
+	mu        sync.Mutex
+	keys      jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// NewKeySet creates a key set fetched from url
+func NewKeySet(url string) *KeySet {
+	return &KeySet{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Key returns the key with the given ID. The key set is fetched again when the key is unknown,
+// identity providers rotate their keys
+func (ks *KeySet) Key(kid string) (*jose.JSONWebKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if keys := ks.keys.Key(kid); len(keys) > 0 {
+		return &keys[0], nil
+	}
+	if time.Since(ks.fetchedAt) < keySetRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	if err := ks.fetch(); err != nil {
+		return nil, err
+	}
+	if keys := ks.keys.Key(kid); len(keys) > 0 {
+		return &keys[0], nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (ks *KeySet) fetch() error {
+	ks.fetchedAt = time.Now()
+
+	res, err := ks.client.Get(ks.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch key set: %s", res.Status)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return err
+	}
+	ks.keys = keys
+
+	return nil
+}
+
+// VerifyJWT checks the signature of a JWT issued by the identity provider and decodes its claims
+func (ks *KeySet) VerifyJWT(token string, claims ...interface{}) error {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return ErrJWTParse
+	}
+	if len(tok.Headers) != 1 {
+		return ErrJWTParse
+	}
+
+	key, err := ks.Key(tok.Headers[0].KeyID)
+	if err != nil {
+		return err
+	}
+	// the published key decides the algorithm, not the token
+	if key.Algorithm != "" && key.Algorithm != tok.Headers[0].Algorithm {
+		return ErrJWTParse
+	}
+
+	return tok.Claims(key.Key, claims...)
+}
@@ -0,0 +1,110 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Provider represents a Keycloak realm
+type Provider struct {
+	providers.OAuth2Provider
+	oauth2    oauth2.Config
+	issuer    string
+	keys      *providers.KeySet
+	logoutURL string
+}
+
+// claims are the Keycloak specific id_token claims.
+// groups requires a group membership mapper on the client
+type claims struct {
+	Groups      []string `json:"groups"`
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+}
+
+// NewKeycloakProvider creates a new Keycloak identity provider for config.Realm on the server in config.Domain.
+// Servers older than Keycloak 17 need the /auth path in the domain
+func NewKeycloakProvider(config providers.OAuth2Config) providers.OAuth2Provider {
+	issuer := providers.BaseURL(config.Domain) + "/realms/" + config.Realm
+	endpoints := issuer + "/protocol/openid-connect"
+
+	return &Provider{
+		issuer:    issuer,
+		keys:      providers.NewKeySet(endpoints + "/certs"),
+		logoutURL: endpoints + "/logout",
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  endpoints + "/auth",
+				TokenURL: endpoints + "/token",
+			},
+			Scopes: config.ScopesOrDefault("openid", "email", "roles", "offline_access"),
+		},
+	}
+}
+
+// FetchUser fetches user info from Keycloak
+func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error) {
+	code := r.URL.Query().Get("code")
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := scheme + "://" + r.Host + r.URL.Path
+	callback := oauth2.SetAuthURLParam("redirect_uri", url)
+
+	// get access token
+	token, err := provider.oauth2.Exchange(context.TODO(), code, callback)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrCodeExchange
+	}
+
+	return provider.userInfo(token)
+}
+
+// Refresh re-validates a user with Keycloak using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
+	}
+
+	return provider.userInfo(token)
+}
+
+// userInfo verifies the id_token and maps the groups and realm roles claims
+func (provider Provider) userInfo(token *oauth2.Token) (providers.UserInfo, error) {
+	var c claims
+	userInfo, err := providers.VerifyIDToken(token, provider.keys, provider.issuer, provider.oauth2.ClientID, &c)
+	if err != nil {
+		return userInfo, err
+	}
+	userInfo.Groups = append(c.Groups, c.RealmAccess.Roles...)
+
+	return userInfo, nil
+}
+
+// GetLoginURL returns OAuth 2 login endpoint used to redirect users
+func (provider Provider) GetLoginURL(callbackURL string, state string) string {
+	// @todo encrypt state
+	s := base64.StdEncoding.EncodeToString([]byte(state))
+
+	callback := oauth2.SetAuthURLParam("redirect_uri", callbackURL)
+
+	return provider.oauth2.AuthCodeURL(s, callback)
+}
+
+// GetLogoutURL returns the Keycloak end session endpoint
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return providers.EndSessionURL(provider.logoutURL, provider.oauth2.ClientID, returnURL, idToken)
+}
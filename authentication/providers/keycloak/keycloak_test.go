@@ -0,0 +1,85 @@
+package keycloak
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/providers/oidctest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newKeycloak fakes the acme realm of a Keycloak server publishing key and issuing id_tokens with the given extra
+// claims signed with signingKey
+func newKeycloak(t *testing.T, key, signingKey *rsa.PrivateKey, extra map[string]interface{}) *httptest.Server {
+	return oidctest.NewServer(t, oidctest.Config{
+		KeysPath:   "/realms/acme/protocol/openid-connect/certs",
+		TokenPath:  "/realms/acme/protocol/openid-connect/token",
+		KeyID:      "keycloak",
+		Key:        key,
+		SigningKey: signingKey,
+		Claims: func(url string) interface{} {
+			claims := map[string]interface{}{
+				"iss":            url + "/realms/acme",
+				"aud":            []string{"client", "account"},
+				"sub":            "f1b2",
+				"sid":            "session",
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"email":          "dev@acme.test",
+				"email_verified": true,
+			}
+			for k, v := range extra {
+				claims[k] = v
+			}
+			return claims
+		},
+	})
+}
+
+func TestProvider_FetchUser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	roles := map[string]interface{}{"roles": []string{"admin", "offline_access"}}
+	tests := []struct {
+		Key    *rsa.PrivateKey
+		Extra  map[string]interface{}
+		Groups []string
+		Err    error
+	}{
+		{key, map[string]interface{}{"realm_access": roles}, []string{"admin", "offline_access"}, nil},
+		{key, map[string]interface{}{"realm_access": roles, "groups": []string{"/engineering"}}, []string{"/engineering", "admin", "offline_access"}, nil},
+		{key, nil, nil, nil},
+		{otherKey, nil, nil, providers.ErrJWTParse},
+		{key, map[string]interface{}{"aud": "account"}, nil, providers.ErrJWTClaims},
+	}
+
+	for _, test := range tests {
+		server := newKeycloak(t, key, test.Key, test.Extra)
+		provider := NewKeycloakProvider(providers.OAuth2Config{
+			ClientID:     "client",
+			ClientSecret: "secret",
+			Domain:       server.URL,
+			Realm:        "acme",
+		})
+
+		req := httptest.NewRequest("GET", "http://helios/.well-known/callback?code=code", nil)
+		info, err := provider.FetchUser(req)
+		assert.Equal(t, test.Err, err)
+		if err == nil {
+			assert.Equal(t, "dev@acme.test", info.Email)
+			assert.Equal(t, "session", info.SessionID)
+			assert.Equal(t, test.Groups, info.Groups)
+
+			info, err = provider.Refresh("refresh")
+			assert.NoError(t, err)
+			assert.Equal(t, test.Groups, info.Groups)
+		}
+		server.Close()
+	}
+}
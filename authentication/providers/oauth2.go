@@ -1,9 +1,14 @@
 package providers
 
 import (
+	"context"
 	"errors"
-	"github.com/dgrijalva/jwt-go"
 	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
 )
 
 // OAuth2Config OAuth2 provider configuration settings
@@ -13,22 +18,67 @@ type OAuth2Config struct {
 	AuthURL      string
 	TokenURL     string
 	ProfileURL   string
+	// LogoutURL is the OpenID Connect end_session_endpoint
+	LogoutURL string
+	// Scopes replace the scopes requested by default
+	Scopes []string
+	// APIURL is the REST API of providers that are not OpenID Connect compliant, or Microsoft Graph for Azure AD
+	APIURL string
+	// Domain is the Okta organization or the Keycloak server endpoints are built from
+	Domain string
+	// Realm is the Keycloak realm
+	Realm string
+	// AuthorizationServer is the Okta custom authorization server, the org authorization server is used when empty
+	AuthorizationServer string
+	// GroupNames maps Azure AD group object IDs to their display names
+	GroupNames bool
+	// GroupCacheTTL is how long Azure AD groups resolved through Microsoft Graph are cached per user
+	GroupCacheTTL time.Duration
+}
+
+// ScopesOrDefault returns the configured scopes, or the given defaults
+func (c OAuth2Config) ScopesOrDefault(defaults ...string) []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+	return defaults
 }
 
 // UserInfo represents a Open ID Connect user info
 type UserInfo struct {
-	Email string
+	Email        string
+	Groups       []string
+	AccessToken  string
+	RefreshToken string
+	// IDToken is sent back to the identity provider as a hint on logout
+	IDToken string
+	// Subject and SessionID identify the user and its session at the identity provider
+	Subject   string
+	SessionID string
 }
 
 // OAuth2Provider provider interface
 type OAuth2Provider interface {
 	FetchUser(r *http.Request) (UserInfo, error)
 	GetLoginURL(callbackURL, state string) string
+	// Refresh re-validates a user with the identity provider using a refresh token
+	Refresh(refreshToken string) (UserInfo, error)
+	// GetLogoutURL returns the identity provider logout endpoint, which sends users back to returnURL.
+	// It is empty when the provider cannot end sessions
+	GetLogoutURL(returnURL, idToken string) string
+}
+
+// MetadataProvider is implemented by SAML service providers, which publish their metadata to identity providers.
+// Identity providers post assertions to their assertion consumer service rather than the OAuth2 callback
+type MetadataProvider interface {
+	Metadata(acsURL string) ([]byte, error)
 }
 
 type OIDClaims struct {
 	jwt.StandardClaims
 	Email string `json:"email,omitempty"`
+	// SessionID is the identity provider session, used by back-channel logout
+	SessionID string `json:"sid,omitempty"`
 }
 
 // ErrCodeExchange is returned when the auth code exchange failed
@@ -45,3 +95,75 @@ var ErrJWTParse = errors.New("cannot parse jwt")
 
 // ErrJWTClaims is returned when required claims are missing
 var ErrJWTClaims = errors.New("invalid jwt claims")
+
+// ErrRefresh is returned when the identity provider refused to refresh a session
+var ErrRefresh = errors.New("error refreshing token")
+
+// UserInfoFromToken builds the user info out of the id_token returned by a token endpoint
+func UserInfoFromToken(token *oauth2.Token) (UserInfo, error) {
+	var userInfo UserInfo
+
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return userInfo, ErrJWTParse
+	}
+
+	// Parse the token
+	jwtToken, _ := jwt.ParseWithClaims(idToken, &OIDClaims{}, nil)
+	if jwtToken == nil {
+		return userInfo, ErrJWTParse
+	}
+
+	claims, ok := jwtToken.Claims.(*OIDClaims)
+	if !ok {
+		return userInfo, ErrJWTClaims
+	}
+
+	if claims.Email == "" {
+		return userInfo, ErrNoEmail
+	}
+
+	userInfo.Email = claims.Email
+	userInfo.AccessToken = token.AccessToken
+	userInfo.RefreshToken = token.RefreshToken
+	userInfo.IDToken = idToken
+	userInfo.Subject = claims.Subject
+	userInfo.SessionID = claims.SessionID
+
+	return userInfo, nil
+}
+
+// EndSessionURL builds an OpenID Connect RP-initiated logout URL
+func EndSessionURL(endpoint, clientID, returnURL, idToken string) string {
+	params := url.Values{
+		"client_id":                {clientID},
+		"post_logout_redirect_uri": {returnURL},
+	}
+	if idToken != "" {
+		params.Set("id_token_hint", idToken)
+	}
+
+	return endpoint + "?" + params.Encode()
+}
+
+// RefreshToken exchanges a refresh token for a new set of tokens
+func RefreshToken(config oauth2.Config, refreshToken string) (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// an expired token forces the token source to use the refresh token
+	token, err := config.TokenSource(ctx, &oauth2.Token{
+		RefreshToken: refreshToken,
+		Expiry:       time.Unix(1, 0),
+	}).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// identity providers may not rotate refresh tokens
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+
+	return token, nil
+}
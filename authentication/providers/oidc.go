@@ -0,0 +1,66 @@
+package providers
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// IDTokenClaims are the standard claims of an OpenID Connect id_token
+type IDTokenClaims struct {
+	jwt.Claims
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	SessionID     string `json:"sid"`
+}
+
+// BaseURL returns an https URL for a domain, full URLs are returned as is
+func BaseURL(domain string) string {
+	if strings.Contains(domain, "://") {
+		return strings.TrimSuffix(domain, "/")
+	}
+	return "https://" + strings.TrimSuffix(domain, "/")
+}
+
+// VerifyIDToken checks the signature and the standard claims of the id_token returned along a token.
+// The id_token claims are also decoded into claims so providers can read their own
+func VerifyIDToken(token *oauth2.Token, keys *KeySet, issuer, clientID string, claims interface{}) (UserInfo, error) {
+	var userInfo UserInfo
+
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return userInfo, ErrJWTParse
+	}
+
+	var std IDTokenClaims
+	if err := keys.VerifyJWT(idToken, &std, claims); err != nil {
+		log.Error(err)
+		return userInfo, ErrJWTParse
+	}
+
+	err := std.ValidateWithLeeway(jwt.Expected{
+		Issuer:   issuer,
+		Audience: jwt.Audience{clientID},
+		Time:     time.Now(),
+	}, time.Minute)
+	if err != nil {
+		log.Error(err)
+		return userInfo, ErrJWTClaims
+	}
+
+	if std.Email == "" || (std.EmailVerified != nil && !*std.EmailVerified) {
+		return userInfo, ErrNoEmail
+	}
+
+	userInfo.Email = std.Email
+	userInfo.AccessToken = token.AccessToken
+	userInfo.RefreshToken = token.RefreshToken
+	userInfo.IDToken = idToken
+	userInfo.Subject = std.Subject
+	userInfo.SessionID = std.SessionID
+
+	return userInfo, nil
+}
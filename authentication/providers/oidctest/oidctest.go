@@ -0,0 +1,64 @@
+// Package oidctest fakes OpenID Connect identity providers for provider tests
+package oidctest
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Config describes a fake identity provider
+type Config struct {
+	// KeysPath serves the key set
+	KeysPath string
+	// TokenPath is the token endpoint, it issues the same tokens for every grant
+	TokenPath string
+	// KeyID identifies the published key
+	KeyID string
+	// Key is published in the key set
+	Key *rsa.PrivateKey
+	// SigningKey signs id_tokens, defaults to Key
+	SigningKey *rsa.PrivateKey
+	// Claims returns the id_token claims given the server URL
+	Claims func(url string) interface{}
+}
+
+// NewServer starts a fake identity provider, callers close it
+func NewServer(t *testing.T, conf Config) *httptest.Server {
+	signingKey := conf.SigningKey
+	if signingKey == nil {
+		signingKey = conf.Key
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: signingKey},
+		(&jose.SignerOptions{}).WithHeader("kid", conf.KeyID))
+	assert.NoError(t, err)
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.KeysPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &conf.Key.PublicKey, KeyID: conf.KeyID, Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc(conf.TokenPath, func(w http.ResponseWriter, r *http.Request) {
+		token, err := jwt.Signed(signer).Claims(conf.Claims(server.URL)).CompactSerialize()
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": "refresh",
+			"token_type":    "Bearer",
+			"expires_in":    300,
+			"id_token":      token,
+		})
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
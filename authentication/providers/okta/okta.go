@@ -0,0 +1,109 @@
+package okta
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Provider represents an Okta organization
+type Provider struct {
+	providers.OAuth2Provider
+	oauth2    oauth2.Config
+	issuer    string
+	keys      *providers.KeySet
+	logoutURL string
+}
+
+// claims are the Okta specific id_token claims
+type claims struct {
+	Groups []string `json:"groups"`
+}
+
+// NewOktaProvider creates a new Okta identity provider for the organization in config.Domain
+func NewOktaProvider(config providers.OAuth2Config) providers.OAuth2Provider {
+	issuer := providers.BaseURL(config.Domain)
+	endpoints := issuer + "/oauth2/v1"
+	if config.AuthorizationServer != "" {
+		issuer += "/oauth2/" + config.AuthorizationServer
+		endpoints = issuer + "/v1"
+	}
+
+	return &Provider{
+		issuer:    issuer,
+		keys:      providers.NewKeySet(endpoints + "/keys"),
+		logoutURL: endpoints + "/logout",
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  endpoints + "/authorize",
+				TokenURL: endpoints + "/token",
+			},
+			Scopes: config.ScopesOrDefault("openid", "email", "groups", "offline_access"),
+		},
+	}
+}
+
+// FetchUser fetches user info from Okta
+func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error) {
+	code := r.URL.Query().Get("code")
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := scheme + "://" + r.Host + r.URL.Path
+	callback := oauth2.SetAuthURLParam("redirect_uri", url)
+
+	// get access token
+	token, err := provider.oauth2.Exchange(context.TODO(), code, callback)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrCodeExchange
+	}
+
+	return provider.userInfo(token)
+}
+
+// Refresh re-validates a user with Okta using a refresh token
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	token, err := providers.RefreshToken(provider.oauth2, refreshToken)
+	if err != nil {
+		log.Error(err)
+		return providers.UserInfo{}, providers.ErrRefresh
+	}
+
+	return provider.userInfo(token)
+}
+
+// userInfo verifies the id_token and maps the groups claim
+func (provider Provider) userInfo(token *oauth2.Token) (providers.UserInfo, error) {
+	var c claims
+	userInfo, err := providers.VerifyIDToken(token, provider.keys, provider.issuer, provider.oauth2.ClientID, &c)
+	if err != nil {
+		return userInfo, err
+	}
+	userInfo.Groups = c.Groups
+
+	return userInfo, nil
+}
+
+// GetLoginURL returns OAuth 2 login endpoint used to redirect users
+func (provider Provider) GetLoginURL(callbackURL string, state string) string {
+	// @todo encrypt state
+	s := base64.StdEncoding.EncodeToString([]byte(state))
+
+	callback := oauth2.SetAuthURLParam("redirect_uri", callbackURL)
+
+	return provider.oauth2.AuthCodeURL(s, callback)
+}
+
+// GetLogoutURL returns the Okta logout endpoint
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return providers.EndSessionURL(provider.logoutURL, provider.oauth2.ClientID, returnURL, idToken)
+}
@@ -0,0 +1,90 @@
+package okta
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/providers/oidctest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOkta fakes an Okta org authorization server publishing key and signing the id_token returned by idToken
+// with signingKey
+func newOkta(t *testing.T, key, signingKey *rsa.PrivateKey, idToken func(issuer string) interface{}) *httptest.Server {
+	return oidctest.NewServer(t, oidctest.Config{
+		KeysPath:   "/oauth2/v1/keys",
+		TokenPath:  "/oauth2/v1/token",
+		KeyID:      "okta",
+		Key:        key,
+		SigningKey: signingKey,
+		Claims:     idToken,
+	})
+}
+
+func TestProvider_FetchUser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	claims := func(extra map[string]interface{}) func(string) interface{} {
+		return func(issuer string) interface{} {
+			c := map[string]interface{}{
+				"iss":            issuer,
+				"aud":            "client",
+				"sub":            "00u1",
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"iat":            time.Now().Unix(),
+				"email":          "dev@acme.test",
+				"email_verified": true,
+				"groups":         []string{"Everyone", "Engineering"},
+			}
+			for k, v := range extra {
+				c[k] = v
+			}
+			return c
+		}
+	}
+
+	tests := []struct {
+		Key    *rsa.PrivateKey
+		Claims func(string) interface{}
+		Err    error
+	}{
+		{key, claims(nil), nil},
+		{otherKey, claims(nil), providers.ErrJWTParse},
+		{key, claims(map[string]interface{}{"aud": "other"}), providers.ErrJWTClaims},
+		{key, claims(map[string]interface{}{"iss": "https://evil.test"}), providers.ErrJWTClaims},
+		{key, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), providers.ErrJWTClaims},
+		{key, claims(map[string]interface{}{"email_verified": false}), providers.ErrNoEmail},
+	}
+
+	for _, test := range tests {
+		server := newOkta(t, key, test.Key, test.Claims)
+		provider := NewOktaProvider(providers.OAuth2Config{ClientID: "client", ClientSecret: "secret", Domain: server.URL})
+
+		req := httptest.NewRequest("GET", "http://helios/.well-known/callback?code=code", nil)
+		info, err := provider.FetchUser(req)
+		server.Close()
+
+		assert.Equal(t, test.Err, err)
+		if err == nil {
+			assert.Equal(t, "dev@acme.test", info.Email)
+			assert.Equal(t, "00u1", info.Subject)
+			assert.Equal(t, []string{"Everyone", "Engineering"}, info.Groups)
+		}
+	}
+}
+
+func TestNewOktaProvider(t *testing.T) {
+	provider := NewOktaProvider(providers.OAuth2Config{ClientID: "client", Domain: "acme.okta.com", AuthorizationServer: "default"})
+
+	assert.Contains(t, provider.GetLoginURL("https://helios/.well-known/callback", "/"),
+		"https://acme.okta.com/oauth2/default/v1/authorize?")
+	assert.Contains(t, provider.GetLogoutURL("https://helios/", "token"),
+		"https://acme.okta.com/oauth2/default/v1/logout?")
+}
@@ -0,0 +1,230 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/cyakimov/helios/authentication/providers"
+	dsig "github.com/russellhaering/goxmldsig"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearerMethod  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	// clockSkew is the clock difference tolerated with identity providers
+	clockSkew = 3 * time.Minute
+)
+
+// ErrResponse is returned when the identity provider response is malformed or not successful
+var ErrResponse = errors.New("invalid SAML response")
+
+// ErrSignature is returned when the assertion is not signed by the identity provider
+var ErrSignature = errors.New("invalid SAML assertion signature")
+
+// ErrConditions is returned when the assertion is not meant for this service provider or expired
+var ErrConditions = errors.New("SAML assertion conditions are not met")
+
+// ErrReplay is returned when an assertion is used twice
+var ErrReplay = errors.New("SAML assertion was already used")
+
+type assertion struct {
+	ID      string `xml:"ID,attr"`
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID        string `xml:"NameID"`
+		Confirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				Recipient    string    `xml:"Recipient,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+				InResponseTo string    `xml:"InResponseTo,attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	} `xml:"Subject"`
+	Conditions *struct {
+		NotBefore            time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter         time.Time `xml:"NotOnOrAfter,attr"`
+		AudienceRestrictions []struct {
+			Audiences []string `xml:"Audience"`
+		} `xml:"AudienceRestriction"`
+	} `xml:"Conditions"`
+	AuthnStatements []struct {
+		SessionIndex string `xml:"SessionIndex,attr"`
+	} `xml:"AuthnStatement"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+// parseResponse verifies a base64 encoded SAML response posted to acsURL and returns its assertion.
+// Either the response or the assertion must be signed, only signed content is trusted.
+// The response must answer the authentication request requestID, unsolicited responses are refused
+func (provider Provider) parseResponse(encoded, acsURL, requestID string, now time.Time) (*assertion, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrResponse
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, ErrResponse
+	}
+
+	res := doc.Root()
+	if res == nil || res.Tag != "Response" || res.NamespaceURI() != protocolNamespace {
+		return nil, ErrResponse
+	}
+	if status := res.FindElement("./Status/StatusCode"); status == nil || status.SelectAttrValue("Value", "") != statusSuccess {
+		log.Debug("SAML response status is not successful")
+		return nil, ErrResponse
+	}
+	if dest := res.SelectAttrValue("Destination", ""); dest != "" && dest != acsURL {
+		log.Debugf("SAML response destination %q is not %q", dest, acsURL)
+		return nil, ErrResponse
+	}
+	if inResponseTo := res.SelectAttrValue("InResponseTo", ""); inResponseTo != requestID {
+		log.Debugf("SAML response answers request %q, not %q", inResponseTo, requestID)
+		return nil, ErrResponse
+	}
+
+	el, err := provider.signedAssertion(res)
+	if err != nil {
+		log.Debugf("Cannot verify SAML response: %v", err)
+		return nil, ErrSignature
+	}
+
+	// only the validated element is decoded, so unsigned content cannot be smuggled in
+	signed := etree.NewDocument()
+	signed.SetRoot(el)
+	b, err := signed.WriteToBytes()
+	if err != nil {
+		return nil, ErrResponse
+	}
+	var a assertion
+	if err := xml.Unmarshal(b, &a); err != nil {
+		return nil, ErrResponse
+	}
+
+	expiresAt, err := provider.checkConditions(&a, acsURL, requestID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !provider.seen.add(a.ID, expiresAt, now) {
+		return nil, ErrReplay
+	}
+
+	return &a, nil
+}
+
+// signedAssertion returns the single assertion of a response, out of the signed response or the signed assertion
+func (provider Provider) signedAssertion(res *etree.Element) (*etree.Element, error) {
+	validated, err := provider.validator.Validate(res)
+	if err == nil {
+		return onlyAssertion(validated)
+	}
+	if err != dsig.ErrMissingSignature {
+		return nil, err
+	}
+
+	el, err := onlyAssertion(res)
+	if err != nil {
+		return nil, err
+	}
+	return provider.validator.Validate(el)
+}
+
+func onlyAssertion(res *etree.Element) (*etree.Element, error) {
+	if len(res.SelectElements("EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := res.SelectElements("Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must hold exactly one assertion")
+	}
+	return assertions[0], nil
+}
+
+// checkConditions verifies the assertion is meant for this service provider, answers requestID and is still valid.
+// It returns when the assertion expires
+func (provider Provider) checkConditions(a *assertion, acsURL, requestID string, now time.Time) (time.Time, error) {
+	if provider.config.IdPEntityID != "" && a.Issuer != provider.config.IdPEntityID {
+		log.Debugf("SAML assertion issuer %q is not %q", a.Issuer, provider.config.IdPEntityID)
+		return now, ErrConditions
+	}
+
+	c := a.Conditions
+	if c == nil {
+		log.Debug("SAML assertion has no conditions")
+		return now, ErrConditions
+	}
+	if !c.NotBefore.IsZero() && now.Add(clockSkew).Before(c.NotBefore) {
+		log.Debug("SAML assertion is not valid yet")
+		return now, ErrConditions
+	}
+	if !c.NotOnOrAfter.IsZero() && !now.Add(-clockSkew).Before(c.NotOnOrAfter) {
+		log.Debug("SAML assertion expired")
+		return now, ErrConditions
+	}
+	// every audience restriction must include the service provider
+	if len(c.AudienceRestrictions) == 0 {
+		log.Debug("SAML assertion has no audience restriction")
+		return now, ErrConditions
+	}
+	for _, restriction := range c.AudienceRestrictions {
+		if !contains(restriction.Audiences, provider.config.EntityID) {
+			log.Debugf("SAML assertion audience %v does not include %q", restriction.Audiences, provider.config.EntityID)
+			return now, ErrConditions
+		}
+	}
+
+	for _, confirmation := range a.Subject.Confirmations {
+		data := confirmation.Data
+		if confirmation.Method == bearerMethod && data.Recipient == acsURL && data.InResponseTo == requestID &&
+			now.Add(-clockSkew).Before(data.NotOnOrAfter) {
+			return data.NotOnOrAfter.Add(clockSkew), nil
+		}
+	}
+	log.Debugf("SAML assertion has no valid bearer confirmation of request %q for %q", requestID, acsURL)
+	return now, ErrConditions
+}
+
+// userInfo maps the assertion subject and attributes to the user info
+func (provider Provider) userInfo(a *assertion) (providers.UserInfo, error) {
+	userInfo := providers.UserInfo{
+		Email:   a.Subject.NameID,
+		Subject: a.Subject.NameID,
+	}
+	if len(a.AuthnStatements) > 0 {
+		userInfo.SessionID = a.AuthnStatements[0].SessionIndex
+	}
+
+	if provider.config.EmailAttribute != "" {
+		userInfo.Email = ""
+	}
+	for _, attr := range a.Attributes {
+		if attr.Name == provider.config.EmailAttribute && len(attr.Values) > 0 {
+			userInfo.Email = attr.Values[0]
+		}
+		if attr.Name == provider.config.GroupsAttribute {
+			userInfo.Groups = append(userInfo.Groups, attr.Values...)
+		}
+	}
+
+	if userInfo.Email == "" {
+		return userInfo, providers.ErrNoEmail
+	}
+	return userInfo, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	dsig "github.com/russellhaering/goxmldsig"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	protocolNamespace = "urn:oasis:names:tc:SAML:2.0:protocol"
+	postBinding       = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	emailNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	rsaSHA256         = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	// defaultGroupsAttribute is the attribute groups are read from by default
+	defaultGroupsAttribute = "groups"
+)
+
+// Config SAML service provider configuration settings
+type Config struct {
+	// EntityID identifies Helios at the identity provider
+	EntityID string
+	// Certificate and Key sign authentication requests
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+	// SSOURL is the identity provider single sign-on endpoint, using the HTTP-Redirect binding
+	SSOURL string
+	// IdPEntityID is the issuer of assertions, it is not checked when empty
+	IdPEntityID string
+	// IdPCertificate verifies the signature of assertions
+	IdPCertificate *x509.Certificate
+	// EmailAttribute is the attribute holding the user email, the NameID is used when empty
+	EmailAttribute string
+	// GroupsAttribute is the attribute holding the user groups, defaults to groups
+	GroupsAttribute string
+}
+
+// Provider represents a SAML 2.0 service provider
+type Provider struct {
+	providers.OAuth2Provider
+	config    Config
+	validator *dsig.ValidationContext
+	// seen holds the IDs of consumed assertions until they expire, so they cannot be replayed
+	seen *assertionCache
+}
+
+// NewSAMLProvider creates a new SAML service provider with a given config
+func NewSAMLProvider(config Config) (*Provider, error) {
+	if config.EntityID == "" || config.SSOURL == "" {
+		return nil, errors.New("SAML entity ID and SSO URL are required")
+	}
+	if config.Certificate == nil || config.Key == nil {
+		return nil, errors.New("SAML certificate and key are required to sign authentication requests")
+	}
+	if config.IdPCertificate == nil {
+		return nil, errors.New("SAML identity provider certificate is required")
+	}
+	if config.GroupsAttribute == "" {
+		config.GroupsAttribute = defaultGroupsAttribute
+	}
+
+	return &Provider{
+		config: config,
+		validator: dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: []*x509.Certificate{config.IdPCertificate},
+		}),
+		seen: &assertionCache{ids: make(map[string]time.Time)},
+	}, nil
+}
+
+type issuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Value   string   `xml:",chardata"`
+}
+
+type nameIDPolicy struct {
+	Format      string `xml:"Format,attr,omitempty"`
+	AllowCreate bool   `xml:"AllowCreate,attr"`
+}
+
+type authnRequest struct {
+	XMLName                     xml.Name     `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string       `xml:"ID,attr"`
+	Version                     string       `xml:"Version,attr"`
+	IssueInstant                string       `xml:"IssueInstant,attr"`
+	Destination                 string       `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string       `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string       `xml:"ProtocolBinding,attr"`
+	Issuer                      issuer       `xml:"Issuer"`
+	NameIDPolicy                nameIDPolicy `xml:"NameIDPolicy"`
+}
+
+// FetchUser validates the assertion posted by the identity provider to the assertion consumer service
+func (provider Provider) FetchUser(r *http.Request) (providers.UserInfo, error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	acsURL := scheme + "://" + r.Host + r.URL.Path
+
+	requestID := authnRequestID(r.PostFormValue("RelayState"))
+	a, err := provider.parseResponse(r.PostFormValue("SAMLResponse"), acsURL, requestID, time.Now())
+	if err != nil {
+		return providers.UserInfo{}, err
+	}
+
+	return provider.userInfo(a)
+}
+
+// Refresh is not supported, SAML sessions last until they expire
+func (provider Provider) Refresh(refreshToken string) (providers.UserInfo, error) {
+	return providers.UserInfo{}, providers.ErrRefresh
+}
+
+// GetLoginURL returns the identity provider single sign-on URL with a signed authentication request.
+// The identity provider posts the assertion to callbackURL, the assertion consumer service. The state is sent as
+// RelayState and must be short, identity providers may drop relay states longer than 80 bytes
+func (provider Provider) GetLoginURL(callbackURL string, state string) string {
+	req := authnRequest{
+		ID:                          authnRequestID(state),
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(time.RFC3339),
+		Destination:                 provider.config.SSOURL,
+		AssertionConsumerServiceURL: callbackURL,
+		ProtocolBinding:             postBinding,
+		Issuer:                      issuer{Value: provider.config.EntityID},
+		NameIDPolicy:                nameIDPolicy{AllowCreate: true},
+	}
+	if provider.config.EmailAttribute == "" {
+		req.NameIDPolicy.Format = emailNameIDFormat
+	}
+
+	signed, err := provider.signRequest(req, state)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	sep := "?"
+	if strings.Contains(provider.config.SSOURL, "?") {
+		sep = "&"
+	}
+	return provider.config.SSOURL + sep + signed
+}
+
+// authnRequestID derives the authentication request ID from the relay state it is sent with, so responses are matched
+// to their request without keeping track of the requests. Relay states must be random for the IDs to be unique
+func authnRequestID(relayState string) string {
+	sum := sha256.Sum256([]byte(relayState))
+	return "_" + hex.EncodeToString(sum[:20])
+}
+
+// signRequest encodes an authentication request for the HTTP-Redirect binding and signs the query string
+func (provider Provider) signRequest(req authnRequest, relayState string) (string, error) {
+	b, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(b); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	// the signature covers the parameters in this exact order
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(buf.Bytes())) +
+		"&RelayState=" + url.QueryEscape(relayState) +
+		"&SigAlg=" + url.QueryEscape(rsaSHA256)
+
+	sum := sha256.Sum256([]byte(query))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, provider.config.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// GetLogoutURL returns an empty URL, single logout is not supported
+func (provider Provider) GetLogoutURL(returnURL, idToken string) string {
+	return ""
+}
+
+type keyDescriptor struct {
+	Use     string `xml:"use,attr"`
+	KeyInfo struct {
+		XMLName         xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+		X509Certificate string   `xml:"X509Data>X509Certificate"`
+	}
+}
+
+type endpoint struct {
+	Binding  string `xml:"Binding,attr"`
+	Location string `xml:"Location,attr"`
+	Index    int    `xml:"index,attr"`
+}
+
+type entityDescriptor struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string   `xml:"entityID,attr"`
+	SPSSODescriptor struct {
+		AuthnRequestsSigned        bool          `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool          `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string        `xml:"protocolSupportEnumeration,attr"`
+		KeyDescriptor              keyDescriptor `xml:"KeyDescriptor"`
+		NameIDFormat               string        `xml:"NameIDFormat,omitempty"`
+		AssertionConsumerService   endpoint      `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// Metadata returns the service provider metadata identity providers are configured with
+func (provider Provider) Metadata(acsURL string) ([]byte, error) {
+	var m entityDescriptor
+	m.EntityID = provider.config.EntityID
+	sp := &m.SPSSODescriptor
+	sp.AuthnRequestsSigned = true
+	sp.WantAssertionsSigned = true
+	sp.ProtocolSupportEnumeration = protocolNamespace
+	sp.KeyDescriptor.Use = "signing"
+	sp.KeyDescriptor.KeyInfo.X509Certificate = base64.StdEncoding.EncodeToString(provider.config.Certificate.Raw)
+	if provider.config.EmailAttribute == "" {
+		sp.NameIDFormat = emailNameIDFormat
+	}
+	sp.AssertionConsumerService = endpoint{Binding: postBinding, Location: acsURL}
+
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// assertionCache remembers consumed assertions until they expire
+type assertionCache struct {
+	sync.Mutex
+	ids map[string]time.Time
+}
+
+// add records an assertion ID, it returns false when the assertion was already consumed
+func (c *assertionCache) add(id string, expiresAt, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for key, exp := range c.ids {
+		if !exp.After(now) {
+			delete(c.ids, key)
+		}
+	}
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	c.ids[id] = expiresAt
+	return true
+}
@@ -0,0 +1,283 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/cyakimov/helios/authentication/providers"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	acsURL   = "https://helios.test/.well-known/saml/acs"
+	entityID = "https://helios.test/saml"
+	idpID    = "https://idp.test"
+	// relayState is the relay state the test authentication request was sent with
+	relayState = "state"
+)
+
+func newKeyPair(t *testing.T) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// response describes a SAML response issued by the test identity provider
+type response struct {
+	ID           string
+	Destination  string
+	Recipient    string
+	Audience     string
+	NotOnOrAfter time.Time
+	// InResponseTo is the request the response answers, ConfirmedRequest the one the subject confirmation answers
+	InResponseTo     string
+	ConfirmedRequest string
+	SignResponse     bool
+	SignAssertion    bool
+	// Tamper changes the user after the assertion was signed
+	Tamper bool
+	// Wrap adds an unsigned assertion next to the signed one
+	Wrap bool
+}
+
+func defaultResponse() response {
+	return response{
+		ID:               "_a1",
+		Destination:      acsURL,
+		Recipient:        acsURL,
+		Audience:         entityID,
+		NotOnOrAfter:     time.Now().Add(5 * time.Minute),
+		InResponseTo:     authnRequestID(relayState),
+		ConfirmedRequest: authnRequestID(relayState),
+		SignAssertion:    true,
+	}
+}
+
+const assertionTemplate = `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="%s" Version="2.0" IssueInstant="%s">` +
+	`<saml:Issuer>` + idpID + `</saml:Issuer>` +
+	`<saml:Subject><saml:NameID>%s</saml:NameID>` +
+	`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+	`<saml:SubjectConfirmationData Recipient="%s" NotOnOrAfter="%s" InResponseTo="%s"/></saml:SubjectConfirmation></saml:Subject>` +
+	`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience>` +
+	`</saml:AudienceRestriction></saml:Conditions>` +
+	`<saml:AuthnStatement SessionIndex="idp-session"/>` +
+	`<saml:AttributeStatement><saml:Attribute Name="groups"><saml:AttributeValue>engineering</saml:AttributeValue>` +
+	`<saml:AttributeValue>ops</saml:AttributeValue></saml:Attribute></saml:AttributeStatement></saml:Assertion>`
+
+func (r response) assertion(id, user string) *etree.Element {
+	now := time.Now().UTC()
+	doc := etree.NewDocument()
+	err := doc.ReadFromString(fmt.Sprintf(assertionTemplate, id, now.Format(time.RFC3339), user, r.Recipient,
+		r.NotOnOrAfter.UTC().Format(time.RFC3339), r.ConfirmedRequest, now.Add(-time.Minute).Format(time.RFC3339),
+		r.NotOnOrAfter.UTC().Format(time.RFC3339), r.Audience))
+	if err != nil {
+		panic(err)
+	}
+	return doc.Root()
+}
+
+// encode builds the response signed by the given identity provider key pair
+func (r response) encode(t *testing.T, idp tls.Certificate) string {
+	signer := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(idp))
+
+	res := etree.NewElement("samlp:Response")
+	res.CreateAttr("xmlns:samlp", protocolNamespace)
+	res.CreateAttr("ID", "_r1")
+	res.CreateAttr("Version", "2.0")
+	res.CreateAttr("Destination", r.Destination)
+	if r.InResponseTo != "" {
+		res.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+	res.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", statusSuccess)
+
+	a := r.assertion(r.ID, "jane@acme.test")
+	if r.SignAssertion {
+		signed, err := signer.SignEnveloped(a)
+		assert.NoError(t, err)
+		a = signed
+	}
+	if r.Tamper {
+		a.FindElement(".//NameID").SetText("mallory@acme.test")
+	}
+	res.AddChild(a)
+	if r.Wrap {
+		res.AddChild(r.assertion("_evil", "mallory@acme.test"))
+	}
+
+	if r.SignResponse {
+		signed, err := signer.SignEnveloped(res)
+		assert.NoError(t, err)
+		res = signed
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(res)
+	b, err := doc.WriteToBytes()
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func newProvider(t *testing.T, idp tls.Certificate) *Provider {
+	sp := newKeyPair(t)
+	provider, err := NewSAMLProvider(Config{
+		EntityID:       entityID,
+		Certificate:    sp.Leaf,
+		Key:            sp.PrivateKey.(*rsa.PrivateKey),
+		SSOURL:         "https://idp.test/sso",
+		IdPEntityID:    idpID,
+		IdPCertificate: idp.Leaf,
+	})
+	assert.NoError(t, err)
+	return provider
+}
+
+func TestProvider_ParseResponse(t *testing.T) {
+	idp := newKeyPair(t)
+	attacker := newKeyPair(t)
+
+	tests := []struct {
+		Name   string
+		Edit   func(r *response)
+		Signer tls.Certificate
+		Err    error
+	}{
+		{"signed assertion", func(r *response) {}, idp, nil},
+		{"signed response", func(r *response) { r.SignAssertion, r.SignResponse = false, true }, idp, nil},
+		{"unsigned", func(r *response) { r.SignAssertion = false }, idp, ErrSignature},
+		{"unknown key", func(r *response) {}, attacker, ErrSignature},
+		{"tampered", func(r *response) { r.Tamper = true }, idp, ErrSignature},
+		{"wrapped", func(r *response) { r.Wrap = true }, idp, ErrSignature},
+		{"destination", func(r *response) { r.Destination = "https://evil.test/acs" }, idp, ErrResponse},
+		{"recipient", func(r *response) { r.Recipient = "https://evil.test/acs" }, idp, ErrConditions},
+		{"audience", func(r *response) { r.Audience = "https://other.test" }, idp, ErrConditions},
+		{"expired", func(r *response) { r.NotOnOrAfter = time.Now().Add(-time.Hour) }, idp, ErrConditions},
+		{"unsolicited", func(r *response) { r.InResponseTo, r.ConfirmedRequest = "", "" }, idp, ErrResponse},
+		{"other request", func(r *response) { r.InResponseTo = authnRequestID("other") }, idp, ErrResponse},
+		{"confirmation of other request", func(r *response) { r.ConfirmedRequest = authnRequestID("other") }, idp, ErrConditions},
+	}
+
+	for _, test := range tests {
+		provider := newProvider(t, idp)
+		r := defaultResponse()
+		test.Edit(&r)
+
+		a, err := provider.parseResponse(r.encode(t, test.Signer), acsURL, authnRequestID(relayState), time.Now())
+		assert.Equal(t, test.Err, err, test.Name)
+		if err != nil {
+			continue
+		}
+
+		info, err := provider.userInfo(a)
+		assert.NoError(t, err, test.Name)
+		assert.Equal(t, "jane@acme.test", info.Email, test.Name)
+		assert.Equal(t, []string{"engineering", "ops"}, info.Groups, test.Name)
+		assert.Equal(t, "idp-session", info.SessionID, test.Name)
+	}
+}
+
+func TestProvider_FetchUserReplay(t *testing.T) {
+	idp := newKeyPair(t)
+	provider := newProvider(t, idp)
+	encoded := defaultResponse().encode(t, idp)
+
+	post := func() error {
+		form := url.Values{"SAMLResponse": {encoded}, "RelayState": {relayState}}
+		req := httptest.NewRequest("POST", acsURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err := provider.FetchUser(req)
+		return err
+	}
+
+	assert.NoError(t, post())
+	assert.Equal(t, ErrReplay, post())
+}
+
+func TestProvider_EmailAttribute(t *testing.T) {
+	provider := newProvider(t, newKeyPair(t))
+	provider.config.EmailAttribute = "mail"
+
+	a := &assertion{}
+	a.Subject.NameID = "jdoe"
+	_, err := provider.userInfo(a)
+	assert.Equal(t, providers.ErrNoEmail, err)
+}
+
+func TestProvider_GetLoginURL(t *testing.T) {
+	sp := newKeyPair(t)
+	provider, err := NewSAMLProvider(Config{
+		EntityID:       entityID,
+		Certificate:    sp.Leaf,
+		Key:            sp.PrivateKey.(*rsa.PrivateKey),
+		SSOURL:         "https://idp.test/sso",
+		IdPCertificate: newKeyPair(t).Leaf,
+	})
+	assert.NoError(t, err)
+
+	login, err := url.Parse(provider.GetLoginURL(acsURL, relayState))
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.test", login.Host)
+
+	// the signature covers the query without the Signature parameter
+	i := strings.Index(login.RawQuery, "&Signature=")
+	sig, err := base64.StdEncoding.DecodeString(login.Query().Get("Signature"))
+	assert.NoError(t, err)
+	sum := sha256.Sum256([]byte(login.RawQuery[:i]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&sp.PrivateKey.(*rsa.PrivateKey).PublicKey, crypto.SHA256, sum[:], sig))
+
+	assert.Equal(t, relayState, login.Query().Get("RelayState"))
+
+	deflated, err := base64.StdEncoding.DecodeString(login.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.NoError(t, err)
+	var req authnRequest
+	assert.NoError(t, xml.Unmarshal(inflated, &req))
+	assert.Equal(t, authnRequestID(relayState), req.ID)
+	assert.Equal(t, acsURL, req.AssertionConsumerServiceURL)
+	assert.Equal(t, entityID, req.Issuer.Value)
+	assert.Equal(t, "https://idp.test/sso", req.Destination)
+}
+
+func TestProvider_Metadata(t *testing.T) {
+	provider := newProvider(t, newKeyPair(t))
+
+	b, err := provider.Metadata(acsURL)
+	assert.NoError(t, err)
+
+	var m entityDescriptor
+	assert.NoError(t, xml.Unmarshal(b, &m))
+	assert.Equal(t, entityID, m.EntityID)
+	assert.Equal(t, acsURL, m.SPSSODescriptor.AssertionConsumerService.Location)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(provider.config.Certificate.Raw),
+		m.SPSSODescriptor.KeyDescriptor.KeyInfo.X509Certificate)
+}
@@ -0,0 +1,211 @@
+package authentication
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// renew re-validates a session with the identity provider once its refresh time has passed
+// and slides the idle timeout on activity.
+// It returns false when the session was ended because the identity provider refused to renew it
+func (helios Helios) renew(w http.ResponseWriter, r *http.Request, creds *credentials) bool {
+	now := time.Now()
+
+	switch {
+	case creds.session != nil:
+		s := creds.session
+		if s.RefreshToken == "" || now.Before(s.RefreshAt) {
+			helios.touchSession(s)
+			return true
+		}
+		// server-side sessions are renewed in the background, the store is updated for the following requests
+		if _, renewing := helios.renewing.LoadOrStore(s.ID, true); !renewing {
+			go func() {
+				defer helios.renewing.Delete(s.ID)
+				helios.renewSession(s)
+			}()
+		}
+		return true
+
+	case creds.claims != nil:
+		claims := creds.claims
+		if claims.RefreshToken == "" || now.Before(time.Unix(claims.RefreshAt, 0)) {
+			helios.touchCookie(w, r, claims)
+			return true
+		}
+		return helios.renewCookie(w, r, creds)
+	}
+
+	// tokens sent in headers cannot be renewed
+	return true
+}
+
+// renewSession refreshes a server-side session, revoking it if the identity provider refuses
+func (helios Helios) renewSession(s *session.Session) {
+	info, err := helios.refresh(s.Provider, s.RefreshToken)
+	if err != nil {
+		log.Warnf("Cannot renew session of %q: %v", s.User, err)
+		sessionEnded(s.User, ExpiryRenewalFailed)
+		if err := helios.store.Delete(s.ID); err != nil {
+			log.Errorf("Cannot revoke session: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	updateSession(s, info)
+	s.LastSeenAt = now
+	s.RefreshAt = now.Add(helios.refreshInterval)
+	s.ExpiresAt = now.Add(helios.jwtConfig.Expiration)
+
+	// sessions revoked during the renewal stay revoked
+	if err := helios.store.Update(s); err != nil {
+		if err == session.ErrNotFound {
+			log.Debugf("Session of %q was revoked while renewing it", s.User)
+			return
+		}
+		log.Errorf("Cannot save renewed session: %v", err)
+		return
+	}
+	log.Debugf("Renewed session of %q", s.User)
+}
+
+// renewalGrace is how long the result of a cookie renewal is reused by requests still sending the previous cookie
+const renewalGrace = 30 * time.Second
+
+// cookieRenewal is the refresh of a cookie session, shared by the concurrent requests sending the cookie.
+// Providers rotating refresh tokens reject a token used twice, which would end the session
+type cookieRenewal struct {
+	done     chan struct{}
+	value    string
+	exp      time.Time
+	identity Identity
+	// ended is set when the identity provider refused to renew the session
+	ended bool
+}
+
+// renewCookie refreshes a cookie session and re-issues the cookie
+func (helios Helios) renewCookie(w http.ResponseWriter, r *http.Request, creds *credentials) bool {
+	key := "cookie:" + creds.claims.RefreshToken
+	renewal := &cookieRenewal{done: make(chan struct{})}
+	if running, loaded := helios.renewing.LoadOrStore(key, renewal); loaded {
+		renewal = running.(*cookieRenewal)
+		<-renewal.done
+	} else {
+		helios.refreshCookie(creds, renewal)
+		close(renewal.done)
+		time.AfterFunc(renewalGrace, func() { helios.renewing.Delete(key) })
+	}
+
+	if renewal.ended {
+		helios.clearSessionCookie(w, r)
+		return false
+	}
+	if renewal.value == "" {
+		return true
+	}
+	if err := helios.setSessionCookie(w, r, renewal.value, renewal.exp); err != nil {
+		log.Errorf("Cannot set renewed session cookie: %v", err)
+		return true
+	}
+	creds.identity = renewal.identity
+	return true
+}
+
+// refreshCookie re-validates a cookie session with the identity provider and issues the renewed cookie
+func (helios Helios) refreshCookie(creds *credentials, renewal *cookieRenewal) {
+	claims := creds.claims
+	refreshToken, err := decryptString(helios.jwtConfig.Secret, claims.RefreshToken)
+	if err == nil {
+		var info providers.UserInfo
+		if info, err = helios.refresh(claims.Provider, refreshToken); err == nil {
+			if info.Groups == nil {
+				info.Groups = claims.Groups
+			}
+			if info.IDToken == "" {
+				info.IDToken = claims.IDToken
+			}
+
+			value, exp, err := helios.newSession(claims.Provider, info, claims.authTime())
+			if err != nil {
+				log.Errorf("Cannot issue renewed session: %v", err)
+				return
+			}
+			renewal.value, renewal.exp = value, exp
+			renewal.identity = Identity{
+				Email:       info.Email,
+				Groups:      info.Groups,
+				AccessToken: helios.cookieAccessToken(info.AccessToken),
+				Provider:    claims.Provider,
+			}
+			log.Debugf("Renewed session of %q", info.Email)
+			return
+		}
+	}
+
+	log.Warnf("Cannot renew session of %q: %v", claims.Subject, err)
+	sessionEnded(claims.Subject, ExpiryRenewalFailed)
+	renewal.ended = true
+}
+
+// refresh re-validates a user with the identity provider the session was created with
+func (helios Helios) refresh(name, refreshToken string) (providers.UserInfo, error) {
+	provider, ok := helios.provider(name)
+	if !ok {
+		return providers.UserInfo{}, fmt.Errorf("unknown identity provider %q", name)
+	}
+	return provider.Refresh(refreshToken)
+}
+
+// touchSession records activity once a session is past half its idle window
+func (helios Helios) touchSession(s *session.Session) {
+	if helios.idleTimeout == 0 || time.Since(s.LastSeenAt) < helios.idleTimeout/2 {
+		return
+	}
+
+	s.LastSeenAt = time.Now()
+	// sessions revoked since the request loaded them stay revoked
+	if err := helios.store.Update(s); err != nil && err != session.ErrNotFound {
+		log.Errorf("Cannot save session activity: %v", err)
+	}
+}
+
+// touchCookie re-issues the session cookie once it is past half its idle window
+func (helios Helios) touchCookie(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	if helios.idleTimeout == 0 || time.Since(time.Unix(claims.IssuedAt, 0)) < helios.idleTimeout/2 {
+		return
+	}
+
+	authTime := claims.authTime()
+	claims.AuthTime = authTime.Unix()
+	value, err := helios.issueCookieToken(claims)
+	if err != nil {
+		log.Errorf("Cannot re-issue session cookie: %v", err)
+		return
+	}
+	if err := helios.setSessionCookie(w, r, value, helios.cookieExpiration(authTime, time.Unix(claims.ExpiresAt, 0))); err != nil {
+		log.Errorf("Cannot re-issue session cookie: %v", err)
+	}
+}
+
+// updateSession copies refreshed user info into a session
+func updateSession(s *session.Session, info providers.UserInfo) {
+	if info.Groups != nil {
+		s.Groups = info.Groups
+	}
+	s.AccessToken = info.AccessToken
+	if info.RefreshToken != "" {
+		s.RefreshToken = info.RefreshToken
+	}
+	if info.IDToken != "" {
+		s.IDToken = info.IDToken
+	}
+	if info.SessionID != "" {
+		s.ProviderSessionID = info.SessionID
+	}
+}
@@ -0,0 +1,176 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// SAMLLoginPath starts the login with the SAML provider named by the idp query parameter and sends users back to rd
+const SAMLLoginPath = "/.well-known/saml/login"
+
+// SAMLACSPath is the assertion consumer service SAML identity providers post assertions to
+const SAMLACSPath = "/.well-known/saml/acs"
+
+// SAMLMetadataPath serves the SAML service provider metadata. The idp query parameter names the provider when
+// several use SAML
+const SAMLMetadataPath = "/.well-known/saml/metadata"
+
+const (
+	// samlStatePrefix prefixes the pending SAML logins kept with the one-time codes
+	samlStatePrefix = codePrefix + "saml:"
+	// samlLoginExpiration leaves users time to sign in at the identity provider
+	samlLoginExpiration = 10 * time.Minute
+)
+
+// samlCookieName names the cookie binding a pending SAML login to the browser that started it
+func (helios Helios) samlCookieName() string {
+	return helios.cookie.Name + "_saml"
+}
+
+// samlCookie returns the login binding cookie. Identity providers post assertions cross-site, so the cookie must be
+// SameSite=None to be sent along
+func (helios Helios) samlCookie(value string, exp time.Time) *http.Cookie {
+	c := &http.Cookie{
+		Name:     helios.samlCookieName(),
+		Value:    value,
+		Expires:  exp,
+		Path:     SAMLACSPath,
+		Secure:   helios.cookie.Secure,
+		HttpOnly: true,
+	}
+	if c.Secure {
+		c.SameSite = http.SameSiteNoneMode
+	}
+	return c
+}
+
+// SAMLLoginHandler keeps the login state server-side and sends users to the SAML identity provider with a short
+// handle as RelayState. The handle is also set in a cookie so assertions are only accepted by the browser that
+// started the login
+func (helios Helios) SAMLLoginHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("idp")
+	provider, ok := helios.provider(name)
+	if _, isSAML := provider.OAuth2Provider.(providers.MetadataProvider); !ok || !isSAML {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rd := r.URL.Query().Get("rd")
+	if !helios.loginRedirect(r, rd) {
+		log.Warnf("Rejecting SAML login: invalid redirect url %q", rd)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	handle, err := session.NewID()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	exp := now.Add(samlLoginExpiration)
+	err = helios.codes.Save(&session.Session{
+		ID:          samlStatePrefix + handle,
+		Provider:    provider.Name,
+		RedirectURL: rd,
+		CreatedAt:   now,
+		ExpiresAt:   exp,
+	})
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, helios.samlCookie(handle, exp))
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := provider.GetLoginURL(scheme+"://"+r.Host+SAMLACSPath, handle)
+	log.Debugf("Redirecting to %s", url)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// loginRedirect tells if users can be sent back to rd once logged in: a path, a URL of the current host or of a
+// host allowed to receive sessions
+func (helios Helios) loginRedirect(r *http.Request, rd string) bool {
+	if strings.HasPrefix(rd, "/") {
+		return !strings.HasPrefix(rd, "//") && !strings.HasPrefix(rd, "/\\")
+	}
+	u, err := url.Parse(rd)
+	if err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host == r.Host {
+		return true
+	}
+	_, err = helios.validateRedirect(rd)
+	return err == nil
+}
+
+// SAMLACSHandler logs users in with the assertion posted by a SAML identity provider.
+// The RelayState must be the handle of a login started by the same browser, each login is completed once
+func (helios Helios) SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Debug("Handling SAML assertion")
+
+	handle := r.PostFormValue("RelayState")
+	cookie, err := r.Cookie(helios.samlCookieName())
+	if err != nil || handle == "" || !hmac.Equal([]byte(cookie.Value), []byte(handle)) {
+		log.Warn("Rejecting SAML assertion: the login was not started by this browser")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, helios.samlCookie("", time.Unix(0, 0)))
+
+	state, err := helios.codes.Load(samlStatePrefix + handle)
+	if err != nil {
+		log.Warnf("Rejecting SAML assertion: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := helios.codes.Delete(state.ID); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	helios.callback(w, r, state.Provider, state.RedirectURL, true)
+}
+
+// SAMLMetadataHandler serves the metadata SAML identity providers are configured with
+func (helios Helios) SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("idp")
+	for _, p := range helios.providers {
+		sp, ok := p.OAuth2Provider.(providers.MetadataProvider)
+		if !ok || (name != "" && p.Name != name) {
+			continue
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		metadata, err := sp.Metadata(scheme + "://" + r.Host + SAMLACSPath)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		_, _ = w.Write(metadata)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var sessionsBucket = []byte("sessions")
+
+// purgeInterval is how often saving a session also drops the expired ones
+const purgeInterval = time.Minute
+
+// indexBuckets map session indexes to the buckets holding them
+var indexBuckets = map[string][]byte{
+	indexUser:            []byte("users"),
+	indexSubject:         []byte("subjects"),
+	indexProviderSession: []byte("provider_sessions"),
+}
+
+// FileStore persists sessions in a BoltDB file so they survive restarts
+type FileStore struct {
+	db *bolt.DB
+
+	mu       sync.Mutex
+	purgedAt time.Time
+}
+
+// NewFileStore opens or creates a BoltDB session file
+func NewFileStore(path string) (*FileStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sessionsBucket); err != nil {
+			return err
+		}
+		for _, bucket := range indexBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &FileStore{db: db}, nil
+}
+
+// Save creates or updates a session
+func (f *FileStore) Save(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return f.db.Update(func(tx *bolt.Tx) error {
+		// purge expired sessions and codes so the file does not grow forever
+		if f.purgeDue(time.Now()) {
+			if err := purgeExpired(tx); err != nil {
+				return err
+			}
+		}
+		return putSession(tx, s, b)
+	})
+}
+
+// Update saves a session only if it still exists
+func (f *FileStore) Update(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return f.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(sessionsBucket).Get([]byte(s.ID)) == nil {
+			return ErrNotFound
+		}
+		return putSession(tx, s, b)
+	})
+}
+
+// putSession writes an encoded session and indexes it so sessions can be revoked together
+func putSession(tx *bolt.Tx, s *Session, b []byte) error {
+	if err := tx.Bucket(sessionsBucket).Put([]byte(s.ID), b); err != nil {
+		return err
+	}
+	for index, key := range s.indexes() {
+		ids, err := tx.Bucket(indexBuckets[index]).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		if err := ids.Put([]byte(s.ID), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load returns a live session or ErrNotFound
+func (f *FileStore) Load(id string) (*Session, error) {
+	var s *Session
+	err := f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket).Get([]byte(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		s = &Session{}
+		return json.Unmarshal(b, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Expired() {
+		_ = f.Delete(id)
+		return nil, ErrNotFound
+	}
+
+	return s, nil
+}
+
+// Delete revokes a single session
+func (f *FileStore) Delete(id string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return deleteSession(tx, []byte(id))
+	})
+}
+
+// DeleteUser revokes every session of a user
+func (f *FileStore) DeleteUser(user string) error {
+	return f.deleteIndexed(indexUser, user)
+}
+
+// DeleteSubject revokes every session of a subject of the named identity provider
+func (f *FileStore) DeleteSubject(provider, sub string) error {
+	return f.deleteIndexed(indexSubject, providerKey(provider, sub))
+}
+
+// DeleteProviderSession revokes every session created from a session of the named identity provider
+func (f *FileStore) DeleteProviderSession(provider, sid string) error {
+	return f.deleteIndexed(indexProviderSession, providerKey(provider, sid))
+}
+
+func (f *FileStore) deleteIndexed(index, key string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(indexBuckets[index]).Bucket([]byte(key))
+		if ids == nil {
+			return nil
+		}
+
+		// collect first, deleting sessions updates the index being iterated
+		var sessions [][]byte
+		err := ids.ForEach(func(id, _ []byte) error {
+			sessions = append(sessions, append([]byte(nil), id...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range sessions {
+			if err := deleteSession(tx, id); err != nil {
+				return err
+			}
+		}
+
+		// the index is dropped along its last session, unless it held stale entries
+		if tx.Bucket(indexBuckets[index]).Bucket([]byte(key)) == nil {
+			return nil
+		}
+		return tx.Bucket(indexBuckets[index]).DeleteBucket([]byte(key))
+	})
+}
+
+// purgeDue tells if expired sessions should be purged, at most once per purgeInterval
+func (f *FileStore) purgeDue(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.purgedAt) < purgeInterval {
+		return false
+	}
+	f.purgedAt = now
+	return true
+}
+
+// purgeExpired removes expired sessions and their index entries
+func purgeExpired(tx *bolt.Tx) error {
+	var expired [][]byte
+	err := tx.Bucket(sessionsBucket).ForEach(func(id, b []byte) error {
+		var s Session
+		if err := json.Unmarshal(b, &s); err != nil || s.Expired() {
+			expired = append(expired, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		if err := deleteSession(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSession removes a session and its index entries
+func deleteSession(tx *bolt.Tx, id []byte) error {
+	sessions := tx.Bucket(sessionsBucket)
+	b := sessions.Get(id)
+	if b == nil {
+		return nil
+	}
+
+	var s Session
+	if err := json.Unmarshal(b, &s); err == nil {
+		for index, key := range s.indexes() {
+			ids := tx.Bucket(indexBuckets[index]).Bucket([]byte(key))
+			if ids == nil {
+				continue
+			}
+			if err := ids.Delete(id); err != nil {
+				return err
+			}
+			// drop indexes left without sessions
+			if k, _ := ids.Cursor().First(); k == nil {
+				if err := tx.Bucket(indexBuckets[index]).DeleteBucket([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return sessions.Delete(id)
+}
+
+// Close releases the resources held by the store
+func (f *FileStore) Close() error {
+	return f.db.Close()
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"sync"
+)
+
+// MemoryStore keeps sessions in memory. Sessions are lost on restart
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+// NewMemoryStore creates an in-memory session store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]Session)}
+}
+
+// Save creates or updates a session
+func (m *MemoryStore) Save(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// purge expired sessions so the map does not grow forever
+	for id, stored := range m.sessions {
+		if stored.Expired() {
+			delete(m.sessions, id)
+		}
+	}
+
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+// Update saves a session only if it still exists
+func (m *MemoryStore) Update(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.sessions[s.ID]; !ok || stored.Expired() {
+		return ErrNotFound
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+// Load returns a live session or ErrNotFound
+func (m *MemoryStore) Load(id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.Expired() {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+// Delete revokes a single session
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteUser revokes every session of a user
+func (m *MemoryStore) DeleteUser(user string) error {
+	return m.deleteIndexed(indexUser, user)
+}
+
+// DeleteSubject revokes every session of a subject of the named identity provider
+func (m *MemoryStore) DeleteSubject(provider, sub string) error {
+	return m.deleteIndexed(indexSubject, providerKey(provider, sub))
+}
+
+// DeleteProviderSession revokes every session created from a session of the named identity provider
+func (m *MemoryStore) DeleteProviderSession(provider, sid string) error {
+	return m.deleteIndexed(indexProviderSession, providerKey(provider, sid))
+}
+
+func (m *MemoryStore) deleteIndexed(index, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.indexes()[index] == key {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Close releases the resources held by the store
+func (m *MemoryStore) Close() error {
+	return nil
+}
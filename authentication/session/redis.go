@@ -0,0 +1,190 @@
+package session
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const redisPrefix = "helios:"
+
+// extendTTL sets the TTL of a key in milliseconds, unless the key already lives longer
+var extendTTL = redis.NewScript(`
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return 0`)
+
+// RedisStore keeps sessions in Redis so several Helios instances can share them
+type RedisStore struct {
+	client *redis.Client
+}
+
+// RedisConfig Redis connection settings
+type RedisConfig struct {
+	Address  string
+	Password string
+	DB       int
+}
+
+// NewRedisStore connects to Redis and returns a session store
+func NewRedisStore(conf RedisConfig) (*RedisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     conf.Address,
+		Password: conf.Password,
+		DB:       conf.DB,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &RedisStore{client: client}, nil
+}
+
+func sessionKey(id string) string {
+	return redisPrefix + "session:" + id
+}
+
+func indexKey(index, key string) string {
+	return redisPrefix + index + ":" + key
+}
+
+// Save creates or updates a session
+func (r *RedisStore) Save(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(s.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	pipe := r.client.TxPipeline()
+	queueSave(pipe, s, b, ttl)
+	_, err = pipe.Exec()
+
+	return err
+}
+
+// Update saves a session only if it still exists. The session key is watched, so a session revoked while it is
+// being updated is not written back
+func (r *RedisStore) Update(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(s.ExpiresAt)
+	if ttl <= 0 {
+		return ErrNotFound
+	}
+
+	return r.client.Watch(func(tx *redis.Tx) error {
+		n, err := tx.Exists(sessionKey(s.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			queueSave(pipe, s, b, ttl)
+			return nil
+		})
+		if err == redis.TxFailedErr {
+			return ErrNotFound
+		}
+		return err
+	}, sessionKey(s.ID))
+}
+
+// queueSave queues the commands writing an encoded session. Sessions are indexed so they can be revoked together,
+// indexes live as long as their longest session
+func queueSave(pipe redis.Pipeliner, s *Session, b []byte, ttl time.Duration) {
+	pipe.Set(sessionKey(s.ID), b, ttl)
+	for index, key := range s.indexes() {
+		pipe.SAdd(indexKey(index, key), s.ID)
+		extendTTL.Eval(pipe, []string{indexKey(index, key)}, int64(ttl/time.Millisecond))
+	}
+}
+
+// Load returns a live session or ErrNotFound
+func (r *RedisStore) Load(id string) (*Session, error) {
+	b, err := r.client.Get(sessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Expired() {
+		return nil, ErrNotFound
+	}
+
+	return s, nil
+}
+
+// Delete revokes a single session
+func (r *RedisStore) Delete(id string) error {
+	s, err := r.Load(id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Del(sessionKey(id))
+	for index, key := range s.indexes() {
+		pipe.SRem(indexKey(index, key), id)
+	}
+	_, err = pipe.Exec()
+
+	return err
+}
+
+// DeleteUser revokes every session of a user
+func (r *RedisStore) DeleteUser(user string) error {
+	return r.deleteIndexed(indexUser, user)
+}
+
+// DeleteSubject revokes every session of a subject of the named identity provider
+func (r *RedisStore) DeleteSubject(provider, sub string) error {
+	return r.deleteIndexed(indexSubject, providerKey(provider, sub))
+}
+
+// DeleteProviderSession revokes every session created from a session of the named identity provider
+func (r *RedisStore) DeleteProviderSession(provider, sid string) error {
+	return r.deleteIndexed(indexProviderSession, providerKey(provider, sid))
+}
+
+func (r *RedisStore) deleteIndexed(index, key string) error {
+	ids, err := r.client.SMembers(indexKey(index, key)).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	keys = append(keys, indexKey(index, key))
+
+	return r.client.Del(keys...).Err()
+}
+
+// Close releases the resources held by the store
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,94 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when a session does not exist, expired or was revoked
+var ErrNotFound = errors.New("session not found")
+
+// Session represents a server-side user session
+type Session struct {
+	ID           string    `json:"id"`
+	User         string    `json:"user"`
+	Provider     string    `json:"provider,omitempty"`
+	Groups       []string  `json:"groups,omitempty"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+	RefreshAt    time.Time `json:"refresh_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	// Subject is the identity provider subject of the user
+	Subject string `json:"sub,omitempty"`
+	// ProviderSessionID is the identity provider session the session was created from
+	ProviderSessionID string `json:"sid,omitempty"`
+	// RedirectURL is where a pending login sends the user back to
+	RedirectURL string `json:"rd,omitempty"`
+}
+
+// Session indexes, sessions can be revoked by any of them
+const (
+	indexUser            = "user"
+	indexSubject         = "sub"
+	indexProviderSession = "sid"
+)
+
+// indexes returns the index keys of the session. Pending logins and codes without a user are not indexed
+func (s *Session) indexes() map[string]string {
+	idx := map[string]string{}
+	if s.User != "" {
+		idx[indexUser] = s.User
+	}
+	if s.Subject != "" {
+		idx[indexSubject] = providerKey(s.Provider, s.Subject)
+	}
+	if s.ProviderSessionID != "" {
+		idx[indexProviderSession] = providerKey(s.Provider, s.ProviderSessionID)
+	}
+	return idx
+}
+
+// providerKey scopes a subject or session of an identity provider to that provider, other providers may issue the
+// same values
+func providerKey(provider, key string) string {
+	return provider + "\n" + key
+}
+
+// Expired checks if the session lifetime is over
+func (s *Session) Expired() bool {
+	return !s.ExpiresAt.After(time.Now())
+}
+
+// Store persists sessions so they can be looked up and revoked
+type Store interface {
+	// Save creates or updates a session
+	Save(s *Session) error
+	// Update saves a session only if it still exists, it returns ErrNotFound when the session was revoked meanwhile
+	Update(s *Session) error
+	// Load returns a live session or ErrNotFound
+	Load(id string) (*Session, error)
+	// Delete revokes a single session
+	Delete(id string) error
+	// DeleteUser revokes every session of a user
+	DeleteUser(user string) error
+	// DeleteSubject revokes every session of a subject of the named identity provider
+	DeleteSubject(provider, sub string) error
+	// DeleteProviderSession revokes every session created from a session of the named identity provider
+	DeleteProviderSession(provider, sid string) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// NewID generates a random opaque session ID
+func NewID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
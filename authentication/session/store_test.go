@@ -0,0 +1,214 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func testStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "helios-sessions")
+	assert.NoError(t, err)
+	file, err := NewFileStore(filepath.Join(dir, "sessions.db"))
+	assert.NoError(t, err)
+
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	redis, err := NewRedisStore(RedisConfig{Address: mr.Addr()})
+	assert.NoError(t, err)
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   file,
+		"redis":  redis,
+	}
+
+	return stores, func() {
+		for _, store := range stores {
+			_ = store.Close()
+		}
+		mr.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestStore_SaveLoad(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, store := range stores {
+		id, err := NewID()
+		assert.NoError(t, err)
+
+		s := &Session{
+			ID:        id,
+			User:      "t@test",
+			Groups:    []string{"admins"},
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		assert.NoError(t, store.Save(s), name)
+
+		loaded, err := store.Load(id)
+		assert.NoError(t, err, name)
+		assert.Equal(t, s.User, loaded.User, name)
+		assert.Equal(t, s.Groups, loaded.Groups, name)
+
+		_, err = store.Load("unknown")
+		assert.Equal(t, ErrNotFound, err, name)
+	}
+}
+
+func TestStore_Expired(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, store := range stores {
+		s := &Session{
+			ID:        "expired",
+			User:      "t@test",
+			ExpiresAt: time.Now().Add(-time.Minute),
+		}
+		assert.NoError(t, store.Save(s), name)
+
+		_, err := store.Load(s.ID)
+		assert.Equal(t, ErrNotFound, err, name)
+	}
+}
+
+func TestStore_Update(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, store := range stores {
+		s := &Session{ID: "a1", User: "a@test", ExpiresAt: time.Now().Add(time.Hour)}
+		assert.NoError(t, store.Save(s), name)
+
+		s.Groups = []string{"admins"}
+		assert.NoError(t, store.Update(s), name)
+		loaded, err := store.Load(s.ID)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{"admins"}, loaded.Groups, name)
+
+		// revoked sessions are not written back
+		assert.NoError(t, store.Delete(s.ID), name)
+		assert.Equal(t, ErrNotFound, store.Update(s), name)
+		_, err = store.Load(s.ID)
+		assert.Equal(t, ErrNotFound, err, name)
+	}
+}
+
+func TestStore_Revoke(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, store := range stores {
+		expires := time.Now().Add(time.Hour)
+		sessions := []*Session{
+			{ID: "a1", User: "a@test", ExpiresAt: expires},
+			{ID: "a2", User: "a@test", ExpiresAt: expires},
+			{ID: "b1", User: "b@test", ExpiresAt: expires},
+		}
+		for _, s := range sessions {
+			assert.NoError(t, store.Save(s), name)
+		}
+
+		assert.NoError(t, store.Delete("b1"), name)
+		_, err := store.Load("b1")
+		assert.Equal(t, ErrNotFound, err, name)
+		// revoking twice is not an error
+		assert.NoError(t, store.Delete("b1"), name)
+
+		assert.NoError(t, store.DeleteUser("a@test"), name)
+		for _, id := range []string{"a1", "a2"} {
+			_, err := store.Load(id)
+			assert.Equal(t, ErrNotFound, err, name)
+		}
+	}
+}
+
+func TestStore_RevokeProviderSessions(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, store := range stores {
+		expires := time.Now().Add(time.Hour)
+		sessions := []*Session{
+			{ID: "a1", User: "a@test", Provider: "idp", Subject: "a", ProviderSessionID: "s1", ExpiresAt: expires},
+			{ID: "a2", User: "a@test", Provider: "idp", Subject: "a", ProviderSessionID: "s2", ExpiresAt: expires},
+			{ID: "a3", User: "a@test", Provider: "idp", Subject: "a", ProviderSessionID: "s3", ExpiresAt: expires},
+			{ID: "b1", User: "b@test", Provider: "idp", Subject: "b", ProviderSessionID: "s4", ExpiresAt: expires},
+			// another provider may issue the same subject and session IDs
+			{ID: "o1", User: "o@test", Provider: "other", Subject: "a", ProviderSessionID: "s1", ExpiresAt: expires},
+		}
+		for _, s := range sessions {
+			assert.NoError(t, store.Save(s), name)
+		}
+
+		assert.NoError(t, store.DeleteProviderSession("idp", "s1"), name)
+		_, err := store.Load("a1")
+		assert.Equal(t, ErrNotFound, err, name)
+		_, err = store.Load("a2")
+		assert.NoError(t, err, name)
+
+		assert.NoError(t, store.DeleteSubject("idp", "a"), name)
+		for _, id := range []string{"a2", "a3"} {
+			_, err := store.Load(id)
+			assert.Equal(t, ErrNotFound, err, name)
+		}
+		for _, id := range []string{"b1", "o1"} {
+			_, err := store.Load(id)
+			assert.NoError(t, err, name)
+		}
+	}
+}
+
+func TestRedisStore_IndexExpiry(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+	store, err := NewRedisStore(RedisConfig{Address: mr.Addr()})
+	assert.NoError(t, err)
+	defer store.Close()
+
+	// a newer and shorter session does not shorten the index of older sessions
+	assert.NoError(t, store.Save(&Session{ID: "long", User: "a@test", ExpiresAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, store.Save(&Session{ID: "short", User: "a@test", ExpiresAt: time.Now().Add(time.Minute)}))
+	assert.True(t, mr.TTL(indexKey(indexUser, "a@test")) > 59*time.Minute)
+	mr.FastForward(2 * time.Minute)
+
+	assert.NoError(t, store.DeleteUser("a@test"))
+	_, err = store.Load("long")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStore_Purge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(filepath.Join(dir, "sessions.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	expired := &Session{ID: "old", User: "a@test", Provider: "idp", Subject: "a", ExpiresAt: time.Now().Add(-time.Minute)}
+	assert.NoError(t, store.Save(expired))
+	assert.NoError(t, store.Save(&Session{ID: "code:1", ExpiresAt: time.Now().Add(-time.Minute)}))
+
+	// the next save after the purge interval drops expired sessions, codes and their indexes
+	store.purgedAt = time.Time{}
+	assert.NoError(t, store.Save(&Session{ID: "new", User: "b@test", ExpiresAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(sessionsBucket).Get([]byte("old")))
+		assert.Nil(t, tx.Bucket(sessionsBucket).Get([]byte("code:1")))
+		assert.NotNil(t, tx.Bucket(sessionsBucket).Get([]byte("new")))
+		assert.Nil(t, tx.Bucket(indexBuckets[indexUser]).Bucket([]byte("a@test")))
+		assert.Nil(t, tx.Bucket(indexBuckets[indexSubject]).Bucket([]byte(providerKey("idp", "a"))))
+		return nil
+	}))
+}
@@ -0,0 +1,211 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyakimov/helios/authentication/providers"
+	"github.com/cyakimov/helios/authentication/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// SSO endpoints
+const (
+	// SSOAuthorizePath is served on the auth domain and hands a one-time code to the requesting host
+	SSOAuthorizePath = "/.well-known/sso/authorize"
+	// SSORedeemPath is served on every host and exchanges a one-time code for a session cookie
+	SSORedeemPath = "/.well-known/sso/redeem"
+)
+
+const (
+	codePrefix     = "code:"
+	codeExpiration = time.Minute
+)
+
+// ErrRedirect is returned when a redirect URL points to a host Helios does not protect
+var ErrRedirect = errors.New("invalid redirect url")
+
+// SSOConfig single sign-on configuration
+type SSOConfig struct {
+	// AuthDomain is the host every login goes through
+	AuthDomain string
+	// AllowedHosts are the hosts that can receive sessions from the auth domain
+	AllowedHosts []string
+}
+
+func isCode(id string) bool {
+	return strings.HasPrefix(id, codePrefix)
+}
+
+// ssoAuthorizeURL returns the auth domain URL that logs users in and sends them back to rd.
+// The providers accepted by the middleware are passed along
+func (helios Helios) ssoAuthorizeURL(scheme, rd string) string {
+	params := url.Values{"rd": {rd}}
+	if len(helios.allowed) > 0 {
+		params["idp"] = helios.allowed
+	}
+	return scheme + "://" + helios.sso.AuthDomain + SSOAuthorizePath + "?" + params.Encode()
+}
+
+// validateRedirect makes sure rd points to a host protected by Helios
+func (helios Helios) validateRedirect(rd string) (*url.URL, error) {
+	u, err := url.Parse(rd)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, ErrRedirect
+	}
+
+	for _, host := range helios.sso.AllowedHosts {
+		if u.Host == host || u.Hostname() == host {
+			return u, nil
+		}
+	}
+
+	return nil, ErrRedirect
+}
+
+// SSOAuthorizeHandler logs users in on the auth domain and hands a one-time code back to the requesting host
+func (helios Helios) SSOAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if helios.sso.AuthDomain == "" || r.Host != helios.sso.AuthDomain {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	target, err := helios.validateRedirect(r.URL.Query().Get("rd"))
+	if err != nil {
+		log.Warnf("Rejecting SSO request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	helios = helios.ForProviders(r.URL.Query()["idp"]...)
+	creds, err := helios.authenticate(r)
+	if err == nil && !helios.allows(creds.identity.Provider) {
+		err = ErrUnauthorized
+	}
+	if err == nil && !helios.renew(w, r, creds) {
+		err = ErrUnauthorized
+	}
+	if err != nil || (creds.claims == nil && creds.session == nil) {
+		// log in on the auth domain first, the callback brings the user back here
+		helios.login(w, r, r.URL.RequestURI())
+		return
+	}
+
+	if helios.cookie.Domain != "" {
+		// the session cookie is already shared with the target host
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	code, err := helios.issueCode(creds)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	redeem := url.URL{
+		Scheme:   target.Scheme,
+		Host:     target.Host,
+		Path:     SSORedeemPath,
+		RawQuery: url.Values{"code": {code}, "rd": {target.String()}}.Encode(),
+	}
+	log.Debugf("Handing session of %q to %s", creds.identity.Email, target.Host)
+
+	http.Redirect(w, r, redeem.String(), http.StatusFound)
+}
+
+// SSORedeemHandler exchanges a one-time code issued by the auth domain for a session cookie
+func (helios Helios) SSORedeemHandler(w http.ResponseWriter, r *http.Request) {
+	target, err := helios.validateRedirect(r.URL.Query().Get("rd"))
+	if err != nil || target.Host != r.Host {
+		log.Warn("Rejecting SSO code: invalid redirect url")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	// codes handed to command line clients are only exchanged for tokens, SAML login states are not codes
+	if !isCode(code) || strings.HasPrefix(code, cliCodePrefix) || strings.HasPrefix(code, samlStatePrefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s, err := helios.codes.Load(code)
+	if err != nil {
+		log.Warnf("Rejecting SSO code: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// codes can only be used once
+	if err := helios.codes.Delete(code); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	profile := providers.UserInfo{
+		Email:        s.User,
+		Groups:       s.Groups,
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		IDToken:      s.IDToken,
+		Subject:      s.Subject,
+		SessionID:    s.ProviderSessionID,
+	}
+	value, exp, err := helios.newSession(s.Provider, profile, s.CreatedAt)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := helios.setSessionCookie(w, r, value, exp); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// issueCode stores the session behind a short-lived one-time code
+func (helios Helios) issueCode(creds *credentials) (string, error) {
+	id, err := session.NewID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	code := &session.Session{
+		ID:        codePrefix + id,
+		User:      creds.identity.Email,
+		Groups:    creds.identity.Groups,
+		Provider:  creds.identity.Provider,
+		CreatedAt: now,
+		ExpiresAt: now.Add(codeExpiration),
+	}
+
+	switch {
+	case creds.session != nil:
+		code.AccessToken = creds.session.AccessToken
+		code.RefreshToken = creds.session.RefreshToken
+		code.IDToken = creds.session.IDToken
+		code.Subject = creds.session.Subject
+		code.ProviderSessionID = creds.session.ProviderSessionID
+		code.CreatedAt = creds.session.CreatedAt
+	case creds.claims != nil:
+		code.AccessToken = creds.claims.AccessToken
+		code.IDToken = creds.claims.IDToken
+		code.CreatedAt = creds.claims.authTime()
+		if creds.claims.RefreshToken != "" {
+			if code.RefreshToken, err = decryptString(helios.jwtConfig.Secret, creds.claims.RefreshToken); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return code.ID, helios.codes.Save(code)
+}
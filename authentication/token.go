@@ -7,17 +7,57 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
+// Claims represents the claims of a Helios session token
+type Claims struct {
+	jwt.StandardClaims
+	Groups      []string `json:"groups,omitempty"`
+	AccessToken string   `json:"access_token,omitempty"`
+	// RefreshToken is the identity provider refresh token, encrypted with the JWT secret
+	RefreshToken string `json:"rt,omitempty"`
+	// RefreshAt is when the session must be re-validated with the identity provider
+	RefreshAt int64 `json:"rat,omitempty"`
+	// AuthTime is when the user authenticated with the identity provider
+	AuthTime int64 `json:"auth_time,omitempty"`
+	// IDToken is the identity provider id_token, sent back as a hint on logout
+	IDToken string `json:"idt,omitempty"`
+	// Provider is the name of the identity provider the user logged in with
+	Provider string `json:"idp,omitempty"`
+}
+
+// Identity returns the user identity held by the claims
+func (c *Claims) Identity() Identity {
+	return Identity{
+		Email:       c.Subject,
+		Groups:      c.Groups,
+		AccessToken: c.AccessToken,
+		Provider:    c.Provider,
+	}
+}
+
+// authTime returns when the user authenticated, tokens issued without auth_time count from their issue date
+func (c *Claims) authTime() time.Time {
+	if c.AuthTime == 0 {
+		return time.Unix(c.IssuedAt, 0)
+	}
+	return time.Unix(c.AuthTime, 0)
+}
+
 // IssueJWTWithSecret issues and sign a JWT with a secret
 func IssueJWTWithSecret(secret, email string, expires time.Time) (string, error) {
+	return IssueJWTWithClaims(secret, &Claims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expires.Unix(),
+			Subject:   email,
+		},
+	})
+}
+
+// IssueJWTWithClaims issues and sign a JWT with a secret and a given set of claims
+func IssueJWTWithClaims(secret string, claims *Claims) (string, error) {
 	key := []byte(secret)
 
-	// Create the Claims
-	claims := &jwt.StandardClaims{
-		ExpiresAt: expires.Unix(),
-		Subject:   email,
-		Issuer:    "Helios",
-		IssuedAt:  time.Now().Unix(),
-	}
+	claims.Issuer = "Helios"
+	claims.IssuedAt = time.Now().Unix()
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(key)
@@ -25,7 +65,15 @@ func IssueJWTWithSecret(secret, email string, expires time.Time) (string, error)
 
 // ValidateJWTWithSecret checks JWT signing algorithm as well the signature
 func ValidateJWTWithSecret(secret, tokenString string) bool {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+	_, err := ParseJWTWithSecret(secret, tokenString)
+	return err == nil
+}
+
+// ParseJWTWithSecret validates a JWT and returns its claims.
+// Claims are also returned along the error of an expired token
+func ParseJWTWithSecret(secret, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		// Validate the alg
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -34,5 +82,21 @@ func ValidateJWTWithSecret(secret, tokenString string) bool {
 		return []byte(secret), nil
 	})
 
-	return err == nil && token != nil && token.Valid
+	if isExpired(err) {
+		return claims, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, ErrUnauthorized
+	}
+
+	return claims, nil
+}
+
+// isExpired checks if a JWT was rejected only because it expired
+func isExpired(err error) bool {
+	ve, ok := err.(*jwt.ValidationError)
+	return ok && ve.Errors == jwt.ValidationErrorExpired
 }
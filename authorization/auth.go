@@ -1,6 +1,8 @@
 package authorization
 
 import (
+	"github.com/cyakimov/helios/authentication"
+	"github.com/cyakimov/helios/grpcutil"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
 	"github.com/google/cel-go/common/types"
@@ -8,6 +10,7 @@ import (
 	"github.com/google/cel-go/interpreter/functions"
 	log "github.com/sirupsen/logrus"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/grpc/codes"
 	"net"
 	"net/http"
 	"time"
@@ -46,6 +49,13 @@ func NewAuthorization(expressions []string) *Helios {
 		decls.NewIdent("request.path", decls.String, nil),
 		decls.NewIdent("request.ip", decls.String, nil),
 		decls.NewIdent("request.time", decls.Timestamp, nil),
+		decls.NewIdent("request.tls.client_cert", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("identity.provider", decls.String, nil),
+		decls.NewIdent("identity.email", decls.String, nil),
+		decls.NewIdent("identity.groups", decls.NewListType(decls.String), nil),
+		decls.NewIdent("principal.client_id", decls.String, nil),
+		decls.NewIdent("principal.subject", decls.String, nil),
+		decls.NewIdent("principal.scopes", decls.NewListType(decls.String), nil),
 		decls.NewFunction("network",
 			decls.NewInstanceOverload("network_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String)),
 	))
@@ -93,12 +103,12 @@ func (h *Helios) Middleware(next http.Handler) http.Handler {
 			out, _, err := exp.Eval(context)
 			if err != nil {
 				log.Errorf("Error evaluating expression: %v", err)
-				w.WriteHeader(http.StatusForbidden)
+				forbidden(w, r)
 				return
 			}
 
 			if out.Value() == false {
-				w.WriteHeader(http.StatusForbidden)
+				forbidden(w, r)
 				return
 			}
 		}
@@ -107,15 +117,58 @@ func (h *Helios) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// forbidden rejects a request using the status code expected by the client
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	if grpcutil.IsGRPCRequest(r) {
+		grpcutil.WriteError(w, codes.PermissionDenied, "permission denied")
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+}
+
 func getContext(r *http.Request) map[string]interface{} {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Error(err)
 	}
+	// requests of paths without authentication have no identity
+	identity, _ := authentication.IdentityFromContext(r.Context())
+	// only requests authenticated with a bearer access token have a principal
+	principal, _ := authentication.PrincipalFromContext(r.Context())
+	return map[string]interface{}{
+		"request.host":            r.Host,
+		"request.path":            r.RequestURI,
+		"request.ip":              ip,
+		"request.time":            time.Now().UTC().Format(time.RFC3339),
+		"request.tls.client_cert": clientCertContext(r),
+		"identity.provider":       identity.Provider,
+		"identity.email":          identity.Email,
+		"identity.groups":         identity.Groups,
+		"principal.client_id":     principal.ClientID,
+		"principal.subject":       principal.Subject,
+		"principal.scopes":        nonNil(principal.Scopes),
+	}
+}
+
+// clientCertContext exposes the verified client certificate. Every field is set, empty without certificate
+func clientCertContext(r *http.Request) map[string]interface{} {
+	cert, verified := authentication.ClientCertificateFromRequest(r)
 	return map[string]interface{}{
-		"request.host": r.Host,
-		"request.path": r.RequestURI,
-		"request.ip":   ip,
-		"request.time": time.Now().UTC().Format(time.RFC3339),
+		"verified":    verified,
+		"subject":     cert.Subject,
+		"issuer":      cert.Issuer,
+		"uris":        nonNil(cert.URIs),
+		"emails":      nonNil(cert.Emails),
+		"dns_names":   nonNil(cert.DNSNames),
+		"spiffe_id":   cert.SPIFFEID,
+		"fingerprint": cert.Fingerprint,
+	}
+}
+
+// nonNil returns an empty list instead of nil, so rules can use list functions
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
 	}
+	return values
 }
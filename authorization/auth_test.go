@@ -0,0 +1,42 @@
+package authorization
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelios_Middleware(t *testing.T) {
+	authZ := NewAuthorization([]string{"'engineering' in identity.groups"})
+	mdw := authZ.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	tests := []struct {
+		Groups      []string
+		ContentType string
+		Code        int
+		GRPCStatus  string
+	}{
+		{[]string{"engineering"}, "", http.StatusOK, ""},
+		{[]string{"sales"}, "", http.StatusForbidden, ""},
+		{nil, "", http.StatusForbidden, ""},
+		// gRPC clients ignore HTTP status codes and get PermissionDenied instead
+		{[]string{"sales"}, "application/grpc", http.StatusOK, "7"},
+		{[]string{"engineering"}, "application/grpc", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "http://testing/helloworld.Greeter/SayHello", nil)
+		req.Header.Set("Content-Type", test.ContentType)
+		req = req.WithContext(authentication.WithIdentity(context.Background(),
+			authentication.Identity{Email: "jane@acme.test", Groups: test.Groups}))
+		res := httptest.NewRecorder()
+		mdw.ServeHTTP(res, req)
+
+		assert.Equal(t, test.Code, res.Code)
+		assert.Equal(t, test.GRPCStatus, res.Header().Get("Grpc-Status"))
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// client subcommands, run as helios <command> [arguments]
+var commands = map[string]func(args []string) error{
+	"login": loginCommand,
+	"curl":  curlCommand,
+	"proxy": proxyCommand,
+	"tcp":   tcpCommand,
+}
+
+// loginTimeout is how long users have to log in with their browser
+const loginTimeout = 5 * time.Minute
+
+// sleep waits between device token polls
+var sleep = time.Sleep
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// cachedToken is a token issued to the client, cached per host
+type cachedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// configDir is where tokens are cached, ~/.config/helios unless XDG_CONFIG_HOME is set
+func configDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "helios"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "helios"), nil
+}
+
+func tokensPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tokens.json"), nil
+}
+
+func loadTokens() (map[string]cachedToken, error) {
+	tokens := make(map[string]cachedToken)
+	path, err := tokensPath()
+	if err != nil {
+		return tokens, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return tokens, err
+	}
+	return tokens, json.Unmarshal(b, &tokens)
+}
+
+func saveToken(host string, token cachedToken) error {
+	tokens, err := loadTokens()
+	if err != nil {
+		return err
+	}
+	tokens[host] = token
+
+	path, err := tokensPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// tokenFor returns the cached token of a host
+func tokenFor(host *url.URL) (string, error) {
+	tokens, err := loadTokens()
+	if err != nil {
+		return "", err
+	}
+	token, ok := tokens[host.String()]
+	if !ok || !time.Now().Before(token.ExpiresAt) {
+		return "", fmt.Errorf("not logged in to %s, run: helios login %s", host.Host, host.Host)
+	}
+	return token.Token, nil
+}
+
+// hostURL returns the base URL of a host given with or without scheme, https by default
+func hostURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
+
+// tokenError is returned by the token endpoint, its code is an OAuth2 error
+type tokenError string
+
+func (e tokenError) Error() string {
+	return "login failed: " + string(e)
+}
+
+// requestToken posts a grant to the token endpoint of a host
+func requestToken(host *url.URL, grant url.Values) (authentication.CLIToken, error) {
+	var token authentication.CLIToken
+	res, err := httpClient.PostForm(host.String()+authentication.CLITokenPath, grant)
+	if err != nil {
+		return token, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return token, err
+		}
+		return token, tokenError(body.Error)
+	}
+	if res.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("login failed: %s", res.Status)
+	}
+	return token, json.NewDecoder(res.Body).Decode(&token)
+}
+
+// deviceLogin runs the RFC 8628 device flow, users approve the login from any browser
+func deviceLogin(host *url.URL, out io.Writer) (authentication.CLIToken, error) {
+	var device authentication.DeviceAuthorization
+	res, err := httpClient.PostForm(host.String()+authentication.CLIDeviceCodePath, nil)
+	if err != nil {
+		return authentication.CLIToken{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return authentication.CLIToken{}, fmt.Errorf("cannot start device login: %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&device); err != nil {
+		return authentication.CLIToken{}, err
+	}
+
+	fmt.Fprintf(out, "Open %s and enter the code %s\n", device.VerificationURI, device.UserCode)
+	fmt.Fprintf(out, "or open %s\n", device.VerificationURIComplete)
+
+	interval := time.Duration(device.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		sleep(interval)
+		token, err := requestToken(host, url.Values{
+			"grant_type":  {authentication.DeviceCodeGrantType},
+			"device_code": {device.DeviceCode},
+		})
+		switch err {
+		case tokenError("authorization_pending"):
+			continue
+		case tokenError("slow_down"):
+			interval += 5 * time.Second
+			continue
+		}
+		return token, err
+	}
+	return authentication.CLIToken{}, tokenError("expired_token")
+}
+
+// browserLogin opens the browser of the user, which logs in and hands a one-time code to a loopback callback
+func browserLogin(host *url.URL, out io.Writer) (authentication.CLIToken, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return authentication.CLIToken{}, err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return authentication.CLIToken{}, err
+	}
+	callbacks := make(chan url.Values, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" || r.URL.Query().Get("state") != state {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("error") != "" {
+			_, _ = w.Write([]byte("The login was denied, you can close this page.\n"))
+		} else {
+			_, _ = w.Write([]byte("You are logged in, you can close this page.\n"))
+		}
+		select {
+		case callbacks <- r.URL.Query():
+		default:
+		}
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	authorize := host.String() + authentication.CLIAuthorizePath + "?" + url.Values{
+		"callback": {"http://" + ln.Addr().String() + "/callback"},
+		"state":    {state},
+	}.Encode()
+	fmt.Fprintf(out, "Opening %s\n", authorize)
+	if err := openBrowser(authorize); err != nil {
+		fmt.Fprintln(out, "Cannot open a browser, open the URL above or log in with -device")
+	}
+
+	select {
+	case callback := <-callbacks:
+		if callback.Get("error") != "" {
+			return authentication.CLIToken{}, errors.New("login denied")
+		}
+		return requestToken(host, url.Values{"grant_type": {"authorization_code"}, "code": {callback.Get("code")}})
+	case <-time.After(loginTimeout):
+		return authentication.CLIToken{}, errors.New("login timed out")
+	}
+}
+
+func openBrowser(target string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", target).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", target).Start()
+	default:
+		return exec.Command("xdg-open", target).Start()
+	}
+}
+
+// loginCommand logs in to a host and caches the token
+func loginCommand(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	device := flags.Bool("device", false, "Log in with a code approved from any browser, for remote machines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: helios login [-device] <host>")
+	}
+	host, err := hostURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	login := browserLogin
+	if *device {
+		login = deviceLogin
+	}
+	token, err := login(host, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	err = saveToken(host.String(), cachedToken{
+		Token:     token.AccessToken,
+		ExpiresAt: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Logged in to %s\n", host.Host)
+	return nil
+}
+
+// curlValueFlags are the short curl options taking a value, the rest of a group of short options is that value
+const curlValueFlags = "AbcCdDeEFHKmoPQrtTuUwxXyYz"
+
+// followsRedirects tells if curl arguments follow redirects, curl would send the token header to other hosts
+func followsRedirects(args []string) bool {
+	for _, arg := range args {
+		switch {
+		case arg == "--location" || arg == "--location-trusted":
+			return true
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+			for _, c := range arg[1:] {
+				if c == 'L' {
+					return true
+				}
+				if strings.ContainsRune(curlValueFlags, c) {
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+// curlArgs adds the token header of the first URL in the arguments of curl
+func curlArgs(args []string) ([]string, error) {
+	if followsRedirects(args) {
+		return nil, errors.New("helios curl cannot follow redirects, the token would be sent to other hosts")
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+			continue
+		}
+		host, err := hostURL(arg)
+		if err != nil {
+			return nil, err
+		}
+		token, err := tokenFor(host)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{"-H", authentication.HeaderName + ": " + token}, args...), nil
+	}
+	return nil, errors.New("usage: helios curl [curl options] <url>")
+}
+
+// curlCommand runs curl with the token of the requested host
+func curlCommand(args []string) error {
+	withToken, err := curlArgs(args)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("curl", withToken...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			os.Exit(exit.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// newClientProxy forwards requests to a host with its token, the token is read from the cache on every request so
+// logging in again does not require a restart
+func newClientProxy(host *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(host)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = host.Host
+		token, err := tokenFor(host)
+		if err != nil {
+			log.Warn(err)
+			return
+		}
+		r.Header.Set(authentication.HeaderName, token)
+	}
+	return proxy
+}
+
+// proxyCommand serves a local proxy to a host, for tools that cannot set headers
+func proxyCommand(args []string) error {
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "Local address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: helios proxy [-listen address] <host>")
+	}
+	host, err := hostURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := tokenFor(host); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Proxying http://%s to %s\n", *listen, host)
+	return http.ListenAndServe(*listen, newClientProxy(host))
+}
+
+// dialTunnel opens a WebSocket to a tcp upstream of Helios, authenticated with the cached token of its host
+func dialTunnel(target *url.URL) (*websocket.Conn, error) {
+	host, err := hostURL(target.String())
+	if err != nil {
+		return nil, err
+	}
+	token, err := tokenFor(host)
+	if err != nil {
+		return nil, err
+	}
+
+	wsURL := *target
+	wsURL.Scheme = "wss"
+	if target.Scheme == "http" {
+		wsURL.Scheme = "ws"
+	}
+	header := http.Header{authentication.HeaderName: {token}}
+
+	ws, res, err := websocket.DefaultDialer.Dial(wsURL.String(), header)
+	if err == websocket.ErrBadHandshake {
+		res.Body.Close()
+		if res.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("session of %s expired, run: helios login %s", host.Host, host.Host)
+		}
+		return nil, fmt.Errorf("cannot open tunnel to %s: %s", target, res.Status)
+	}
+	return ws, err
+}
+
+// stdio is the standard input and output of the process, ssh uses it with ProxyCommand
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	return os.Stdin.Close()
+}
+
+// tcpCommand tunnels TCP connections through a tcp upstream, from a local port or the standard input and output
+func tcpCommand(args []string) error {
+	flags := flag.NewFlagSet("tcp", flag.ContinueOnError)
+	listen := flags.String("listen", "", "Local address to listen on, the standard input and output are tunneled when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: helios tcp [-listen address] <url>")
+	}
+	if !strings.Contains(flags.Arg(0), "://") {
+		return errors.New("the tunnel URL must start with https:// or http://")
+	}
+	target, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *listen == "" {
+		ws, err := dialTunnel(target)
+		if err != nil {
+			return err
+		}
+		pipeWebSocket(ws, stdio{os.Stdin, os.Stdout})
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Tunneling %s to %s\n", ln.Addr(), target)
+	return serveTunnel(ln, target)
+}
+
+// serveTunnel opens a tunnel for every connection accepted by ln
+func serveTunnel(ln net.Listener, target *url.URL) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			ws, err := dialTunnel(target)
+			if err != nil {
+				log.Error(err)
+				conn.Close()
+				return
+			}
+			pipeWebSocket(ws, conn)
+		}()
+	}
+}
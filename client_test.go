@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	auth := authentication.NewHeliosAuthenticationWithConfig(nil, authentication.Config{
+		JWT: authentication.JWTConfig{Secret: "test", Expiration: time.Hour},
+		CLI: authentication.CLIConfig{Enabled: true},
+	})
+	jane := authentication.Identity{Email: "jane@acme.test"}
+	mux := http.NewServeMux()
+	mux.HandleFunc(authentication.CLIDeviceCodePath, auth.CLIDeviceCodeHandler)
+	mux.HandleFunc(authentication.CLITokenPath, auth.CLITokenHandler)
+	mux.HandleFunc(authentication.CLIDevicePath, func(w http.ResponseWriter, r *http.Request) {
+		auth.CLIDeviceHandler(w, r.WithContext(authentication.WithIdentity(context.Background(), jane)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var out bytes.Buffer
+	polls := 0
+	sleep = func(time.Duration) {
+		polls++
+		if polls != 2 {
+			return
+		}
+		// the user approves the code shown by the terminal
+		code := regexp.MustCompile(`enter the code (\S+)`).FindStringSubmatch(out.String())[1]
+		res, err := http.Get(server.URL + authentication.CLIDevicePath)
+		assert.NoError(t, err)
+		page, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(string(page))[1]
+		res, err = http.PostForm(server.URL+authentication.CLIDevicePath,
+			url.Values{"user_code": {code}, "csrf": {csrf}, "action": {"approve"}})
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	defer func() { sleep = time.Sleep }()
+
+	host, err := hostURL(server.URL)
+	assert.NoError(t, err)
+	token, err := deviceLogin(host, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, polls)
+	assert.Equal(t, authentication.CLITokenType, token.TokenType)
+
+	claims, err := authentication.ParseJWTWithSecret("test", token.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@acme.test", claims.Subject)
+}
+
+func TestClientTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-client")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	assert.NoError(t, os.Setenv("XDG_CONFIG_HOME", dir))
+
+	var header string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(authentication.HeaderName)
+	}))
+	defer upstream.Close()
+	host, err := hostURL(upstream.URL + "/ignored?path")
+	assert.NoError(t, err)
+	assert.Equal(t, upstream.URL, host.String())
+
+	_, err = curlArgs([]string{"-s", upstream.URL + "/api"})
+	assert.Error(t, err)
+
+	assert.NoError(t, saveToken(host.String(), cachedToken{Token: "t1", ExpiresAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, saveToken("https://other.test", cachedToken{Token: "t2", ExpiresAt: time.Now().Add(-time.Hour)}))
+	info, err := os.Stat(dir + "/helios/tokens.json")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	args, err := curlArgs([]string{"-s", upstream.URL + "/api"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-H", authentication.HeaderName + ": t1", "-s", upstream.URL + "/api"}, args)
+
+	// redirects could send the token to other hosts
+	for _, flag := range []string{"-L", "-sL", "--location", "--location-trusted"} {
+		_, err = curlArgs([]string{flag, upstream.URL + "/api"})
+		assert.Error(t, err, flag)
+	}
+	args, err = curlArgs([]string{"-oLICENSE", "-H", "X-Lang: en", upstream.URL + "/api"})
+	assert.NoError(t, err)
+	assert.Len(t, args, 6)
+
+	// expired tokens require a new login
+	_, err = curlArgs([]string{"https://other.test/api"})
+	assert.True(t, strings.Contains(err.Error(), "helios login other.test"))
+
+	proxy := httptest.NewServer(newClientProxy(host))
+	defer proxy.Close()
+	res, err := http.Get(proxy.URL + "/api")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "t1", header)
+}
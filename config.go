@@ -2,6 +2,8 @@ package main
 
 import (
 	"time"
+
+	"github.com/cyakimov/helios/authentication"
 )
 
 // Config structure used to configure Helios
@@ -9,8 +11,75 @@ type Config struct {
 	Server    Server     `yaml:"server"`
 	Upstreams []Upstream `yaml:"upstreams"`
 	Routes    []Route    `yaml:"routes"`
-	Identity  Identity   `yaml:"identity"`
+	Identity  Identities `yaml:"identity"`
+	LoginPage LoginPage  `yaml:"login_page"`
 	JWT       JWT        `yaml:"jwt"`
+	Session   Session    `yaml:"session"`
+	SSO       SSO        `yaml:"sso"`
+	Cookie    Cookie     `yaml:"cookie"`
+	Bearer    Bearer     `yaml:"bearer"`
+	// ServiceAccounts authenticate automation with static API keys
+	ServiceAccounts ServiceAccounts `yaml:"service_accounts"`
+	CLI             CLI             `yaml:"cli"`
+}
+
+// CLI lets command line clients log in with helios login
+type CLI struct {
+	Enabled bool `yaml:"enabled"`
+	// TokenExpires is the lifetime of tokens issued to command line clients, defaults to jwt.expires
+	TokenExpires time.Duration `yaml:"token_expires"`
+}
+
+// ServiceAccounts lists named service accounts and their hashed API keys
+type ServiceAccounts struct {
+	// Header holds API keys, defaults to X-Api-Key
+	Header string `yaml:"header"`
+	// Path is a YAML file listing more accounts, reloaded when it changes
+	Path     string                          `yaml:"path"`
+	Accounts []authentication.ServiceAccount `yaml:"accounts"`
+}
+
+// Bearer configures the validation of OAuth2 access tokens sent by machine clients
+type Bearer struct {
+	// Issuer is the expected iss of access tokens
+	Issuer string `yaml:"issuer"`
+	// JWKSURL verifies JWT access tokens
+	JWKSURL string `yaml:"jwks_url"`
+	// Introspection validates opaque access tokens with RFC 7662
+	Introspection struct {
+		URL          string        `yaml:"url"`
+		ClientID     string        `yaml:"client_id"`
+		ClientSecret string        `yaml:"client_secret"`
+		CacheTTL     time.Duration `yaml:"cache_ttl"`
+	} `yaml:"introspection"`
+	// Audience is required of access tokens on paths that do not set their own
+	Audience string `yaml:"audience"`
+}
+
+// PathBearer configures bearer access tokens on a path
+type PathBearer struct {
+	Enabled  bool   `yaml:"enabled"`
+	Audience string `yaml:"audience"`
+	// Scopes must all be granted to the access token
+	Scopes []string `yaml:"scopes"`
+}
+
+// Cookie configures the session cookie
+type Cookie struct {
+	Name   string `yaml:"name"`
+	Domain string `yaml:"domain"`
+	Path   string `yaml:"path"`
+	// SameSite is one of lax, strict or none
+	SameSite string `yaml:"same_site"`
+	// Secure defaults to true, disable it for local HTTP development only
+	Secure     *bool `yaml:"secure"`
+	HostPrefix bool  `yaml:"host_prefix"`
+}
+
+// SSO configures single sign-on across route hosts
+type SSO struct {
+	// AuthDomain is the host every login goes through
+	AuthDomain string `yaml:"auth_domain"`
 }
 
 // Server structure is used to configure the HTTP(S) server
@@ -20,58 +89,242 @@ type Server struct {
 	Timeout     time.Duration `yaml:"timeout"`
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
 	TLSContext  TLSContext    `yaml:"tls_context"`
+	// MetricsAddress serves expvar metrics on /debug/vars when set
+	MetricsAddress string `yaml:"metrics_address"`
 }
 
 // TLSContext structure is used to configure TLS for the server
 type TLSContext struct {
 	CertificatePath string `yaml:"certificate_path"`
 	PrivateKeyPath  string `yaml:"private_key_path"`
+	// ClientCAPath is the CA bundle client certificates are verified against
+	ClientCAPath string `yaml:"client_ca_path"`
+	// ClientAuth is request (default) to verify client certificates when given, or require to reject clients without
+	ClientAuth string `yaml:"client_auth"`
 }
 
 // Route represents a route configuration
 type Route struct {
-	Host  string
-	Rules []string
-	HTTP  struct {
-		Paths []struct {
-			Path           string
-			Upstream       string
-			Authentication bool `yaml:"authentication"`
-		}
+	Host    string
+	Rules   []string
+	Headers Headers `yaml:"headers"`
+	// Providers restricts the identity providers users can log in with, all are accepted when empty
+	Providers []string `yaml:"providers"`
+	// Identity binds the route to its own identity provider client
+	Identity RouteIdentity `yaml:"identity"`
+	HTTP     struct {
+		Paths []Path
 	}
 }
 
+// Path represents a path within a route
+type Path struct {
+	Path           string
+	Upstream       string
+	Authentication bool `yaml:"authentication"`
+	// ClientCertificate requires a verified TLS client certificate, in addition to the session when Authentication
+	// is set
+	ClientCertificate bool `yaml:"client_certificate"`
+	// Bearer accepts OAuth2 access tokens, requests without one fall back to the session when Authentication is set
+	Bearer PathBearer `yaml:"bearer"`
+	// UnauthenticatedAction is redirect, 401 or 403. Browser navigations are redirected to log in and other requests
+	// get a JSON 401 when empty
+	UnauthenticatedAction string       `yaml:"unauthenticated_action"`
+	Headers               Headers      `yaml:"headers"`
+	StripPrefix           bool         `yaml:"strip_prefix"`
+	PrefixRewrite         string       `yaml:"prefix_rewrite"`
+	Rewrite               RegexRewrite `yaml:"rewrite"`
+	HostRewrite           string       `yaml:"host_rewrite"`
+}
+
+// RegexRewrite rewrites paths matching a regular expression. The replacement may reference capture groups
+type RegexRewrite struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Headers structure is used to manipulate headers sent to and received from upstreams
+type Headers struct {
+	Request  HeaderRules `yaml:"request"`
+	Response HeaderRules `yaml:"response"`
+}
+
+// HeaderRules describes headers to remove, set and add. Values are Go templates
+type HeaderRules struct {
+	Remove        []string          `yaml:"remove"`
+	RemoveCookies []string          `yaml:"remove_cookies"`
+	Set           map[string]string `yaml:"set"`
+	Add           map[string]string `yaml:"add"`
+}
+
 // Upstream represents a single proxy upstream
 type Upstream struct {
-	Name           string `yaml:"name"`
-	URL            string `yaml:"url"`
+	Name           string           `yaml:"name"`
+	URL            string           `yaml:"url"`
+	Protocol       string           `yaml:"protocol"`
+	TLS            UpstreamTLS      `yaml:"tls"`
+	Identity       UpstreamIdentity `yaml:"identity"`
 	ConnectTimeout time.Duration
 }
 
+// UpstreamIdentity configures how the user identity is forwarded to an upstream
+type UpstreamIdentity struct {
+	// Headers sends X-Forwarded-Email, X-Forwarded-User and X-Forwarded-Groups
+	Headers   bool `yaml:"headers"`
+	Assertion struct {
+		Enabled  bool          `yaml:"enabled"`
+		Header   string        `yaml:"header"`
+		Audience string        `yaml:"audience"`
+		Expires  time.Duration `yaml:"expires"`
+	} `yaml:"assertion"`
+	// AccessToken sends the identity provider access token as a bearer token
+	AccessToken bool `yaml:"access_token"`
+}
+
+// UpstreamTLS structure is used to configure TLS connections to an upstream
+type UpstreamTLS struct {
+	CAPath             string `yaml:"ca_path"`
+	CertificatePath    string `yaml:"certificate_path"`
+	PrivateKeyPath     string `yaml:"private_key_path"`
+	ServerName         string `yaml:"server_name"`
+	MinVersion         string `yaml:"min_version"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// LoginPage brands the page users choose an identity provider on
+type LoginPage struct {
+	Title   string `yaml:"title"`
+	LogoURL string `yaml:"logo_url"`
+}
+
+// RouteIdentity overrides the identity provider client of a route
+type RouteIdentity struct {
+	// Provider is the name of the identity provider the client is registered with
+	Provider     string   `yaml:"provider"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// Identities lists the identity providers users can log in with
+type Identities []Identity
+
+// UnmarshalYAML parses a list of identity providers, or a single one
+func (c *Identities) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	var list []Identity
+	if err := unmarshal(&list); err == nil {
+		*c = list
+		return nil
+	}
+
+	var single Identity
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+	*c = Identities{single}
+
+	return nil
+}
+
 // Identity provider configuration
 type Identity struct {
+	// Name identifies the provider in routes and sessions, defaults to the provider type
+	Name string `yaml:"name"`
+	// Title is shown on the login page
+	Title        string `yaml:"title"`
 	Provider     string `yaml:"provider"`
 	ClientID     string `yaml:"client_id"`
 	ClientSecret string `yaml:"client_secret"`
-	OAuth2       struct {
+	// Scopes replace the scopes requested by default
+	Scopes []string `yaml:"scopes"`
+	OAuth2 struct {
 		AuthURL    string `yaml:"auth_url"`
 		TokenURL   string `yaml:"token_url"`
 		ProfileURL string `yaml:"profile_url"`
+		// LogoutURL is the OpenID Connect end_session_endpoint
+		LogoutURL string `yaml:"logout_url"`
+		// Issuer and JWKSURL verify back-channel logout tokens
+		Issuer  string `yaml:"issuer"`
+		JWKSURL string `yaml:"jwks_url"`
+		// APIURL is the GitHub Enterprise or self-hosted GitLab API, or Microsoft Graph for Azure AD
+		APIURL string `yaml:"api_url"`
+		// Domain is the Okta organization or the Keycloak server
+		Domain string `yaml:"domain"`
+		// Realm is the Keycloak realm
+		Realm string `yaml:"realm"`
+		// AuthorizationServer is the Okta custom authorization server
+		AuthorizationServer string `yaml:"authorization_server"`
+		// GroupNames maps Azure AD group object IDs to their display names
+		GroupNames bool `yaml:"group_names"`
+		// GroupCacheTTL is how long Azure AD groups resolved through Microsoft Graph are cached per user
+		GroupCacheTTL time.Duration `yaml:"group_cache_ttl"`
 	}
+	// SAML configures the saml provider, Helios being the service provider
+	SAML struct {
+		// EntityID identifies Helios at the identity provider
+		EntityID string `yaml:"entity_id"`
+		// CertificatePath and PrivateKeyPath sign authentication requests, the key must be RSA
+		CertificatePath string `yaml:"certificate_path"`
+		PrivateKeyPath  string `yaml:"private_key_path"`
+		// SSOURL is the identity provider HTTP-Redirect single sign-on endpoint
+		SSOURL string `yaml:"sso_url"`
+		// IdPEntityID is the issuer of assertions
+		IdPEntityID string `yaml:"idp_entity_id"`
+		// IdPCertificatePath verifies the signature of assertions
+		IdPCertificatePath string `yaml:"idp_certificate_path"`
+		// EmailAttribute holds the user email, the NameID is used when empty
+		EmailAttribute string `yaml:"email_attribute"`
+		// GroupsAttribute holds the user groups, defaults to groups
+		GroupsAttribute string `yaml:"groups_attribute"`
+	} `yaml:"saml"`
+}
+
+// Session configures the server-side session store
+type Session struct {
+	// Store is one of memory, file or redis. Sessions live in the cookie when empty
+	Store string `yaml:"store"`
+	Path  string `yaml:"path"`
+	Redis struct {
+		Address  string `yaml:"address"`
+		Password string `yaml:"password"`
+		DB       int    `yaml:"db"`
+	} `yaml:"redis"`
+	AdminToken string `yaml:"admin_token"`
+	// RefreshInterval is how often sessions are re-validated with the identity provider
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// IdleTimeout ends sessions after a period of inactivity
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxLifetime is the absolute session lifetime
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
 }
 
 // JWT token configuration
 type JWT struct {
-	Secret  string
-	Expires time.Duration
+	Secret         string
+	Expires        time.Duration
+	SigningKeyPath string
+	// Encrypt session cookies so browsers cannot read their claims
+	Encrypt bool
+	// EncryptionKeys are base64 encoded 256 bits keys, the first one encrypts.
+	// A key is derived from the secret when none is given
+	EncryptionKeys []EncryptionKey
+}
+
+// EncryptionKey is a session cookie encryption key
+type EncryptionKey struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
 }
 
 // UnmarshalYAML parses upstream configuration from a YAML file
 func (c *Upstream) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	buf := struct {
-		ConnectTimeout string `yaml:"connect_timeout"`
-		Name           string `yaml:"name"`
-		URL            string `yaml:"url"`
+		ConnectTimeout string           `yaml:"connect_timeout"`
+		Name           string           `yaml:"name"`
+		URL            string           `yaml:"url"`
+		Protocol       string           `yaml:"protocol"`
+		TLS            UpstreamTLS      `yaml:"tls"`
+		Identity       UpstreamIdentity `yaml:"identity"`
 	}{}
 
 	if err := unmarshal(&buf); err != nil {
@@ -86,6 +339,9 @@ func (c *Upstream) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	c.ConnectTimeout = timeout
 	c.URL = buf.URL
 	c.Name = buf.Name
+	c.Protocol = buf.Protocol
+	c.TLS = buf.TLS
+	c.Identity = buf.Identity
 
 	return nil
 }
@@ -93,8 +349,11 @@ func (c *Upstream) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 // UnmarshalYAML parses JWT configuration from a YAML file
 func (c *JWT) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	buf := struct {
-		Secret  string `yaml:"secret"`
-		Expires string `yaml:"expires"`
+		Secret         string          `yaml:"secret"`
+		Expires        string          `yaml:"expires"`
+		SigningKeyPath string          `yaml:"signing_key_path"`
+		Encrypt        bool            `yaml:"encrypt"`
+		EncryptionKeys []EncryptionKey `yaml:"encryption_keys"`
 	}{}
 
 	if err := unmarshal(&buf); err != nil {
@@ -108,6 +367,9 @@ func (c *JWT) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 
 	c.Expires = expires
 	c.Secret = buf.Secret
+	c.SigningKeyPath = buf.SigningKeyPath
+	c.Encrypt = buf.Encrypt
+	c.EncryptionKeys = buf.EncryptionKeys
 
 	return nil
 }
@@ -115,11 +377,12 @@ func (c *JWT) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 // UnmarshalYAML parses server configuration from a YAML file
 func (c *Server) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	var buf struct {
-		ListenIP    string     `yaml:"listen_ip"`
-		ListenPort  int        `yaml:"listen_port"`
-		Timeout     string     `yaml:"timeout"`
-		IdleTimeout string     `yaml:"idle_timeout"`
-		TLSContext  TLSContext `yaml:"tls_context"`
+		ListenIP       string     `yaml:"listen_ip"`
+		ListenPort     int        `yaml:"listen_port"`
+		Timeout        string     `yaml:"timeout"`
+		IdleTimeout    string     `yaml:"idle_timeout"`
+		TLSContext     TLSContext `yaml:"tls_context"`
+		MetricsAddress string     `yaml:"metrics_address"`
 	}
 
 	if err := unmarshal(&buf); err != nil {
@@ -140,6 +403,7 @@ func (c *Server) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	c.TLSContext = buf.TLSContext
 	c.ListenIP = buf.ListenIP
 	c.ListenPort = buf.ListenPort
+	c.MetricsAddress = buf.MetricsAddress
 
 	return nil
 }
@@ -3,13 +3,22 @@ module github.com/cyakimov/helios
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.11.0
+	github.com/beevik/etree v1.1.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-redis/redis/v7 v7.2.0
 	github.com/google/cel-go v0.2.0
 	github.com/gorilla/mux v1.7.1
+	github.com/gorilla/websocket v1.4.2
+	github.com/russellhaering/goxmldsig v1.1.0
 	github.com/sirupsen/logrus v1.4.1
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a
-	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 	google.golang.org/genproto v0.0.0-20190227213309-4f5b463f9597
-	gopkg.in/yaml.v3 v3.0.0-20190409140830-cdc409dda467
+	google.golang.org/grpc v1.19.0
+	gopkg.in/square/go-jose.v2 v2.5.1
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,42 @@
+package grpcutil
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ContentType is the content type prefix used by gRPC requests
+const ContentType = "application/grpc"
+
+// IsGRPCRequest checks if a request was made by a gRPC client
+func IsGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), ContentType)
+}
+
+// WriteError writes a trailers-only gRPC response carrying the given status code.
+// gRPC clients ignore HTTP status codes, so errors must be reported through grpc-status instead.
+func WriteError(w http.ResponseWriter, code codes.Code, message string) {
+	h := w.Header()
+	h.Set("Content-Type", ContentType)
+	h.Set("Grpc-Status", strconv.Itoa(int(code)))
+	h.Set("Grpc-Message", encodeMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeMessage percent-encodes a status message as required by the gRPC HTTP/2 spec
+func encodeMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
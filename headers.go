@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/cyakimov/helios/authentication"
+	log "github.com/sirupsen/logrus"
+)
+
+type headerContextKey struct{}
+
+// HeaderTemplateData is the data available to header value templates
+type HeaderTemplateData struct {
+	Identity authentication.Identity
+	Request  struct {
+		Host   string
+		Method string
+		Path   string
+		IP     string
+		Scheme string
+	}
+}
+
+type headerValue struct {
+	name  string
+	value *template.Template
+}
+
+// HeaderPolicy is a compiled set of header rules for requests and responses
+type HeaderPolicy struct {
+	request  compiledHeaderRules
+	response compiledHeaderRules
+}
+
+type compiledHeaderRules struct {
+	remove        []string
+	removeCookies map[string]bool
+	set           []headerValue
+	add           []headerValue
+}
+
+// NewHeaderPolicy compiles header rules and their value templates
+func NewHeaderPolicy(headers Headers) (*HeaderPolicy, error) {
+	request, err := compileHeaderRules(headers.Request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := compileHeaderRules(headers.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HeaderPolicy{request: request, response: response}, nil
+}
+
+func compileHeaderRules(rules HeaderRules) (compiledHeaderRules, error) {
+	compiled := compiledHeaderRules{
+		remove:        rules.Remove,
+		removeCookies: make(map[string]bool, len(rules.RemoveCookies)),
+	}
+	for _, name := range rules.RemoveCookies {
+		compiled.removeCookies[name] = true
+	}
+
+	var err error
+	if compiled.set, err = compileHeaderValues(rules.Set); err != nil {
+		return compiled, err
+	}
+	if compiled.add, err = compileHeaderValues(rules.Add); err != nil {
+		return compiled, err
+	}
+
+	return compiled, nil
+}
+
+func compileHeaderValues(values map[string]string) ([]headerValue, error) {
+	// sort names so headers are always applied in the same order
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	compiled := make([]headerValue, 0, len(values))
+	for _, name := range names {
+		tpl, err := template.New(name).Option("missingkey=zero").Parse(values[name])
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, headerValue{name: name, value: tpl})
+	}
+
+	return compiled, nil
+}
+
+func (rules compiledHeaderRules) apply(h http.Header, data *HeaderTemplateData) {
+	for _, name := range rules.remove {
+		h.Del(name)
+	}
+
+	if len(rules.removeCookies) > 0 {
+		removeCookies(h, rules.removeCookies)
+	}
+
+	for _, hv := range rules.set {
+		if v, ok := hv.render(data); ok {
+			h.Set(hv.name, v)
+		}
+	}
+
+	for _, hv := range rules.add {
+		if v, ok := hv.render(data); ok {
+			h.Add(hv.name, v)
+		}
+	}
+}
+
+func (hv headerValue) render(data *HeaderTemplateData) (string, bool) {
+	var sb strings.Builder
+	if err := hv.value.Execute(&sb, data); err != nil {
+		log.Errorf("Error rendering header %q: %v", hv.name, err)
+		return "", false
+	}
+	return sb.String(), true
+}
+
+// removeCookies drops the named cookies from the Cookie header, keeping the others.
+// Names match their __Host- and __Secure- prefixed variants and their numbered chunks
+func removeCookies(h http.Header, names map[string]bool) {
+	cookies := (&http.Request{Header: h}).Cookies()
+	h.Del("Cookie")
+
+	kept := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		if !names[baseCookieName(c.Name)] {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// baseCookieName strips the cookie prefixes and the chunk number of large cookies split by Helios
+func baseCookieName(name string) string {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "__Host-"), "__Secure-")
+	if i := strings.LastIndexByte(name, '_'); i > 0 && i < len(name)-1 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			name = name[:i]
+		}
+	}
+	return name
+}
+
+// newHeaderTemplateData collects the attributes of an incoming request available to header templates
+func newHeaderTemplateData(r *http.Request) *HeaderTemplateData {
+	data := &HeaderTemplateData{}
+	data.Identity, _ = authentication.IdentityFromContext(r.Context())
+	data.Request.Host = r.Host
+	data.Request.Method = r.Method
+	data.Request.Path = r.URL.Path
+	data.Request.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	data.Request.Scheme = "http"
+	if r.TLS != nil {
+		data.Request.Scheme = "https"
+	}
+
+	return data
+}
+
+// applyRequestHeaders applies request rules and keeps the template data around for the response
+func applyRequestHeaders(req *http.Request, policies []*HeaderPolicy) {
+	if len(policies) == 0 {
+		return
+	}
+
+	data := newHeaderTemplateData(req)
+	for _, p := range policies {
+		p.request.apply(req.Header, data)
+	}
+
+	*req = *req.WithContext(context.WithValue(req.Context(), headerContextKey{}, data))
+}
+
+// applyResponseHeaders applies response rules using the data captured for the request
+func applyResponseHeaders(resp *http.Response, policies []*HeaderPolicy) {
+	if len(policies) == 0 {
+		return
+	}
+
+	data, ok := resp.Request.Context().Value(headerContextKey{}).(*HeaderTemplateData)
+	if !ok {
+		data = newHeaderTemplateData(resp.Request)
+	}
+	for _, p := range policies {
+		p.response.apply(resp.Header, data)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderPolicy_Request(t *testing.T) {
+	tests := []struct {
+		Rules    HeaderRules
+		Header   http.Header
+		Expected http.Header
+	}{
+		{
+			Rules:    HeaderRules{Remove: []string{"X-Debug"}},
+			Header:   http.Header{"X-Debug": {"1"}, "Accept": {"*/*"}},
+			Expected: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			Rules:    HeaderRules{Set: map[string]string{"X-Forwarded-User": "{{ .Identity.Email }}"}},
+			Header:   http.Header{"X-Forwarded-User": {"spoofed"}},
+			Expected: http.Header{"X-Forwarded-User": {"jane@acme.test"}},
+		},
+		{
+			Rules:    HeaderRules{Add: map[string]string{"Via": "helios {{ .Request.Scheme }}"}},
+			Header:   http.Header{"Via": {"1.1 cdn"}},
+			Expected: http.Header{"Via": {"1.1 cdn", "helios https"}},
+		},
+		{
+			Rules: HeaderRules{Set: map[string]string{
+				"X-Request": "{{ .Request.Method }} {{ .Request.Host }}{{ .Request.Path }} from {{ .Request.IP }}",
+				"X-Groups":  `{{ range $i, $g := .Identity.Groups }}{{ if $i }},{{ end }}{{ $g }}{{ end }}`,
+			}},
+			Header: http.Header{},
+			Expected: http.Header{
+				"X-Request": {"GET app.test/api/users from 192.0.2.1"},
+				"X-Groups":  {"admins,devs"},
+			},
+		},
+		{
+			// headers are removed before they are set
+			Rules:    HeaderRules{Remove: []string{"X-User"}, Set: map[string]string{"X-User": "{{ .Identity.Email }}"}},
+			Header:   http.Header{"X-User": {"spoofed"}},
+			Expected: http.Header{"X-User": {"jane@acme.test"}},
+		},
+		{
+			// values failing to render are not sent
+			Rules:    HeaderRules{Set: map[string]string{"X-Fail": "{{ .Identity.Email.Missing }}"}},
+			Header:   http.Header{},
+			Expected: http.Header{},
+		},
+		{
+			Rules:    HeaderRules{RemoveCookies: []string{"Helios_Authorization"}},
+			Header:   http.Header{"Cookie": {"Helios_Authorization=jwt; theme=dark"}},
+			Expected: http.Header{"Cookie": {"theme=dark"}},
+		},
+	}
+
+	identity := authentication.Identity{Email: "jane@acme.test", Groups: []string{"admins", "devs"}}
+	for _, test := range tests {
+		policy, err := NewHeaderPolicy(Headers{Request: test.Rules})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "https://app.test/api/users", nil)
+		req.TLS = &tls.ConnectionState{}
+		req = req.WithContext(authentication.WithIdentity(context.Background(), identity))
+		req.Header = test.Header
+		applyRequestHeaders(req, []*HeaderPolicy{policy})
+		assert.Equal(t, test.Expected, req.Header)
+	}
+}
+
+func TestHeaderPolicy_Response(t *testing.T) {
+	route, err := NewHeaderPolicy(Headers{Response: HeaderRules{
+		Remove: []string{"Server"},
+		Set:    map[string]string{"X-Served-For": "{{ .Identity.Email }}", "X-Frame-Options": "DENY"},
+	}})
+	assert.NoError(t, err)
+	// path rules run after route rules
+	path, err := NewHeaderPolicy(Headers{Response: HeaderRules{Set: map[string]string{"X-Frame-Options": "SAMEORIGIN"}}})
+	assert.NoError(t, err)
+	policies := []*HeaderPolicy{route, path}
+
+	req := httptest.NewRequest("GET", "http://app.test/", nil)
+	req = req.WithContext(authentication.WithIdentity(context.Background(), authentication.Identity{Email: "jane@acme.test"}))
+	applyRequestHeaders(req, policies)
+
+	res := &http.Response{Request: req, Header: http.Header{"Server": {"nginx"}, "Content-Type": {"text/html"}}}
+	applyResponseHeaders(res, policies)
+	assert.Equal(t, http.Header{
+		"Content-Type":    {"text/html"},
+		"X-Frame-Options": {"SAMEORIGIN"},
+		"X-Served-For":    {"jane@acme.test"},
+	}, res.Header)
+
+	_, err = NewHeaderPolicy(Headers{Request: HeaderRules{Set: map[string]string{"X-Invalid": "{{ .Identity"}}})
+	assert.Error(t, err)
+}
+
+func TestRemoveCookies(t *testing.T) {
+	tests := []struct {
+		Cookie   string
+		Expected string
+	}{
+		{"Helios_Authorization=jwt; theme=dark", "theme=dark"},
+		{"__Host-Helios_Authorization=jwt; theme=dark", "theme=dark"},
+		{"__Secure-Helios_Authorization=jwt", ""},
+		{"Helios_Authorization_0=a; Helios_Authorization_1=b; theme=dark", "theme=dark"},
+		{"__Host-Helios_Authorization_0=a; __Host-Helios_Authorization_1=b", ""},
+		{"Helios_Authorization_legacy=a; Other_Authorization=b", "Helios_Authorization_legacy=a; Other_Authorization=b"},
+	}
+
+	for _, test := range tests {
+		h := http.Header{"Cookie": {test.Cookie}}
+		removeCookies(h, map[string]bool{"Helios_Authorization": true})
+		assert.Equal(t, test.Expected, h.Get("Cookie"), test.Cookie)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyakimov/helios/authentication"
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity headers sent to upstreams
+const (
+	HeaderForwardedEmail  = "X-Forwarded-Email"
+	HeaderForwardedUser   = "X-Forwarded-User"
+	HeaderForwardedGroups = "X-Forwarded-Groups"
+	// DefaultAssertionHeader carries the signed identity assertion unless configured otherwise
+	DefaultAssertionHeader = "X-Helios-Assertion"
+)
+
+// IdentityForwarder propagates the authenticated identity to an upstream
+type IdentityForwarder struct {
+	conf            UpstreamIdentity
+	assertionHeader string
+	audience        string
+	expiration      time.Duration
+	signer          *authentication.AssertionSigner
+}
+
+// NewIdentityForwarder creates a forwarder for an upstream. The audience defaults to the upstream URL
+func NewIdentityForwarder(conf UpstreamIdentity, upstreamURL string, signer *authentication.AssertionSigner) *IdentityForwarder {
+	f := &IdentityForwarder{
+		conf:            conf,
+		assertionHeader: conf.Assertion.Header,
+		audience:        conf.Assertion.Audience,
+		expiration:      conf.Assertion.Expires,
+		signer:          signer,
+	}
+	if f.assertionHeader == "" {
+		f.assertionHeader = DefaultAssertionHeader
+	}
+	if f.audience == "" {
+		f.audience = upstreamURL
+	}
+	if f.expiration == 0 {
+		f.expiration = time.Minute
+	}
+
+	return f
+}
+
+// Apply strips client supplied identity headers and Helios tokens, and sets the ones configured for the upstream
+func (f *IdentityForwarder) Apply(req *http.Request) {
+	// never trust identity headers coming from clients
+	req.Header.Del(HeaderForwardedEmail)
+	req.Header.Del(HeaderForwardedUser)
+	req.Header.Del(HeaderForwardedGroups)
+	req.Header.Del(f.assertionHeader)
+	// tokens of command line clients are Helios credentials, upstreams never see them
+	req.Header.Del(authentication.HeaderName)
+	if f.conf.AccessToken {
+		req.Header.Del("Authorization")
+	}
+
+	identity, ok := authentication.IdentityFromContext(req.Context())
+	if !ok {
+		return
+	}
+
+	if f.conf.Headers {
+		req.Header.Set(HeaderForwardedEmail, identity.Email)
+		req.Header.Set(HeaderForwardedUser, identity.Email)
+		if len(identity.Groups) > 0 {
+			req.Header.Set(HeaderForwardedGroups, strings.Join(identity.Groups, ","))
+		}
+	}
+
+	if f.conf.Assertion.Enabled && f.signer != nil {
+		assertion, err := f.signer.Sign(identity, f.audience, f.expiration)
+		if err != nil {
+			log.Errorf("Cannot sign identity assertion: %v", err)
+		} else {
+			req.Header.Set(f.assertionHeader, assertion)
+		}
+	}
+
+	if f.conf.AccessToken && identity.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+identity.AccessToken)
+	}
+}
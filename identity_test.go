@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityForwarder_Apply(t *testing.T) {
+	signer, err := authentication.NewAssertionSigner("")
+	assert.NoError(t, err)
+
+	conf := UpstreamIdentity{Headers: true, AccessToken: true}
+	conf.Assertion.Enabled = true
+	forwarder := NewIdentityForwarder(conf, "https://app.internal", signer)
+
+	identity := authentication.Identity{
+		Email:       "t@test",
+		Groups:      []string{"admins", "devs"},
+		AccessToken: "idp-token",
+	}
+
+	tests := []struct {
+		Authenticated bool
+		Email         string
+		Groups        string
+		Authorization string
+	}{
+		{false, "", "", ""},
+		{true, "t@test", "admins,devs", "Bearer idp-token"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://testing", nil)
+		// spoofed headers must never reach the upstream
+		req.Header.Set(HeaderForwardedEmail, "admin@test")
+		req.Header.Set(HeaderForwardedGroups, "admins")
+		req.Header.Set(DefaultAssertionHeader, "forged")
+		req.Header.Set("Authorization", "Bearer forged")
+		req.Header.Set(authentication.HeaderName, "cli-token")
+		if test.Authenticated {
+			req = req.WithContext(authentication.WithIdentity(req.Context(), identity))
+		}
+
+		forwarder.Apply(req)
+
+		assert.Equal(t, test.Email, req.Header.Get(HeaderForwardedEmail))
+		assert.Equal(t, test.Groups, req.Header.Get(HeaderForwardedGroups))
+		assert.Equal(t, test.Authorization, req.Header.Get("Authorization"))
+		assert.Empty(t, req.Header.Get(authentication.HeaderName))
+
+		assertion := req.Header.Get(DefaultAssertionHeader)
+		if !test.Authenticated {
+			assert.Empty(t, assertion)
+			continue
+		}
+
+		claims := &authentication.AssertionClaims{}
+		token, _, _ := new(jwt.Parser).ParseUnverified(assertion, claims)
+		assert.NotNil(t, token)
+		assert.Equal(t, "ES256", token.Method.Alg())
+		assert.Equal(t, "https://app.internal", claims.Audience)
+		assert.Equal(t, "t@test", claims.Email)
+	}
+}
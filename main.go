@@ -2,7 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,13 +16,20 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/cyakimov/helios/authentication"
 	"github.com/cyakimov/helios/authentication/providers"
 	"github.com/cyakimov/helios/authentication/providers/auth0"
 	"github.com/cyakimov/helios/authentication/providers/azuread"
+	"github.com/cyakimov/helios/authentication/providers/github"
+	"github.com/cyakimov/helios/authentication/providers/gitlab"
 	"github.com/cyakimov/helios/authentication/providers/google"
+	"github.com/cyakimov/helios/authentication/providers/keycloak"
+	"github.com/cyakimov/helios/authentication/providers/okta"
+	"github.com/cyakimov/helios/authentication/providers/saml"
+	"github.com/cyakimov/helios/authentication/session"
 	"github.com/cyakimov/helios/authorization"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -38,34 +51,429 @@ func init() {
 	flag.BoolVar(&debugMode, "verbose", false, "DEBUG level logging")
 }
 
-func router() *mux.Router {
-	router := mux.NewRouter()
-	upstreams := make(map[string]http.Handler, len(config.Upstreams))
+// upstream holds what is needed to build proxies for a configured upstream
+type upstream struct {
+	url  *url.URL
+	conf ReverseProxyConfig
+}
 
+func newSessionStore(conf Session) (session.Store, error) {
+	switch conf.Store {
+	case "":
+		return nil, nil
+	case "memory":
+		return session.NewMemoryStore(), nil
+	case "file":
+		return session.NewFileStore(conf.Path)
+	case "redis":
+		return session.NewRedisStore(session.RedisConfig{
+			Address:  conf.Redis.Address,
+			Password: conf.Redis.Password,
+			DB:       conf.Redis.DB,
+		})
+	default:
+		return nil, fmt.Errorf("%q session store is not supported", conf.Store)
+	}
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteLaxMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func newCookieConfig(conf Cookie) (authentication.CookieConfig, error) {
+	cookie := authentication.DefaultCookieConfig()
+	if conf.Name != "" {
+		cookie.Name = conf.Name
+	}
+	if conf.Path != "" {
+		cookie.Path = conf.Path
+	}
+	if conf.Secure != nil {
+		cookie.Secure = *conf.Secure
+	}
+	cookie.Domain = conf.Domain
+	cookie.HostPrefix = conf.HostPrefix
+
+	sameSite, ok := sameSiteModes[strings.ToLower(conf.SameSite)]
+	if !ok {
+		return cookie, fmt.Errorf("unknown SameSite mode %q", conf.SameSite)
+	}
+	cookie.SameSite = sameSite
+
+	return cookie, cookie.Validate()
+}
+
+// newEncryptionKeys decodes the session cookie encryption keys.
+// A key is derived from the JWT secret when encryption is enabled without keys
+func newEncryptionKeys(conf JWT) ([]authentication.EncryptionKey, error) {
+	if !conf.Encrypt {
+		return nil, nil
+	}
+	if len(conf.EncryptionKeys) == 0 {
+		return []authentication.EncryptionKey{authentication.DefaultEncryptionKey(conf.Secret)}, nil
+	}
+
+	keys := make([]authentication.EncryptionKey, 0, len(conf.EncryptionKeys))
+	for _, k := range conf.EncryptionKeys {
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode key %q: %v", k.ID, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes long", k.ID)
+		}
+		keys = append(keys, authentication.EncryptionKey{ID: k.ID, Key: key})
+	}
+	return keys, nil
+}
+
+func newProvider(conf Identity) (providers.OAuth2Provider, error) {
 	oauth2conf := providers.OAuth2Config{
-		ClientID:     config.Identity.ClientID,
-		ClientSecret: config.Identity.ClientSecret,
-		AuthURL:      config.Identity.OAuth2.AuthURL,
-		TokenURL:     config.Identity.OAuth2.TokenURL,
-		ProfileURL:   config.Identity.OAuth2.ProfileURL,
+		ClientID:            conf.ClientID,
+		ClientSecret:        conf.ClientSecret,
+		AuthURL:             conf.OAuth2.AuthURL,
+		TokenURL:            conf.OAuth2.TokenURL,
+		ProfileURL:          conf.OAuth2.ProfileURL,
+		LogoutURL:           conf.OAuth2.LogoutURL,
+		Scopes:              conf.Scopes,
+		APIURL:              conf.OAuth2.APIURL,
+		Domain:              conf.OAuth2.Domain,
+		Realm:               conf.OAuth2.Realm,
+		AuthorizationServer: conf.OAuth2.AuthorizationServer,
+		GroupNames:          conf.OAuth2.GroupNames,
+		GroupCacheTTL:       conf.OAuth2.GroupCacheTTL,
 	}
 
-	var provider providers.OAuth2Provider
-	switch config.Identity.Provider {
+	switch conf.Provider {
 	case "aad":
-		provider = azuread.NewAzureADProvider(oauth2conf)
+		return azuread.NewAzureADProvider(oauth2conf), nil
 	case "auth0":
-		provider = auth0.NewAuth0Provider(oauth2conf)
+		return auth0.NewAuth0Provider(oauth2conf), nil
 	case "google":
-		provider = google.NewGoogleProvider(oauth2conf)
+		return google.NewGoogleProvider(oauth2conf), nil
+	case "github":
+		return github.NewGitHubProvider(oauth2conf), nil
+	case "gitlab":
+		return gitlab.NewGitLabProvider(oauth2conf), nil
+	case "okta":
+		return okta.NewOktaProvider(oauth2conf), nil
+	case "keycloak":
+		return keycloak.NewKeycloakProvider(oauth2conf), nil
+	case "saml":
+		return newSAMLProvider(conf)
 	default:
-		log.Fatalf("%q provider is not supported", config.Identity.Provider)
+		return nil, fmt.Errorf("%q provider is not supported", conf.Provider)
+	}
+}
+
+// newSAMLProvider creates a SAML service provider out of its key pair and the identity provider certificate
+func newSAMLProvider(conf Identity) (providers.OAuth2Provider, error) {
+	keyPair, err := tls.LoadX509KeyPair(conf.SAML.CertificatePath, conf.SAML.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("SAML private key must be RSA")
+	}
+
+	b, err := ioutil.ReadFile(conf.SAML.IdPCertificatePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate found in %s", conf.SAML.IdPCertificatePath)
+	}
+	idpCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := saml.NewSAMLProvider(saml.Config{
+		EntityID:        conf.SAML.EntityID,
+		Certificate:     cert,
+		Key:             key,
+		SSOURL:          conf.SAML.SSOURL,
+		IdPEntityID:     conf.SAML.IdPEntityID,
+		IdPCertificate:  idpCert,
+		EmailAttribute:  conf.SAML.EmailAttribute,
+		GroupsAttribute: conf.SAML.GroupsAttribute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// newProviders creates the named identity providers users can log in with
+func newProviders(identities Identities) ([]authentication.Provider, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identity provider configured")
+	}
+
+	idps := make([]authentication.Provider, 0, len(identities))
+	names := make(map[string]bool, len(identities))
+	for _, conf := range identities {
+		provider, err := newProvider(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		name := identityName(conf)
+		if names[name] {
+			return nil, fmt.Errorf("duplicate identity provider %q", name)
+		}
+		// routes would accept API keys where they only meant to accept this provider
+		if name == authentication.ServiceAccountProvider {
+			return nil, fmt.Errorf("identity provider name %q is reserved for service accounts", name)
+		}
+		names[name] = true
+
+		backchannel, err := newBackchannelConfig(conf)
+		if err != nil {
+			return nil, fmt.Errorf("identity provider %q: %v", name, err)
+		}
+
+		idps = append(idps, authentication.Provider{
+			OAuth2Provider: provider,
+			Name:           name,
+			Title:          conf.Title,
+			Backchannel:    backchannel,
+		})
+	}
+	return idps, nil
+}
+
+// identityName returns the name of an identity provider, which defaults to its type
+func identityName(conf Identity) string {
+	if conf.Name == "" {
+		return conf.Provider
+	}
+	return conf.Name
+}
+
+// newRouteProvider creates the identity provider client a route is bound to.
+// It returns nil when the route uses the shared clients
+func newRouteProvider(identities Identities, route Route) (*authentication.Provider, error) {
+	conf := route.Identity
+	if conf.ClientID == "" && len(conf.Scopes) == 0 {
+		return nil, nil
+	}
+
+	var base *Identity
+	for i := range identities {
+		if identityName(identities[i]) == conf.Provider || (conf.Provider == "" && len(identities) == 1) {
+			base = &identities[i]
+			break
+		}
+	}
+	if base == nil {
+		return nil, fmt.Errorf("identity provider %q not found", conf.Provider)
+	}
+
+	client := *base
+	if conf.ClientID != "" {
+		client.ClientID = conf.ClientID
+		client.ClientSecret = conf.ClientSecret
+	}
+	if len(conf.Scopes) > 0 {
+		client.Scopes = conf.Scopes
+	}
+
+	provider, err := newProvider(client)
+	if err != nil {
+		return nil, err
+	}
+	backchannel, err := newBackchannelConfig(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authentication.Provider{
+		OAuth2Provider: provider,
+		// sessions are scoped to the route client
+		Name:        identityName(*base) + "@" + route.Host,
+		Title:       base.Title,
+		Backchannel: backchannel,
+		Private:     true,
+	}, nil
+}
+
+// newBackchannelConfig enables back-channel logout when the identity provider keys are configured.
+// Logout tokens are matched to providers by issuer, so one is required along the keys
+func newBackchannelConfig(conf Identity) (authentication.BackchannelConfig, error) {
+	if conf.OAuth2.JWKSURL == "" {
+		return authentication.BackchannelConfig{}, nil
+	}
+	if conf.OAuth2.Issuer == "" {
+		return authentication.BackchannelConfig{}, errors.New("oauth2.jwks_url requires oauth2.issuer")
+	}
+	return authentication.BackchannelConfig{
+		KeySet:   providers.NewKeySet(conf.OAuth2.JWKSURL),
+		Issuer:   conf.OAuth2.Issuer,
+		Audience: conf.ClientID,
+	}, nil
+}
+
+// newServiceAccounts returns nil when no service account is configured
+func newServiceAccounts(conf ServiceAccounts) (*authentication.ServiceAccounts, error) {
+	if len(conf.Accounts) == 0 && conf.Path == "" {
+		return nil, nil
 	}
+	return authentication.NewServiceAccounts(authentication.ServiceAccountsConfig{
+		Header:   conf.Header,
+		Accounts: conf.Accounts,
+		Path:     conf.Path,
+	})
+}
+
+// newBearerAuthenticator validates access tokens with the issuer keys, or by introspection
+func newBearerAuthenticator(conf Bearer) *authentication.BearerAuthenticator {
+	bearer := authentication.BearerConfig{
+		Issuer: conf.Issuer,
+		Introspection: authentication.IntrospectionConfig{
+			URL:          conf.Introspection.URL,
+			ClientID:     conf.Introspection.ClientID,
+			ClientSecret: conf.Introspection.ClientSecret,
+			CacheTTL:     conf.Introspection.CacheTTL,
+		},
+	}
+	if conf.JWKSURL != "" {
+		bearer.KeySet = providers.NewKeySet(conf.JWKSURL)
+	}
+	return authentication.NewBearerAuthenticator(bearer)
+}
 
-	authN := authentication.NewHeliosAuthentication(provider, config.JWT.Secret, config.JWT.Expires)
+func hasProvider(idps []authentication.Provider, name string) bool {
+	for _, idp := range idps {
+		if idp.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// routeHosts lists the hosts of every route
+func routeHosts(routes []Route) []string {
+	hosts := make([]string, 0, len(routes))
+	for _, route := range routes {
+		hosts = append(hosts, route.Host)
+	}
+	return hosts
+}
+
+func router() *mux.Router {
+	router := mux.NewRouter()
+	upstreams := make(map[string]upstream, len(config.Upstreams))
+
+	idps, err := newProviders(config.Identity)
+	if err != nil {
+		log.Fatalf("Invalid identity configuration: %v", err)
+	}
+
+	// routes bound to their own client only accept sessions of that client
+	routeProviders := make([][]string, len(config.Routes))
+	for i, route := range config.Routes {
+		idp, err := newRouteProvider(config.Identity, route)
+		if err != nil {
+			log.Fatalf("Invalid identity for route %q: %v", route.Host, err)
+		}
+		if (idp != nil || route.Identity.Provider != "") && len(route.Providers) > 0 {
+			log.Fatalf("Route %q cannot set both providers and identity", route.Host)
+		}
+
+		switch {
+		case idp != nil:
+			idps = append(idps, *idp)
+			routeProviders[i] = []string{idp.Name}
+		case route.Identity.Provider != "":
+			routeProviders[i] = []string{route.Identity.Provider}
+		default:
+			routeProviders[i] = route.Providers
+		}
+	}
+
+	cookie, err := newCookieConfig(config.Cookie)
+	if err != nil {
+		log.Fatalf("Invalid cookie configuration: %v", err)
+	}
+
+	encryptionKeys, err := newEncryptionKeys(config.JWT)
+	if err != nil {
+		log.Fatalf("Invalid JWT encryption keys: %v", err)
+	}
+
+	store, err := newSessionStore(config.Session)
+	if err != nil {
+		log.Fatalf("Cannot open session store: %v", err)
+	}
+
+	if config.SSO.AuthDomain != "" && store == nil {
+		// one-time codes must be redeemable on any instance
+		log.Fatal("sso.auth_domain requires a session.store")
+	}
+
+	serviceAccounts, err := newServiceAccounts(config.ServiceAccounts)
+	if err != nil {
+		log.Fatalf("Invalid service accounts: %v", err)
+	}
+
+	authN := authentication.NewHeliosAuthenticationWithConfig(nil, authentication.Config{
+		JWT: authentication.JWTConfig{
+			Secret:         config.JWT.Secret,
+			Expiration:     config.JWT.Expires,
+			EncryptionKeys: encryptionKeys,
+		},
+		Store:           store,
+		AdminToken:      config.Session.AdminToken,
+		RefreshInterval: config.Session.RefreshInterval,
+		IdleTimeout:     config.Session.IdleTimeout,
+		MaxLifetime:     config.Session.MaxLifetime,
+		SSO: authentication.SSOConfig{
+			AuthDomain:   config.SSO.AuthDomain,
+			AllowedHosts: routeHosts(config.Routes),
+		},
+		Cookie:    cookie,
+		Providers: idps,
+		LoginPage: authentication.LoginPageConfig{
+			Title:   config.LoginPage.Title,
+			LogoURL: config.LoginPage.LogoURL,
+		},
+		ServiceAccounts: serviceAccounts,
+		CLI: authentication.CLIConfig{
+			Enabled:         config.CLI.Enabled,
+			TokenExpiration: config.CLI.TokenExpires,
+		},
+	})
 
 	router.PathPrefix("/.well-known/callback").HandlerFunc(authN.CallbackHandler)
 	router.PathPrefix("/.well-known/logout").HandlerFunc(authN.Logout)
+	router.Path(authentication.SignedOutPath).HandlerFunc(authN.SignedOutHandler)
+	router.Path(authentication.BackchannelLogoutPath).HandlerFunc(authN.BackchannelLogoutHandler)
+	router.Path(authentication.SAMLLoginPath).HandlerFunc(authN.SAMLLoginHandler)
+	router.Path(authentication.SAMLACSPath).HandlerFunc(authN.SAMLACSHandler)
+	router.Path(authentication.SAMLMetadataPath).HandlerFunc(authN.SAMLMetadataHandler)
+	router.PathPrefix(authentication.SessionsPath).HandlerFunc(authN.RevokeHandler)
+	router.Path(authentication.SSOAuthorizePath).HandlerFunc(authN.SSOAuthorizeHandler)
+	router.Path(authentication.SSORedeemPath).HandlerFunc(authN.SSORedeemHandler)
+	router.Path(authentication.CLIDeviceCodePath).HandlerFunc(authN.CLIDeviceCodeHandler)
+	router.Path(authentication.CLITokenPath).HandlerFunc(authN.CLITokenHandler)
+
+	signer, err := authentication.NewAssertionSigner(config.JWT.SigningKeyPath)
+	if err != nil {
+		log.Fatalf("Cannot load JWT signing key: %v", err)
+	}
+	router.Path("/.well-known/jwks.json").HandlerFunc(signer.JWKSHandler)
+
+	bearer := newBearerAuthenticator(config.Bearer)
 
 	for _, up := range config.Upstreams {
 		upstreamURL, err := url.Parse(up.URL)
@@ -73,33 +481,139 @@ func router() *mux.Router {
 			log.Fatalf("Cannot parse upstream %q URL: %v", up.Name, err)
 		}
 
+		if up.Protocol == ProtocolTCP {
+			// tunnels only need the address, every path shares it
+			upstreams[up.Name] = upstream{url: upstreamURL, conf: ReverseProxyConfig{
+				ConnectTimeout: up.ConnectTimeout,
+				Protocol:       up.Protocol,
+			}}
+			continue
+		}
+
+		if up.Identity.AccessToken && store == nil && len(encryptionKeys) == 0 {
+			log.Fatalf("Upstream %q forwards access tokens, which requires a session store or encrypted session cookies", up.Name)
+		}
+
+		tlsConf, err := NewUpstreamTLSConfig(up.TLS, upstreamURL.Hostname())
+		if err != nil {
+			log.Fatalf("Cannot configure TLS for upstream %q: %v", up.Name, err)
+		}
+
 		conf := ReverseProxyConfig{
 			ConnectTimeout: up.ConnectTimeout,
 			IdleTimeout:    config.Server.IdleTimeout,
 			Timeout:        config.Server.Timeout,
+			Protocol:       up.Protocol,
+			TLS:            tlsConf,
+			Identity:       NewIdentityForwarder(up.Identity, up.URL, signer),
+		}
+		conf.Transport, err = NewTransport(upstreamURL, conf)
+		if err != nil {
+			log.Fatalf("Cannot create transport for upstream %q: %v", up.Name, err)
 		}
-		proxy := NewSingleHostReverseProxy(upstreamURL, conf)
-		upstreams[up.Name] = proxy
+		upstreams[up.Name] = upstream{url: upstreamURL, conf: conf}
 	}
 
-	for _, route := range config.Routes {
+	for i, route := range config.Routes {
 		h := router.Host(route.Host).Subrouter()
 
+		for _, name := range routeProviders[i] {
+			if name == authentication.ServiceAccountProvider {
+				if serviceAccounts == nil {
+					log.Fatalf("Route %q accepts service accounts but none are configured", route.Host)
+				}
+				continue
+			}
+			if !hasProvider(idps, name) {
+				log.Fatalf("Identity provider %q for route %q not found", name, route.Host)
+			}
+		}
+		routeAuthN := authN.ForProviders(routeProviders[i]...)
+
+		if config.CLI.Enabled {
+			// command line logins are approved by users logged in to the route
+			cliAuthN := routeAuthN.OnUnauthenticated(authentication.UnauthenticatedRedirect)
+			h.Path(authentication.CLIAuthorizePath).Handler(cliAuthN.Middleware(http.HandlerFunc(routeAuthN.CLIAuthorizeHandler)))
+			h.Path(authentication.CLIDevicePath).Handler(cliAuthN.Middleware(http.HandlerFunc(routeAuthN.CLIDeviceHandler)))
+		}
+
+		routeHeaders, err := NewHeaderPolicy(route.Headers)
+		if err != nil {
+			log.Fatalf("Invalid headers for route %q: %v", route.Host, err)
+		}
+
 		for _, path := range route.HTTP.Paths {
-			upstream := upstreams[path.Upstream]
+			up, ok := upstreams[path.Upstream]
 
-			if upstream == nil {
+			if !ok {
 				log.Fatalf("Upstream %q for route %q not found", path.Upstream, route.Host)
 				break
 			}
 
-			authZ := authorization.NewAuthorization(route.Rules)
+			pathHeaders, err := NewHeaderPolicy(path.Headers)
+			if err != nil {
+				log.Fatalf("Invalid headers for path %q of route %q: %v", path.Path, route.Host, err)
+			}
+
+			rewrite, err := NewPathRewrite(path)
+			if err != nil {
+				log.Fatalf("Invalid rewrite for path %q of route %q: %v", path.Path, route.Host, err)
+			}
 
-			if path.Authentication {
-				h.PathPrefix(path.Path).Handler(authN.Middleware(authZ.Middleware(upstream)))
+			conf := up.conf
+			conf.Headers = []*HeaderPolicy{routeHeaders, pathHeaders}
+			conf.Rewrite = rewrite
+			var upstream http.Handler
+			if conf.Protocol == ProtocolTCP {
+				// tunnels reach internal services, they are never opened to anonymous clients
+				if !path.Authentication && !path.ClientCertificate {
+					log.Fatalf("Path %q of route %q tunnels to TCP upstream %q without authentication or client_certificate", path.Path, route.Host, path.Upstream)
+				}
+				upstream, err = NewTCPTunnel(up.url, conf)
 			} else {
-				h.PathPrefix(path.Path).Handler(authZ.Middleware(upstream))
+				upstream, err = NewSingleHostReverseProxy(up.url, conf)
+			}
+			if err != nil {
+				log.Fatalf("Cannot create proxy for upstream %q: %v", path.Upstream, err)
+			}
+
+			authZ := authorization.NewAuthorization(route.Rules)
+
+			action, err := authentication.ParseUnauthenticatedAction(path.UnauthenticatedAction)
+			if err != nil {
+				log.Fatalf("Invalid unauthenticated_action for path %q of route %q: %v", path.Path, route.Host, err)
+			}
+			pathAuthN := routeAuthN.OnUnauthenticated(action)
+
+			handler := authZ.Middleware(upstream)
+			if path.Bearer.Enabled {
+				policy := authentication.BearerPolicy{Audience: path.Bearer.Audience, Scopes: path.Bearer.Scopes}
+				if policy.Audience == "" {
+					policy.Audience = config.Bearer.Audience
+				}
+				if policy.Audience == "" {
+					log.Fatalf("Path %q of route %q accepts bearer tokens but no audience is configured", path.Path, route.Host)
+				}
+				if config.Bearer.JWKSURL == "" && config.Bearer.Introspection.URL == "" {
+					log.Fatalf("Path %q of route %q accepts bearer tokens but neither jwks_url nor introspection is configured", path.Path, route.Host)
+				}
+
+				// browsers without a token still log in when the path requires authentication
+				var session http.Handler
+				if path.Authentication {
+					session = pathAuthN.Middleware(handler)
+				}
+				handler = bearer.Middleware(policy, handler, session)
+			} else if path.Authentication {
+				handler = pathAuthN.Middleware(handler)
+			}
+			if path.ClientCertificate {
+				if config.Server.TLSContext.ClientCAPath == "" {
+					log.Fatalf("Path %q of route %q requires client certificates but no client_ca_path is configured", path.Path, route.Host)
+				}
+				handler = authentication.RequireClientCertificate(handler)
 			}
+			h.PathPrefix(path.Path).Handler(handler)
 
 		}
 	}
@@ -108,6 +622,16 @@ func router() *mux.Router {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 	if debugMode {
 		log.SetLevel(log.DebugLevel)
@@ -126,9 +650,9 @@ func main() {
 
 	var wait time.Duration
 
-	tlsConfig = &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS13,
+	tlsConfig, err = NewServerTLSConfig(config.Server.TLSContext)
+	if err != nil {
+		log.Fatalf("Cannot configure TLS: %v", err)
 	}
 
 	address := fmt.Sprintf("%s:%d", config.Server.ListenIP, config.Server.ListenPort)
@@ -144,12 +668,24 @@ func main() {
 
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
-		if err := srv.ListenAndServeTLS(config.Server.TLSContext.CertificatePath, config.Server.TLSContext.PrivateKeyPath); err != nil {
+		// certificates are loaded by NewServerTLSConfig
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
 			log.Fatal(err)
 		}
 	}()
 	log.Infof("Listening on %s", address)
 
+	if config.Server.MetricsAddress != "" {
+		go func() {
+			metrics := http.NewServeMux()
+			metrics.Handle("/debug/vars", expvar.Handler())
+			log.Infof("Serving metrics on %s", config.Server.MetricsAddress)
+			if err := http.ListenAndServe(config.Server.MetricsAddress, metrics); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRouteProvider(t *testing.T) {
+	employees := Identity{Name: "employees", Provider: "aad", ClientID: "shared"}
+	google := Identity{Provider: "google", ClientID: "shared"}
+
+	tests := []struct {
+		Identities Identities
+		Route      Route
+		Name       string
+		Err        bool
+	}{
+		// routes without client use the shared providers
+		{Identities{employees}, Route{Host: "app.test"}, "", false},
+		{Identities{employees}, Route{Host: "app.test", Identity: RouteIdentity{Provider: "employees"}}, "", false},
+		{Identities{employees, google}, Route{Host: "app.test", Identity: RouteIdentity{Provider: "employees", ClientID: "app"}}, "employees@app.test", false},
+		{Identities{employees, google}, Route{Host: "app.test", Identity: RouteIdentity{Provider: "google", Scopes: []string{"email"}}}, "google@app.test", false},
+		// a single provider does not need to be named
+		{Identities{google}, Route{Host: "app.test", Identity: RouteIdentity{ClientID: "app"}}, "google@app.test", false},
+		{Identities{employees, google}, Route{Host: "app.test", Identity: RouteIdentity{ClientID: "app"}}, "", true},
+		{Identities{employees}, Route{Host: "app.test", Identity: RouteIdentity{Provider: "unknown", ClientID: "app"}}, "", true},
+	}
+
+	for _, test := range tests {
+		idp, err := newRouteProvider(test.Identities, test.Route)
+		assert.Equal(t, test.Err, err != nil)
+		if test.Name == "" {
+			assert.Nil(t, idp)
+			continue
+		}
+		assert.Equal(t, test.Name, idp.Name)
+		assert.True(t, idp.Private)
+	}
+}
+
+func TestNewProviders(t *testing.T) {
+	google := Identity{Provider: "google", ClientID: "shared"}
+
+	tests := []struct {
+		Identities Identities
+		Err        bool
+	}{
+		{Identities{google}, false},
+		{Identities{}, true},
+		{Identities{google, google}, true},
+		{Identities{{Name: "service-accounts", Provider: "google", ClientID: "shared"}}, true},
+	}
+
+	for _, test := range tests {
+		_, err := newProviders(test.Identities)
+		assert.Equal(t, test.Err, err != nil)
+	}
+}
+
+func TestNewBackchannelConfig(t *testing.T) {
+	tests := []struct {
+		JWKSURL string
+		Issuer  string
+		Enabled bool
+		Err     bool
+	}{
+		{"", "", false, false},
+		{"https://idp.test/keys", "https://idp.test", true, false},
+		// logout tokens could not be matched to the provider without issuer
+		{"https://idp.test/keys", "", false, true},
+	}
+
+	for _, test := range tests {
+		conf := Identity{Provider: "oidc", ClientID: "helios"}
+		conf.OAuth2.JWKSURL = test.JWKSURL
+		conf.OAuth2.Issuer = test.Issuer
+		backchannel, err := newBackchannelConfig(conf)
+		assert.Equal(t, test.Err, err != nil)
+		assert.Equal(t, test.Enabled, backchannel.KeySet != nil)
+	}
+}
@@ -2,12 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Supported upstream protocols
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+	ProtocolGRPC  = "grpc"
+	// ProtocolTCP tunnels WebSocket connections to a tcp:// upstream
+	ProtocolTCP = "tcp"
 )
 
 // ReverseProxyConfig configuration settings for a proxy instance
@@ -15,6 +29,13 @@ type ReverseProxyConfig struct {
 	ConnectTimeout time.Duration
 	Timeout        time.Duration
 	IdleTimeout    time.Duration
+	Protocol       string
+	TLS            *tls.Config
+	// Transport is shared by every proxy of an upstream. One is created when nil
+	Transport http.RoundTripper
+	Headers   []*HeaderPolicy
+	Rewrite   *PathRewrite
+	Identity  *IdentityForwarder
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -29,13 +50,46 @@ func singleJoiningSlash(a, b string) string {
 	return a + b
 }
 
+// joinURLPath joins the upstream and request paths, keeping the escaped form of the request path
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+	return singleJoiningSlash(a.Path, b.Path), singleJoiningSlash(apath, bpath)
+}
+
 // NewSingleHostReverseProxy creates a new reverse proxy instance
-func NewSingleHostReverseProxy(target *url.URL, conf ReverseProxyConfig) http.Handler {
+func NewSingleHostReverseProxy(target *url.URL, conf ReverseProxyConfig) (http.Handler, error) {
+	transport := conf.Transport
+	if transport == nil {
+		var err error
+		if transport, err = NewTransport(target, conf); err != nil {
+			return nil, err
+		}
+	}
+
 	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
+		if conf.Identity != nil {
+			conf.Identity.Apply(req)
+		}
+		applyRequestHeaders(req, conf.Headers)
+
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if conf.Rewrite != nil && conf.Rewrite.Rewrites() {
+			// rewrites work on the decoded path, which is sent encoded again
+			req.URL.Path = singleJoiningSlash(target.Path, conf.Rewrite.Path(req.URL.Path))
+			req.URL.RawPath = ""
+		} else {
+			// keep the original encoding, so %2F is not sent as a path separator
+			req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+		}
+		if conf.Rewrite != nil {
+			req.Host = conf.Rewrite.Host(req.Host, target)
+		}
 		if targetQuery == "" || req.URL.RawQuery == "" {
 			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
@@ -47,27 +101,98 @@ func NewSingleHostReverseProxy(target *url.URL, conf ReverseProxyConfig) http.Ha
 		}
 	}
 
+	flushInterval := 200 * time.Millisecond
+	if conf.Protocol == ProtocolGRPC {
+		// gRPC streams messages, flush them as soon as they arrive
+		flushInterval = -1
+	}
+
 	return &httputil.ReverseProxy{
-		FlushInterval: 200 * time.Millisecond,
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, e error) {
-				// open conn
-				c, err := net.DialTimeout(network, addr, conf.ConnectTimeout)
-				if err != nil {
-					return c, err
-				}
-				// set read/write timeout
-				if err := c.SetDeadline(time.Now().Add(conf.Timeout)); err != nil {
-					return c, err
-				}
-
-				return c, err
+		FlushInterval: flushInterval,
+		Transport:     transport,
+		Director:      director,
+		ModifyResponse: func(resp *http.Response) error {
+			applyResponseHeaders(resp, conf.Headers)
+			return nil
+		},
+	}, nil
+}
+
+// NewTransport creates the round tripper used to talk to an upstream using the configured protocol
+func NewTransport(target *url.URL, conf ReverseProxyConfig) (http.RoundTripper, error) {
+	dial := func(network, addr string) (net.Conn, error) {
+		// open conn
+		c, err := net.DialTimeout(network, addr, conf.ConnectTimeout)
+		if err != nil {
+			return c, err
+		}
+		// set read/write timeout
+		if err := c.SetDeadline(time.Now().Add(conf.Timeout)); err != nil {
+			return c, err
+		}
+
+		return c, err
+	}
+
+	protocol := conf.Protocol
+	if protocol == ProtocolGRPC {
+		// gRPC always runs over HTTP/2, with or without TLS depending on the upstream scheme
+		protocol = ProtocolH2C
+		if target.Scheme == "https" {
+			protocol = ProtocolH2
+		}
+	}
+
+	// HTTP/2 connections multiplex long lived streams, so they get no deadline and requests end with their context
+	switch protocol {
+	case "", ProtocolHTTP1:
+		return &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(network, addr)
 			},
+			TLSClientConfig:        conf.TLS,
 			TLSHandshakeTimeout:    10 * time.Second,
 			IdleConnTimeout:        conf.IdleTimeout,
 			MaxResponseHeaderBytes: 1 << 20,
 			DisableCompression:     true,
-		},
-		Director: director,
+		}, nil
+	case ProtocolH2:
+		if target.Scheme != "https" {
+			return nil, fmt.Errorf("protocol %q requires an https upstream, use %q for cleartext", ProtocolH2, ProtocolH2C)
+		}
+		return &http2.Transport{
+			TLSClientConfig: conf.TLS,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialH2(network, addr, cfg, conf.ConnectTimeout)
+			},
+			DisableCompression: true,
+		}, nil
+	case ProtocolH2C:
+		if target.Scheme != "http" {
+			return nil, fmt.Errorf("protocol %q requires an http upstream", ProtocolH2C)
+		}
+		return &http2.Transport{
+			// h2c uses prior knowledge, so the "TLS" dialer hands back a plain connection
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, conf.ConnectTimeout)
+			},
+			DisableCompression: true,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream protocol %q", conf.Protocol)
+	}
+}
+
+// dialH2 opens a TLS connection and fails when the upstream does not negotiate HTTP/2, instead of falling back to HTTP/1.1
+func dialH2(network, addr string, cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s does not support HTTP/2, it negotiated %q", addr, p)
 	}
+	return conn, nil
 }
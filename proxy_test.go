@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestNewSingleHostReverseProxy_Rewrite(t *testing.T) {
+	// echoes the path and host received by the upstream
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		_, _ = w.Write([]byte(r.URL.EscapedPath()))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		Path         Path
+		RequestPath  string
+		ExpectedPath string
+		ExpectedHost string
+	}{
+		{
+			Path:         Path{Path: "/grafana/"},
+			RequestPath:  "/grafana/api/health",
+			ExpectedPath: "/grafana/api/health",
+			ExpectedHost: "helios",
+		},
+		{
+			// paths without rewrites keep their encoding
+			Path:         Path{Path: "/"},
+			RequestPath:  "/files/a%2Fb%20c",
+			ExpectedPath: "/files/a%2Fb%20c",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/", HostRewrite: HostRewriteUpstream},
+			RequestPath:  "/files/a%2Fb",
+			ExpectedPath: "/files/a%2Fb",
+			ExpectedHost: backendURL.Host,
+		},
+		{
+			Path:         Path{Path: "/grafana/", StripPrefix: true},
+			RequestPath:  "/grafana/api/health",
+			ExpectedPath: "/api/health",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/grafana/", StripPrefix: true},
+			RequestPath:  "/grafana/",
+			ExpectedPath: "/",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/api/", PrefixRewrite: "/v2/"},
+			RequestPath:  "/api/users",
+			ExpectedPath: "/v2/users",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/", Rewrite: RegexRewrite{Regex: "^/users/(\\d+)/avatar$", Replacement: "/avatars/$1.png"}},
+			RequestPath:  "/users/42/avatar",
+			ExpectedPath: "/avatars/42.png",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/", HostRewrite: HostRewriteOriginal},
+			RequestPath:  "/",
+			ExpectedPath: "/",
+			ExpectedHost: "helios",
+		},
+		{
+			Path:         Path{Path: "/", HostRewrite: HostRewriteUpstream},
+			RequestPath:  "/",
+			ExpectedPath: "/",
+			ExpectedHost: backendURL.Host,
+		},
+		{
+			Path:         Path{Path: "/", HostRewrite: "internal.example.com"},
+			RequestPath:  "/",
+			ExpectedPath: "/",
+			ExpectedHost: "internal.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		rewrite, err := NewPathRewrite(test.Path)
+		assert.NoError(t, err)
+
+		proxy, err := NewSingleHostReverseProxy(backendURL, ReverseProxyConfig{
+			ConnectTimeout: time.Second,
+			Timeout:        5 * time.Second,
+			Rewrite:        rewrite,
+		})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "http://helios"+test.RequestPath, nil)
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, req)
+
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, test.ExpectedPath, string(body))
+		assert.Equal(t, test.ExpectedHost, res.Header().Get("X-Host"))
+	}
+}
+
+func TestNewPathRewrite(t *testing.T) {
+	tests := []struct {
+		Path  Path
+		Valid bool
+	}{
+		{Path{Path: "/", StripPrefix: true}, true},
+		{Path{Path: "/", Rewrite: RegexRewrite{Regex: "("}}, false},
+		{Path{Path: "/", StripPrefix: true, PrefixRewrite: "/v2/"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := NewPathRewrite(test.Path)
+		assert.Equal(t, test.Valid, err == nil)
+	}
+
+	// paths without rewrites are proxied untouched
+	rewrite, err := NewPathRewrite(Path{Path: "/"})
+	assert.NoError(t, err)
+	assert.Nil(t, rewrite)
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		Protocol  string
+		URL       string
+		Transport http.RoundTripper
+	}{
+		{"", "https://upstream", &http.Transport{}},
+		{ProtocolHTTP1, "http://upstream", &http.Transport{}},
+		{ProtocolH2, "https://upstream", &http2.Transport{}},
+		{ProtocolH2, "http://upstream", nil},
+		{ProtocolH2C, "http://upstream", &http2.Transport{}},
+		{ProtocolH2C, "https://upstream", nil},
+		{ProtocolGRPC, "https://upstream", &http2.Transport{}},
+		{ProtocolGRPC, "http://upstream", &http2.Transport{}},
+		{"spdy", "https://upstream", nil},
+	}
+
+	for _, test := range tests {
+		target, _ := url.Parse(test.URL)
+		transport, err := NewTransport(target, ReverseProxyConfig{Protocol: test.Protocol})
+		if test.Transport == nil {
+			assert.Error(t, err, test.Protocol, test.URL)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, reflect.TypeOf(test.Transport), reflect.TypeOf(transport), test.Protocol, test.URL)
+		if h2, ok := transport.(*http2.Transport); ok {
+			assert.Equal(t, test.URL == "http://upstream", h2.AllowHTTP, test.Protocol, test.URL)
+		}
+	}
+}
+
+// grpcBackend answers like a gRPC server, with the status in trailers, after the connection deadline of HTTP/1 upstreams
+func grpcBackend(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		time.Sleep(150 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	})
+}
+
+func TestNewSingleHostReverseProxy_GRPC(t *testing.T) {
+	cleartext := httptest.NewServer(h2c.NewHandler(grpcBackend(t), &http2.Server{}))
+	defer cleartext.Close()
+	encrypted := httptest.NewUnstartedServer(grpcBackend(t))
+	encrypted.EnableHTTP2 = true
+	encrypted.StartTLS()
+	defer encrypted.Close()
+	// upstreams that only speak HTTP/1.1 are rejected instead of silently downgraded
+	http1 := httptest.NewTLSServer(grpcBackend(t))
+	defer http1.Close()
+
+	tests := []struct {
+		Server *httptest.Server
+		Status int
+	}{
+		{cleartext, http.StatusOK},
+		{encrypted, http.StatusOK},
+		{http1, http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		target, _ := url.Parse(test.Server.URL)
+		conf := ReverseProxyConfig{ConnectTimeout: time.Second, Timeout: 100 * time.Millisecond, Protocol: ProtocolGRPC}
+		if test.Server.TLS != nil {
+			roots := x509.NewCertPool()
+			roots.AddCert(test.Server.Certificate())
+			conf.TLS = &tls.Config{RootCAs: roots}
+		}
+		proxy, err := NewSingleHostReverseProxy(target, conf)
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("POST", "http://helios/helloworld.Greeter/SayHello", nil)
+		req.Header.Set("Content-Type", "application/grpc")
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, req)
+
+		assert.Equal(t, test.Status, res.Code, test.Server.URL)
+		if test.Status == http.StatusOK {
+			assert.Equal(t, "message", res.Body.String())
+			assert.Equal(t, "0", res.Result().Trailer.Get("Grpc-Status"))
+			assert.Equal(t, "ok", res.Result().Trailer.Get("Grpc-Message"))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Host rewrite modes. Any other value is used as a literal Host header
+const (
+	HostRewriteOriginal = "original"
+	HostRewriteUpstream = "upstream"
+)
+
+// PathRewrite rewrites the path and host of requests before they are sent upstream
+type PathRewrite struct {
+	prefix        string
+	stripPrefix   bool
+	prefixRewrite string
+	regex         *regexp.Regexp
+	replacement   string
+	host          string
+}
+
+// NewPathRewrite creates the rewrite rules of a path, nil when the path rewrites neither path nor host
+func NewPathRewrite(path Path) (*PathRewrite, error) {
+	rw := &PathRewrite{
+		prefix:        path.Path,
+		stripPrefix:   path.StripPrefix,
+		prefixRewrite: path.PrefixRewrite,
+		replacement:   path.Rewrite.Replacement,
+		host:          path.HostRewrite,
+	}
+
+	rewrites := 0
+	if path.StripPrefix {
+		rewrites++
+	}
+	if path.PrefixRewrite != "" {
+		rewrites++
+	}
+	if path.Rewrite.Regex != "" {
+		rewrites++
+		re, err := regexp.Compile(path.Rewrite.Regex)
+		if err != nil {
+			return nil, err
+		}
+		rw.regex = re
+	}
+	if rewrites > 1 {
+		return nil, errors.New("strip_prefix, prefix_rewrite and rewrite are mutually exclusive")
+	}
+	if rewrites == 0 && path.HostRewrite == "" {
+		return nil, nil
+	}
+
+	return rw, nil
+}
+
+// Rewrites reports whether the path itself is rewritten, not only the host
+func (rw *PathRewrite) Rewrites() bool {
+	return rw.stripPrefix || rw.prefixRewrite != "" || rw.regex != nil
+}
+
+// Path returns the rewritten request path
+func (rw *PathRewrite) Path(p string) string {
+	switch {
+	case rw.stripPrefix && strings.HasPrefix(p, rw.prefix):
+		p = strings.TrimPrefix(p, rw.prefix)
+	case rw.prefixRewrite != "" && strings.HasPrefix(p, rw.prefix):
+		p = rw.prefixRewrite + strings.TrimPrefix(p, rw.prefix)
+	case rw.regex != nil:
+		p = rw.regex.ReplaceAllString(p, rw.replacement)
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return p
+}
+
+// Host returns the Host header sent upstream
+func (rw *PathRewrite) Host(original string, target *url.URL) string {
+	switch rw.host {
+	case "", HostRewriteOriginal:
+		return original
+	case HostRewriteUpstream:
+		return target.Host
+	default:
+		return rw.host
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion converts a version string like "1.2" to its crypto/tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// certReloader keeps upstream CA bundles and client certificates in sync with the files on disk
+type certReloader struct {
+	caPath   string
+	certPath string
+	keyPath  string
+
+	mu          sync.Mutex
+	caModTime   time.Time
+	pool        *x509.CertPool
+	certModTime time.Time
+	cert        *tls.Certificate
+}
+
+func modTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// CertPool returns the CA pool, reloading the bundle if it changed
+func (c *certReloader) CertPool() (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mt, err := modTime(c.caPath)
+	if err != nil {
+		return c.pool, err
+	}
+	if c.pool != nil && mt.Equal(c.caModTime) {
+		return c.pool, nil
+	}
+
+	pem, err := ioutil.ReadFile(c.caPath)
+	if err != nil {
+		return c.pool, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return c.pool, fmt.Errorf("no certificates found in %q", c.caPath)
+	}
+
+	log.Debugf("Loaded upstream CA bundle %q", c.caPath)
+	c.pool = pool
+	c.caModTime = mt
+
+	return c.pool, nil
+}
+
+// Certificate returns the client certificate, reloading the key pair if it changed
+func (c *certReloader) Certificate() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mt, err := modTime(c.certPath, c.keyPath)
+	if err != nil {
+		return c.cert, err
+	}
+	if c.cert != nil && mt.Equal(c.certModTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return c.cert, err
+	}
+
+	log.Debugf("Loaded upstream client certificate %q", c.certPath)
+	c.cert = &cert
+	c.certModTime = mt
+
+	return c.cert, nil
+}
+
+// verify checks the server certificate chain against the current CA pool
+func (c *certReloader) verify(serverName string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("upstream presented no certificates")
+	}
+
+	pool, err := c.CertPool()
+	if pool == nil {
+		return err
+	}
+	if err != nil {
+		// keep serving with the last good bundle
+		log.Errorf("Cannot reload upstream CA bundle: %v", err)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// NewUpstreamTLSConfig builds the client TLS configuration used to connect to an upstream
+func NewUpstreamTLSConfig(conf UpstreamTLS, host string) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := host
+	if conf.ServerName != "" {
+		serverName = conf.ServerName
+	}
+
+	tlsConf := &tls.Config{
+		ServerName: serverName,
+		MinVersion: minVersion,
+	}
+
+	reloader := &certReloader{
+		caPath:   conf.CAPath,
+		certPath: conf.CertificatePath,
+		keyPath:  conf.PrivateKeyPath,
+	}
+
+	if conf.CertificatePath != "" || conf.PrivateKeyPath != "" {
+		if conf.CertificatePath == "" || conf.PrivateKeyPath == "" {
+			return nil, errors.New("both certificate_path and private_key_path are required for client certificates")
+		}
+		if _, err := reloader.Certificate(); err != nil {
+			return nil, err
+		}
+		tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := reloader.Certificate()
+			if err != nil {
+				log.Errorf("Cannot reload upstream client certificate: %v", err)
+			}
+			return cert, nil
+		}
+	}
+
+	switch {
+	case conf.InsecureSkipVerify:
+		log.Warnf("TLS verification is disabled for upstream %q", host)
+		tlsConf.InsecureSkipVerify = true
+	case conf.CAPath != "":
+		if _, err := reloader.CertPool(); err != nil {
+			return nil, err
+		}
+		// the standard verification cannot pick up a reloaded pool,
+		// so skip it and verify the chain ourselves on every handshake
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return reloader.verify(serverName, rawCerts)
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// NewServerTLSConfig builds the listener TLS configuration. Client certificates are requested and verified against
+// the client CA bundle when one is configured, the bundle is reloaded when it changes
+func NewServerTLSConfig(conf TLSContext) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertificatePath, conf.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if conf.ClientCAPath == "" {
+		if conf.ClientAuth != "" {
+			return nil, errors.New("client_auth requires client_ca_path")
+		}
+		return tlsConf, nil
+	}
+
+	var clientAuth tls.ClientAuthType
+	switch conf.ClientAuth {
+	case "", "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", conf.ClientAuth)
+	}
+
+	reloader := &certReloader{caPath: conf.ClientCAPath}
+	if _, err := reloader.CertPool(); err != nil {
+		return nil, err
+	}
+	tlsConf.ClientAuth = clientAuth
+	tlsConf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := reloader.CertPool()
+		if err != nil {
+			// keep serving with the last good bundle
+			log.Errorf("Cannot reload client CA bundle: %v", err)
+		}
+		c := tlsConf.Clone()
+		c.ClientCAs = pool
+		// the server only adds its protocols to the base configuration, keep offering HTTP/2
+		c.NextProtos = []string{"h2", "http/1.1"}
+		return c, nil
+	}
+
+	return tlsConf, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns a PEM encoded certificate and key
+func (ca testCA) issue(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.SerialNumber = big.NewInt(2)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+		return path
+	}
+
+	serverCA, devicesCA, otherCA := newTestCA(t, "server"), newTestCA(t, "devices"), newTestCA(t, "other")
+	serverCert, serverKey := serverCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "helios"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	conf := TLSContext{
+		CertificatePath: write("server.pem", serverCert),
+		PrivateKeyPath:  write("server-key.pem", serverKey),
+		ClientCAPath:    write("devices.pem", devicesCA.pem()),
+	}
+
+	tlsConf, err := NewServerTLSConfig(conf)
+	assert.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(authentication.RequireClientCertificate(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			cert, _ := authentication.ClientCertificateFromRequest(r)
+			_, _ = w.Write([]byte(cert.Subject))
+		})))
+	server.TLS = tlsConf
+	server.StartTLS()
+	defer server.Close()
+
+	client := func(ca testCA) *http.Client {
+		roots := x509.NewCertPool()
+		roots.AddCert(serverCA.cert)
+		tlsClient := &tls.Config{RootCAs: roots}
+		if ca.cert != nil {
+			certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+				Subject:     pkix.Name{CommonName: "laptop-42"},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			assert.NoError(t, err)
+			// present the certificate even when the server does not ask for its CA
+			tlsClient.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsClient}}
+	}
+
+	// verified device
+	res, err := client(devicesCA).Get(server.URL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "CN=laptop-42", string(body))
+
+	// HTTP/2 is negotiated along client certificates
+	certPEM, keyPEM := devicesCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "laptop-42"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	assert.Len(t, conn.ConnectionState().PeerCertificates, 1)
+	conn.Close()
+
+	// certificates are optional at the TLS layer, paths require them
+	res, err = client(testCA{}).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// certificates of other CAs fail the handshake
+	_, err = client(otherCA).Get(server.URL)
+	assert.Error(t, err)
+
+	// the bundle is reloaded when it changes
+	later := time.Now().Add(time.Minute)
+	write("devices.pem", otherCA.pem())
+	assert.NoError(t, os.Chtimes(conf.ClientCAPath, later, later))
+	res, err = client(otherCA).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	conf.ClientAuth = "sometimes"
+	_, err = NewServerTLSConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestNewUpstreamTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+		return path
+	}
+	touch := func(paths ...string) {
+		later := time.Now().Add(time.Minute)
+		for _, path := range paths {
+			assert.NoError(t, os.Chtimes(path, later, later))
+		}
+	}
+
+	upstreamCA, clientCA, otherCA := newTestCA(t, "upstream"), newTestCA(t, "helios"), newTestCA(t, "other")
+	serverCertPEM, serverKeyPEM := upstreamCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "upstream"},
+		DNSNames:    []string{"upstream.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	assert.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	// the upstream requires client certificates and echoes their common name
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	issueClient := func(name string) {
+		certPEM, keyPEM := clientCA.issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		touch(write("client.pem", certPEM), write("client-key.pem", keyPEM))
+	}
+	issueClient("helios-1")
+	conf := UpstreamTLS{
+		CAPath:          write("ca.pem", upstreamCA.pem()),
+		CertificatePath: filepath.Join(dir, "client.pem"),
+		PrivateKeyPath:  filepath.Join(dir, "client-key.pem"),
+		ServerName:      "upstream.internal",
+	}
+	// every request opens a new connection, so handshakes see the files on disk
+	get := func(tlsConf *tls.Config) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf, DisableKeepAlives: true}}
+		res, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	tlsConf, err := NewUpstreamTLSConfig(conf, "127.0.0.1")
+	assert.NoError(t, err)
+	body, err := get(tlsConf)
+	assert.NoError(t, err)
+	assert.Equal(t, "helios-1", body)
+
+	// client certificates are reloaded when they change
+	issueClient("helios-2")
+	body, err = get(tlsConf)
+	assert.NoError(t, err)
+	assert.Equal(t, "helios-2", body)
+
+	// the CA bundle pins the upstream certificate, and is reloaded when it changes
+	write("ca.pem", otherCA.pem())
+	touch(conf.CAPath)
+	_, err = get(tlsConf)
+	assert.Error(t, err)
+	write("ca.pem", upstreamCA.pem())
+	touch(conf.CAPath)
+	_, err = get(tlsConf)
+	assert.NoError(t, err)
+
+	// the chain is verified against the server name
+	wrongName := conf
+	wrongName.ServerName = "other.internal"
+	tlsConf, err = NewUpstreamTLSConfig(wrongName, "127.0.0.1")
+	assert.NoError(t, err)
+	_, err = get(tlsConf)
+	assert.Error(t, err)
+
+	// without a CA bundle, upstreams are verified against the system roots unless verification is disabled
+	insecure := conf
+	insecure.CAPath = ""
+	tlsConf, err = NewUpstreamTLSConfig(insecure, "127.0.0.1")
+	assert.NoError(t, err)
+	_, err = get(tlsConf)
+	assert.Error(t, err)
+	insecure.InsecureSkipVerify = true
+	tlsConf, err = NewUpstreamTLSConfig(insecure, "127.0.0.1")
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConf.VerifyPeerCertificate)
+	_, err = get(tlsConf)
+	assert.NoError(t, err)
+
+	reloader := &certReloader{caPath: conf.CAPath}
+	assert.Error(t, reloader.verify("upstream.internal", nil))
+
+	invalid := []UpstreamTLS{
+		{MinVersion: "1.4"},
+		{CertificatePath: conf.CertificatePath},
+		{CAPath: filepath.Join(dir, "missing.pem")},
+	}
+	for _, c := range invalid {
+		_, err := NewUpstreamTLSConfig(c, "127.0.0.1")
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnelBufferSize is the largest WebSocket message sent through tunnels
+const tunnelBufferSize = 32 * 1024
+
+var tunnelUpgrader = websocket.Upgrader{
+	ReadBufferSize:  tunnelBufferSize,
+	WriteBufferSize: tunnelBufferSize,
+}
+
+// TCPTunnel pipes authenticated WebSocket connections to a TCP address
+type TCPTunnel struct {
+	addr           string
+	connectTimeout time.Duration
+}
+
+// NewTCPTunnel creates a tunnel to a tcp://host:port upstream
+func NewTCPTunnel(target *url.URL, conf ReverseProxyConfig) (*TCPTunnel, error) {
+	if target.Scheme != "tcp" || target.Hostname() == "" || target.Port() == "" {
+		return nil, fmt.Errorf("protocol %q requires a tcp://host:port upstream", ProtocolTCP)
+	}
+	return &TCPTunnel{addr: target.Host, connectTimeout: conf.ConnectTimeout}, nil
+}
+
+func (t *TCPTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "TCP tunnels require a WebSocket upgrade, use helios tcp", http.StatusUpgradeRequired)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", t.addr, t.connectTimeout)
+	if err != nil {
+		log.Errorf("Cannot connect to %s: %v", t.addr, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	ws, err := tunnelUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the client
+		upstream.Close()
+		return
+	}
+
+	log.Debugf("Tunneling %s to %s", r.RemoteAddr, t.addr)
+	pipeWebSocket(ws, upstream)
+}
+
+// pipeWebSocket copies data between a WebSocket and a connection until either side closes, then closes both
+func pipeWebSocket(ws *websocket.Conn, conn io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			ws.Close()
+			conn.Close()
+		})
+	}
+
+	go func() {
+		defer closeBoth()
+		for {
+			_, r, err := ws.NextReader()
+			if err != nil {
+				return
+			}
+			if _, err := io.Copy(conn, r); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer closeBoth()
+	buf := make([]byte, tunnelBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cyakimov/helios/authentication"
+	"github.com/cyakimov/helios/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoServer listens on a local port and writes back every line it reads
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				lines := bufio.NewScanner(conn)
+				for lines.Scan() {
+					conn.Write(append(lines.Bytes(), '\n'))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestNewTCPTunnel(t *testing.T) {
+	tests := []struct {
+		URL   string
+		Valid bool
+	}{
+		{"tcp://db.internal:5432", true},
+		{"tcp://db.internal", false},
+		{"http://db.internal:5432", false},
+	}
+	for _, test := range tests {
+		target, err := url.Parse(test.URL)
+		assert.NoError(t, err)
+		_, err = NewTCPTunnel(target, ReverseProxyConfig{})
+		assert.Equal(t, test.Valid, err == nil, test.URL)
+	}
+}
+
+func TestTCPTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helios-client")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	assert.NoError(t, os.Setenv("XDG_CONFIG_HOME", dir))
+
+	echo := echoServer(t)
+	defer echo.Close()
+	tunnel, err := NewTCPTunnel(&url.URL{Scheme: "tcp", Host: echo.Addr().String()}, ReverseProxyConfig{ConnectTimeout: time.Second})
+	assert.NoError(t, err)
+
+	// the tunnel is served as the router does, behind the authentication and authorization of its route
+	idp, err := newProvider(Identity{Provider: "google", ClientID: "helios"})
+	assert.NoError(t, err)
+	auth := authentication.NewHeliosAuthenticationWithConfig(idp, authentication.Config{
+		JWT: authentication.JWTConfig{Secret: "test", Expiration: time.Hour},
+	})
+	authZ := authorization.NewAuthorization([]string{"'dba' in identity.groups"})
+	server := httptest.NewServer(auth.Middleware(authZ.Middleware(tunnel)))
+	defer server.Close()
+	token := func(groups ...string) string {
+		claims := &authentication.Claims{Groups: groups}
+		claims.Subject = "jane@acme.test"
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		token, err := authentication.IssueJWTWithClaims("test", claims)
+		assert.NoError(t, err)
+		return token
+	}
+	target, err := url.Parse(server.URL + "/postgres")
+	assert.NoError(t, err)
+
+	// plain requests are told to upgrade
+	req, _ := http.NewRequest("GET", target.String(), nil)
+	req.Header.Set(authentication.HeaderName, token("dba"))
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, res.StatusCode)
+
+	_, err = dialTunnel(target)
+	assert.Error(t, err)
+
+	host, err := hostURL(target.String())
+	assert.NoError(t, err)
+	assert.NoError(t, saveToken(host.String(), cachedToken{Token: "wrong", ExpiresAt: time.Now().Add(time.Hour)}))
+	_, err = dialTunnel(target)
+	assert.EqualError(t, err, "session of "+host.Host+" expired, run: helios login "+host.Host)
+
+	// the rules of the route apply to tunnels
+	denied := cachedToken{Token: token("engineering"), ExpiresAt: time.Now().Add(time.Hour)}
+	assert.NoError(t, saveToken(host.String(), denied))
+	_, err = dialTunnel(target)
+	assert.EqualError(t, err, "cannot open tunnel to "+target.String()+": 403 Forbidden")
+
+	assert.NoError(t, saveToken(host.String(), cachedToken{Token: token("dba"), ExpiresAt: time.Now().Add(time.Hour)}))
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer local.Close()
+	go serveTunnel(local, target)
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	lines := bufio.NewReader(conn)
+	for _, line := range []string{"hello\n", "world\n"} {
+		_, err = conn.Write([]byte(line))
+		assert.NoError(t, err)
+		reply, err := lines.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, line, reply)
+	}
+}